@@ -1,41 +1,86 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	gocli "github.com/gen64/go-cli"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
 	"os"
-	"regexp"
+	"os/signal"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
-	"reflect"
 )
 
+var errStaleDelivery = errors.New("Stale delivery")
+var errIgnoredDelivery = errors.New("Delivery ignored")
+var errForeignOwner = errors.New("Repository owner does not match the configured one")
+var errInvalidPayload = errors.New("invalid JSON payload")
+var errMissingPullRequest = errors.New("pull_request payload has no pull_request object")
+
 type App struct {
-	cfg           Config
-	githubPayload *GitHubPayload
-	githubAPI     *GitHubAPI
-	jenkinsAPI    *JenkinsAPI
-	cli           *gocli.CLI
-	cache         Cache
-	wg            sync.WaitGroup
+	cfg             Config
+	githubPayload   *GitHubPayload
+	githubAPI       *GitHubAPI
+	jenkinsAPI      *JenkinsAPI
+	cli             *gocli.CLI
+	cache           Cache
+	metrics         *Metrics
+	events          *EventBroker
+	errorLog        *ErrorLog
+	webhookSlots    chan struct{}
+	server          *http.Server
+	adminServer     *http.Server
+	grpcServer      *grpc.Server
+	tracingShutdown func(context.Context) error
+	// ready is set to 1 once the initial repository scan has completed and
+	// back to 0 when shutting down
+	ready int32
+	// rescanning is set to 1 while POST /rescan rebuilds the cache
+	rescanning int32
+	// cfgMu guards options of cfg that are reloaded on SIGHUP, see
+	// reloadConfig
+	cfgMu sync.RWMutex
+	// repositories holds topics and visibility of repositories by name
+	repositories   map[string]Repository
+	repositoriesMu sync.RWMutex
+}
+
+// ResponseEnvelope wraps JSON responses when ResponseEnvelope is enabled in the
+// config.
+type ResponseEnvelope struct {
+	Data interface{}  `json:"data"`
+	Meta ResponseMeta `json:"meta"`
+}
+
+type ResponseMeta struct {
+	Version   string `json:"version"`
+	Timestamp string `json:"timestamp"`
 }
 
 func (app *App) printIteration(i int, rc int) {
-	log.Print("Retry: (" + strconv.Itoa(i+1) + "/" + strconv.Itoa(rc) + ")")
+	logger.Info("Retrying Jenkins endpoint", "attempt", i+1, "attempts", rc)
 }
 
 func (app *App) getCrumbAndSleep(u string, t string, rd int) (string, error) {
 	crumb, err := app.jenkinsAPI.GetCrumb(app.cfg.Jenkins.BaseURL, u, t)
 	if err != nil {
-		log.Print("Error getting crumb")
+		logger.Error("Error getting crumb")
 		time.Sleep(time.Second * time.Duration(rd))
 		return "", errors.New("Error getting crumb")
 	}
@@ -64,17 +109,16 @@ func (app *App) processJenkinsEndpointRetries(endpointDef *JenkinsEndpoint, repo
 
 			resp, err := app.jenkinsAPI.Post(app.cfg.Jenkins.BaseURL+"/"+endpointPath, app.cfg.Jenkins.User, app.cfg.Jenkins.Token, crumb)
 			if err != nil {
-				log.Print("Error from request to " + endpointPath)
+				logger.Error("Error from request to Jenkins endpoint", "endpoint", endpointPath, "repo", repo, "num", num)
 				time.Sleep(time.Second * time.Duration(retryDelay))
 				iterations++
 				continue
 			}
 
-			log.Print("Posted to endpoint " + endpointPath)
+			logger.Info("Posted to Jenkins endpoint", "endpoint", endpointPath, "repo", repo, "num", num)
 
 			if !endpointDef.CheckHTTPStatus(resp.StatusCode) {
-				rs := strconv.Itoa(resp.StatusCode)
-				log.Print("HTTP Status " + rs + " different than expected ")
+				logger.Warn("Jenkins endpoint responded with unexpected HTTP status", "endpoint", endpointPath, "status", resp.StatusCode)
 				time.Sleep(time.Second * time.Duration(retryDelay))
 				iterations++
 				continue
@@ -87,7 +131,12 @@ func (app *App) processJenkinsEndpointRetries(endpointDef *JenkinsEndpoint, repo
 }
 
 func (app *App) triggerPRJob(repo string, num int) {
-	log.Print(app.cfg)
+	if logger.IsEnabled(LogLevelDebug) {
+		// options reloaded on SIGHUP are copied along with the rest
+		app.cfgMu.RLock()
+		logger.Debug("Triggering Jenkins jobs", "repo", repo, "num", num, "config", app.cfg.Redact())
+		app.cfgMu.RUnlock()
+	}
 	for _, endp := range app.cfg.Jenkins.Endpoints {
 		rd, err := endp.GetRetryDelay()
 		if err != nil {
@@ -101,27 +150,61 @@ func (app *App) triggerPRJob(repo string, num int) {
 	}
 }
 
-func (app *App) updateCache(action string, repo string, num int, branch string, depsAfter []string, branchesOnly bool) {
+// normalizeBranch strips the first matching prefix from BranchPrefixStrip, eg.
+// "feature/" so that "feature/foo" gets cached as "foo".
+func (app *App) normalizeBranch(branch string) string {
+	for _, prefix := range app.cfg.BranchPrefixStrip {
+		if prefix != "" && strings.HasPrefix(branch, prefix) {
+			return strings.TrimPrefix(branch, prefix)
+		}
+	}
+	return branch
+}
+
+// updateCache applies a change of a pull request to the cache. Mutations are
+// serialized by the cache mutex so callers run it synchronously.
+func (app *App) updateCache(action string, repo string, num int, branch string, depsAfter []string, softDepsAfter []string, branchesOnly bool) {
 	app.cache.mu.Lock()
-	defer app.wg.Done()
 	defer app.cache.mu.Unlock()
+	defer app.publishCacheEvent(action, repo, num)
+	app.metrics.ObserveCacheUpdate(action)
+
+	// blocked flags of the PR and of PRs depending on it are recomputed.
+	// Edges to closed PRs are kept without being indexed in Dependents, while
+	// edges to PRs that were never seen open are indexed, so all flags are
+	// recomputed when the PR gets opened or closed. Evicted PRs count as open
+	// as they keep blocking.
+	_, wasOpen := app.cache.Branches[repo][num]
+	wasOpen = wasOpen || app.cache.IsEvicted(repo, num)
+	affected := append([]PullRequestRef{{Repository: repo, Number: num}}, app.cache.Dependents.Get(repo, num)...)
+	defer func() {
+		_, isOpen := app.cache.Branches[repo][num]
+		isOpen = isOpen || app.cache.IsEvicted(repo, num)
+		if isOpen != wasOpen {
+			app.cache.refreshAllBlocked()
+			return
+		}
+		app.cache.refreshBlocked(append(affected, app.cache.Dependents.Get(repo, num)...))
+	}()
 
 	// branches only
-	if action == "opened" || action == "edited" || action == "reopened" {
+	if app.isPullRequestUpdated(action) {
 		// set PR in Branches
-		_, hasKey := app.cache.Branches[repo]
-		if !hasKey {
-			app.cache.Branches[repo] = map[int]string{}
-		}
-		app.cache.Branches[repo][num] = branch
+		app.cache.setBranch(repo, num, app.normalizeBranch(branch))
+		app.cache.touch(repo, num)
+		app.cache.SetState(repo, num, PullRequestStateOpen)
+		app.evictPullRequests(repo, num)
 	}
 
 	if action == "closed" {
 		// unset PR from Branches
-		_, hasKey := app.cache.Branches[repo][num]
-		if hasKey {
-			delete(app.cache.Branches[repo], num)
-		}
+		app.cache.deleteBranch(repo, num)
+		app.cache.forget(repo, num)
+		app.cache.SetLabels(repo, num, nil)
+		app.cache.SetRawDependsOn(repo, num, nil)
+		app.cache.SetDeclared(repo, num, true)
+		// merged ones are marked so afterwards, see updateMerged
+		app.cache.SetState(repo, num, PullRequestStateClosed)
 	}
 
 	if branchesOnly {
@@ -129,370 +212,1955 @@ func (app *App) updateCache(action string, repo string, num int, branch string,
 	}
 
 	// dependencies and tidying up
-	// TODO: this can be refactored as it became quite messy...
-	depsBefore := map[string]int{}
-	_, hasKey := app.cache.Dependencies[repo]
-	if hasKey {
-		_, hasKey2 := app.cache.Dependencies[repo][num]
-		if hasKey2 {
-			for r, n := range app.cache.Dependencies[repo][num] {
-				depsBefore[r] = n
-			}
-		}
-	}
+	depsBefore := app.cache.Dependencies.Get(repo, num)
 
-	if action == "opened" || action == "edited" || action == "reopened" {
-		_, hasKey = app.cache.Dependencies[repo]
-		if !hasKey {
-			app.cache.Dependencies[repo] = map[int]map[string]int{}
+	if app.isPullRequestUpdated(action) {
+		// clean dependencies and dependents as these are set again below
+		for _, dep := range depsBefore {
+			app.cache.removeDependency(repo, num, dep.Key(), dep.Number)
+			app.cache.Dependents.Remove(dep.Repository, dep.Number, repo, num)
+			app.tidyUpPullRequest(dep.Repository, dep.Number)
 		}
+		app.cache.Dependencies.Init(repo, num)
+		app.cache.DeleteAnnotations(repo, num)
+		app.cache.SetRawDependsOn(repo, num, depsAfter)
 
-		// dependencies are added in the 'tidy' loop
-		app.cache.Dependencies[repo][num] = map[string]int{}
-
-		// clean dependents as these are set in the 'tidy' loop
-		for r, n := range depsBefore {
-			_, hasKey := app.cache.Dependents[r][n][repo]
-			if hasKey {
-				delete(app.cache.Dependents[r][n], repo)
+		// add new dependencies
+		seen := map[string]bool{}
+		for _, dep := range depsAfter {
+			ref, err := parseDependsOn(dep)
+			if err != nil {
+				continue
 			}
-			// tidy up: if dependency branch does not exist then tidy it up as well
-			_, hasKey = app.cache.Branches[r][n]
-			if !hasKey {
-				// tidy up - remove entries for non-existing PR
-				_, hasKey2 := app.cache.Dependencies[r][n]
-				if hasKey2 {
-					delete(app.cache.Dependencies[r], n)
+			ref.Repository = app.cache.GetRepositoryName(ref.Repository)
+			// repeated lines pointing to the same target, possibly with a
+			// different annotation, are applied once
+			target := fmt.Sprintf("%s#%d", ref.Key(), ref.Number)
+			if seen[target] {
+				continue
+			}
+			seen[target] = true
+
+			// unknown targets are stored unless strict_dependencies is set, so
+			// that a pull request opened later blocks its dependents
+			_, hasKey := app.cache.Branches[ref.Repository][ref.Number]
+			if !hasKey && !app.cache.IsEvicted(ref.Repository, ref.Number) {
+				msg := "Dependency on a pull request which is not open"
+				if app.cfg.PullRequestDependsOn != nil && !app.checkIfRepoShouldBeIncluded(ref.Repository) {
+					msg = "Dependency on a repository which is not tracked"
 				}
-				_, hasKey2 = app.cache.Dependents[r][n]
-				if hasKey2 {
-					delete(app.cache.Dependents[r], n)
+				if app.cfg.StrictDependencies {
+					logger.Warn(msg+". Ignoring it", "repo", repo, "num", num, "dependency", dep, "dependency_repo", ref.Repository)
+					app.tidyUpPullRequest(ref.Repository, ref.Number)
+					continue
 				}
+				logger.Warn(msg, "repo", repo, "num", num, "dependency", dep, "dependency_repo", ref.Repository)
 			}
-		}
 
-		// add new dependencies
-		for _, dep := range depsAfter {
-			vals := strings.Split(dep, "#")
-			i, err := strconv.Atoi(vals[1])
-			if err == nil {
-				_, hasKey := app.cache.Branches[vals[0]][i]
-				if !hasKey {
-					// tidy up - remove entries for non-existing PR
-					_, hasKey2 := app.cache.Dependencies[vals[0]][i]
-					if hasKey2 {
-						delete(app.cache.Dependencies[vals[0]], i)
-					}
-					_, hasKey2 = app.cache.Dependents[vals[0]][i]
-					if hasKey2 {
-						delete(app.cache.Dependents[vals[0]], i)
-					}
-				} else {
-					// set PR in Dependencies and Dependents
-					if action == "opened" || action == "edited" || action == "reopened" {
-						app.cache.Dependencies[repo][num][vals[0]] = i
-	
-						// set dependency PR in Dependents
-						_, hasKey2 := app.cache.Dependents[vals[0]]
-						if !hasKey2 {
-							app.cache.Dependents[vals[0]] = map[int]map[string]int{}
-						}
-						_, hasKey2 = app.cache.Dependents[vals[0]][i]
-						if !hasKey2 {
-							app.cache.Dependents[vals[0]][i] = map[string]int{}
-						}
-						app.cache.Dependents[vals[0]][i][repo] = num
-					}
-				}
+			if app.cfg.MaxDependenciesPerRepo > 0 && app.countRepoDependencies(repo) >= app.cfg.MaxDependenciesPerRepo {
+				logger.Warn("Repository reached the limit of dependencies. Rejecting dependency", "repo", repo, "num", num, "dependency", dep, "limit", app.cfg.MaxDependenciesPerRepo)
+				continue
 			}
+
+			app.warnOnDependencyCycle(repo, num, ref)
+
+			// set PR in Dependencies and Dependents
+			app.cache.addDependency(repo, num, ref.Key(), ref.Number)
+			app.cache.Dependents.Add(ref.Repository, ref.Number, repo, num)
+			app.cache.SetAnnotation(repo, num, ref)
 		}
 	}
 
 	if action == "closed" {
-		// unset PR in Dependencies
-		_, hasKey = app.cache.Dependencies[repo][num]
-		if hasKey {
-			delete(app.cache.Dependencies[repo], num)
-		}
-		// unset PR in Dependents
-		_, hasKey = app.cache.Dependents[repo][num]
-		if hasKey {
-			delete(app.cache.Dependents[repo], num)
-		}
-		// unset Dependent-PR connection if it exists
+		// unset PR in Dependencies and Dependents
+		app.cache.deleteDependencies(repo, num)
+		app.cache.Dependents.Delete(repo, num)
+		app.cache.DeleteAnnotations(repo, num)
+
+		// unset Dependent-PR connection for both cached and declared dependencies
+		deps := depsBefore
 		for _, dep := range depsAfter {
-			vals := strings.Split(dep, "#")
-			i, err := strconv.Atoi(vals[1])
+			ref, err := parseDependsOn(dep)
 			if err == nil {
-				_, hasKey1 := app.cache.Dependents[vals[0]][i][repo]
-				if hasKey1 {
-					if app.cache.Dependents[vals[0]][i][repo] == num {
-						delete(app.cache.Dependents[vals[0]][i], repo)
-					}
-				}
-				// additionally remove non-existing PRs as well
-				_, hasKey := app.cache.Branches[vals[0]][i]
-				if !hasKey {
-					// tidy up - remove entries for non-existing PR
-					_, hasKey2 := app.cache.Dependencies[vals[0]][i]
-					if hasKey2 {
-						delete(app.cache.Dependencies[vals[0]], i)
-					}
-					_, hasKey2 = app.cache.Dependents[vals[0]][i]
-					if hasKey2 {
-						delete(app.cache.Dependents[vals[0]], i)
-					}
-				}
+				deps = append(deps, ref)
 			}
 		}
+		for _, dep := range deps {
+			app.cache.Dependents.Remove(dep.Repository, dep.Number, repo, num)
+			// additionally remove non-existing PRs as well
+			app.tidyUpPullRequest(dep.Repository, dep.Number)
+		}
 	}
 
-	if action == "edited" {
-		if !reflect.DeepEqual(depsBefore, app.cache.Dependencies[repo][num]) {
+	app.updateSoftDependencies(action, repo, num, softDepsAfter)
+
+	if action == "edited" || action == "synchronize" {
+		if !reflect.DeepEqual(depsBefore, app.cache.Dependencies.Get(repo, num)) {
 			app.triggerPRJob(repo, num)
 		}
 	}
 }
 
-func (app *App) startHandler(cli *gocli.CLI) int {
-	c, err := ioutil.ReadFile(cli.Flag("config"))
+// warnOnDependencyCycle logs a warning when repo#num depending on dep closes a
+// cycle. The dependency is stored anyway. Cache mutex must be held by the
+// caller.
+func (app *App) warnOnDependencyCycle(repo string, num int, dep PullRequestRef) {
+	if dep.Repository == repo && dep.Number == num {
+		logger.Warn("Pull request depends on itself", "repo", repo, "num", num)
+		return
+	}
+	path := app.cache.findDependencyPath(dep, PullRequestRef{Repository: repo, Number: num})
+	if path == nil {
+		return
+	}
+	nodes := []string{fmt.Sprintf("%s#%d", repo, num)}
+	for _, pr := range path {
+		nodes = append(nodes, fmt.Sprintf("%s#%d", pr.Repository, pr.Number))
+	}
+	logger.Warn("Dependency closes a cycle", "repo", repo, "num", num, "dependency", fmt.Sprintf("%s#%d", dep.Repository, dep.Number), "cycle", strings.Join(nodes, " -> "))
+}
+
+// publishCacheEvent notifies /events subscribers about a pull request change.
+// Cache mutex must be held by the caller.
+func (app *App) publishCacheEvent(action string, repo string, num int) {
+	if app.events == nil {
+		return
+	}
+	app.events.Publish(CacheEvent{
+		Action:       action,
+		Repository:   repo,
+		Number:       num,
+		Branch:       app.cache.Branches[repo][num],
+		Dependencies: app.cache.Dependencies.Get(repo, num),
+		Time:         time.Now(),
+	})
+}
+
+// evictPullRequests removes least recently updated pull requests when cache
+// holds more than MaxCachedPullRequests of them. The pull request being
+// updated is never evicted. Cache mutex must be held by the caller.
+func (app *App) evictPullRequests(repo string, num int) {
+	if app.cfg.MaxCachedPullRequests <= 0 {
+		return
+	}
+	for app.cache.Stats().PullRequests > int64(app.cfg.MaxCachedPullRequests) {
+		pr, found := app.cache.getLeastRecentlyUpdated()
+		if !found || (pr.Repository == repo && pr.Number == num) {
+			return
+		}
+		logger.Info("Cache limit of pull requests reached. Evicting pull request", "limit", app.cfg.MaxCachedPullRequests, "repo", pr.Repository, "num", pr.Number)
+		app.cache.evict(pr.Repository, pr.Number)
+	}
+}
+
+// reloadPullRequest fetches an evicted pull request from GitHub and puts it
+// back in the cache.
+func (app *App) reloadPullRequest(ctx context.Context, repo string, num int) error {
+	pr, err := app.githubAPI.GetPullRequest(ctx, app.cfg.PullRequestDependsOn.Owner, repo, num, app.cfg.Token)
+	if err != nil {
+		return err
+	}
+
+	action := "opened"
+	if pr.State != "open" {
+		action = "closed"
+	}
+	logger.Info("Reloaded evicted pull request from GitHub", "repo", repo, "num", num)
+
+	app.updateCache(action, repo, num, pr.Branch, pr.DependsOn, pr.SoftDependsOn, false)
+	if action != "closed" {
+		app.updateLabels(action, repo, num, pr.Labels)
+		app.updateDeclared(repo, num, pr.Declared)
+	}
+	return nil
+}
+
+// updateLabels stores labels of a pull request. Labels of pull requests that
+// are not cached as open are ignored.
+func (app *App) updateLabels(action string, repo string, num int, labels []string) {
+	app.cache.mu.Lock()
+	defer app.cache.mu.Unlock()
+
+	_, hasKey := app.cache.Branches[repo][num]
+	if !hasKey {
+		return
+	}
+	app.cache.SetLabels(repo, num, labels)
+	if action == "labeled" || action == "unlabeled" {
+		app.publishCacheEvent(action, repo, num)
+	}
+}
+
+// updateDeclared records whether an open pull request declares its
+// dependencies, which is required by the RequireDeclaration policy.
+func (app *App) updateDeclared(repo string, num int, declared bool) {
+	app.cache.mu.Lock()
+	defer app.cache.mu.Unlock()
+
+	_, hasKey := app.cache.Branches[repo][num]
+	if !hasKey {
+		return
+	}
+	app.cache.SetDeclared(repo, num, declared)
+}
+
+// updateMerged marks a closed pull request as merged.
+func (app *App) updateMerged(repo string, num int) {
+	app.cache.mu.Lock()
+	defer app.cache.mu.Unlock()
+
+	if app.cache.States[repo][num] != PullRequestStateClosed {
+		return
+	}
+	app.cache.SetState(repo, num, PullRequestStateMerged)
+}
+
+// tidyUpPullRequest removes dependency entries of a pull request that is not
+// open anymore. Its dependents are kept as long as other pull requests still
+// depend on it. Cache mutex must be held by the caller.
+func (app *App) tidyUpPullRequest(repo string, num int) {
+	_, hasKey := app.cache.Branches[repo][num]
+	if hasKey {
+		return
+	}
+	app.cache.deleteDependencies(repo, num)
+	if len(app.cache.Dependents.Get(repo, num)) == 0 {
+		app.cache.Dependents.Delete(repo, num)
+	}
+}
+
+// parseDependsOn splits a "repo#num" or path qualified "repo/path#num"
+// dependency, optionally followed by an annotation such as "[JIRA-123]".
+// Number is stored as int everywhere so "#007" and "#7" are the same
+// dependency.
+func parseDependsOn(dep string) (PullRequestRef, error) {
+	annotation := ""
+	i := strings.Index(dep, " [")
+	if i > -1 && strings.HasSuffix(dep, "]") {
+		annotation = dep[i+2 : len(dep)-1]
+		dep = dep[:i]
+	}
+	vals := strings.Split(dep, "#")
+	if len(vals) != 2 {
+		return PullRequestRef{}, errors.New("Invalid dependency " + dep)
+	}
+	num, err := strconv.Atoi(vals[1])
+	if err != nil || num <= 0 {
+		return PullRequestRef{}, errors.New("Invalid dependency number in " + dep)
+	}
+	repo, path := splitDependencyKey(vals[0])
+	return PullRequestRef{Repository: repo, Number: num, Path: path, Annotation: annotation}, nil
+}
+
+// updateSoftDependencies stores advisory dependencies of a pull request. These
+// are not reflected in Dependents and never block the pull request. Cache
+// mutex must be held by the caller.
+func (app *App) updateSoftDependencies(action string, repo string, num int, softDepsAfter []string) {
+	if action == "closed" {
+		app.cache.SoftDependencies.Delete(repo, num)
+		return
+	}
+
+	if !app.isPullRequestUpdated(action) {
+		return
+	}
+
+	app.cache.SoftDependencies.Delete(repo, num)
+	app.cache.SoftDependencies.Init(repo, num)
+	for _, dep := range softDepsAfter {
+		ref, err := parseDependsOn(dep)
+		if err != nil {
+			continue
+		}
+		ref.Repository = app.cache.GetRepositoryName(ref.Repository)
+		_, hasKey := app.cache.Branches[ref.Repository][ref.Number]
+		if hasKey {
+			app.cache.SoftDependencies.Add(repo, num, ref.Key(), ref.Number)
+		}
+	}
+}
+
+// countRepoDependencies returns number of dependency edges declared by pull
+// requests in a repository. Cache mutex must be held by the caller.
+func (app *App) countRepoDependencies(repo string) int {
+	return app.cache.Dependencies.Count(repo)
+}
+
+func (app *App) loadConfig(path string) {
+	c, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.Fatal("Error reading config file")
+		logger.Fatal("Error reading config file", "path", path)
 	}
 
 	var cfg Config
 	cfg.SetFromJSON(c)
 	app.cfg = cfg
+	logger.Configure(app.cfg.GetLogLevel(), app.cfg.GetLogFormat())
+	app.githubAPI = NewGitHubAPI(&app.cfg)
+}
 
-	repos, err := app.githubAPI.GetRepositoriesList(app.cfg.PullRequestDependsOn.Owner, app.cfg.PullRequestDependsOn.Organization, app.cfg.Token)
+func (app *App) startHandler(cli *gocli.CLI) int {
+	app.loadConfig(cli.Flag("config"))
+	err := app.cfg.Validate()
 	if err != nil {
-		log.Fatal("Error fetching repository list from GitHub")
+		logger.Error(err.Error())
+		return 1
 	}
+	go app.startConfigReload(cli.Flag("config"))
 
-	filteredRepos := []string{}
-	for _, repo := range repos {
-		f := app.checkIfRepoShouldBeIncluded(repo)
-		if f {
-			filteredRepos = append(filteredRepos, repo)
+	if app.cfg.Tracing != nil && app.cfg.Tracing.Enabled {
+		shutdown, err := initTracing(app.cfg.Tracing)
+		if err != nil {
+			logger.Fatal("Error initializing tracing", "error", err)
 		}
+		app.tracingShutdown = shutdown
+		logger.Info("Tracing enabled")
 	}
 
-	log.Print("The following repositories match rules in the config file:")
-	log.Print(filteredRepos)
+	if app.cfg.MaxConcurrentWebhooks > 0 {
+		app.webhookSlots = make(chan struct{}, app.cfg.MaxConcurrentWebhooks)
+	}
+	app.errorLog = NewErrorLog(app.cfg.GetMaxRecentErrors())
 
-	// Nasty loop in a loop but this is executed just twice when app is initialized
-	for _, repo := range filteredRepos {
-		pullRequests, err := app.githubAPI.GetPullRequestList(app.cfg.PullRequestDependsOn.Owner, repo, app.cfg.Token)
-		if err != nil {
-			log.Fatal(fmt.Sprintf("Error fetching pull requests for %s", app.cfg.PullRequestDependsOn.Owner))
-		}
-		log.Print(fmt.Sprintf("The following pull requests have been found in the %s/%s repository", app.cfg.PullRequestDependsOn.Owner, repo))
-		log.Print(pullRequests)
+	loaded := app.loadCacheFile()
 
-		for _, pr := range pullRequests {
-			app.wg.Add(1)
-			go app.updateCache("opened", pr.Repository, pr.Number, pr.Branch, pr.DependsOn, true)
-			app.wg.Wait()
-		}
+	// signals are handled from now on so that a deploy during a long scan
+	// shuts down gracefully too
+	ctx := app.notifyShutdown()
+
+	// serve while scanning so that health checks pass for large owners,
+	// /readyz tells when the cache is warm
+	app.startAPI()
+	if app.cfg.GRPCPort != "" {
+		app.startGRPC()
 	}
 
-	// again same loop - sorry, dependencies have to be added once all PRs are available
-	for _, repo := range filteredRepos {
-		pullRequests, err := app.githubAPI.GetPullRequestList(app.cfg.PullRequestDependsOn.Owner, repo, app.cfg.Token)
-		if err != nil {
-			log.Fatal(fmt.Sprintf("Error fetching pull requests for %s", app.cfg.PullRequestDependsOn.Owner))
+	if app.cfg.PullRequestDependsOn != nil {
+		app.populateCache(ctx, loaded)
+	} else {
+		logger.Info("PullRequestDependsOn is not configured. Skipping repository scan")
+	}
+
+	if ctx.Err() == nil {
+		atomic.StoreInt32(&app.ready, 1)
+
+		if app.cfg.CacheExport != nil {
+			go app.startCacheExport()
 		}
 
-		for _, pr := range pullRequests {
-			app.wg.Add(1)
-			go app.updateCache("opened", pr.Repository, pr.Number, pr.Branch, pr.DependsOn, false)
-			app.wg.Wait()
+		if app.cfg.CacheFile != "" {
+			go app.startCacheFlush()
 		}
 	}
 
-	log.Print("The following Branches have been cached:")
-	log.Print(app.cache.Branches)
-
-	log.Print("The following Dependencies have been found:")
-	log.Print(app.cache.Dependencies)
-
-	done := make(chan bool)
-	go app.startAPI()
-	<-done
+	<-ctx.Done()
+	app.shutdown()
 	return 0
 }
 
-func (app *App) startAPI() {
-	router := mux.NewRouter()
-	router.HandleFunc("/", app.apiHandler).Methods("POST", "GET")
-	log.Print("Starting daemon listening on " + app.cfg.Port + "...")
-	log.Fatal(http.ListenAndServe(":"+app.cfg.Port, router))
+// notifyShutdown returns a context which is cancelled once SIGINT or SIGTERM
+// is received.
+func (app *App) notifyShutdown() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		logger.Info("Got signal. Shutting down...", "signal", s)
+		cancel()
+	}()
+	return ctx
 }
 
-func (app *App) apiHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "POST" {
-		app.apiHandlerPost(w, r)
-	} else if r.Method == "GET" {
-		app.apiHandlerGet(w, r)
-	} else {
-		w.WriteHeader(http.StatusBadRequest)
+// shutdown gives in-flight requests ShutdownTimeout to finish before the
+// remaining connections are forcibly closed. The cache is flushed afterwards.
+func (app *App) shutdown() {
+	atomic.StoreInt32(&app.ready, 0)
+
+	timeout := app.cfg.GetShutdownTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, server := range []*http.Server{app.server, app.adminServer} {
+		if server == nil {
+			continue
+		}
+		err := server.Shutdown(ctx)
+		if err != nil {
+			logger.Warn("Requests did not finish in time. Forcing close", "timeout", timeout)
+			server.Close()
+		}
 	}
-}
 
-func (app *App) apiHandlerGet(w http.ResponseWriter, r *http.Request) {
-	if app.cfg.APITokenHeader != "" && app.cfg.APITokenValue != "" {
-		if r.Header.Get(app.cfg.APITokenHeader) != app.cfg.APITokenValue {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
+	if app.grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			app.grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			app.grpcServer.Stop()
 		}
 	}
 
-	b, err := json.Marshal(app.cache)
+	// cache updates run synchronously within requests, which have finished
+	// by now, and flushing takes the cache lock so it never sees a partial
+	// update
+	if app.cfg.CacheFile != "" {
+		app.flushCacheFile()
+	}
+
+	if app.tracingShutdown != nil {
+		app.tracingShutdown(ctx)
+	}
+}
+
+// populateCache fetches open pull requests of matching repositories. When
+// the cache was loaded from a file only differences are applied. The scan
+// stops early once ctx is cancelled.
+func (app *App) populateCache(ctx context.Context, loaded bool) {
+	filteredRepos, err := app.getMatchingRepositories(ctx)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		// keep serving what was loaded, if anything, rather than crashing
+		logger.Error("Error fetching repository list from GitHub", "error", err)
+		app.cache.AddWarning("", "Error fetching repository list, pull requests were not scanned: "+err.Error())
 		return
 	}
-	w.Header().Set("content-type", "application/json")
-	w.Write(b)
+
+	if loaded {
+		app.reconcileRepositories(ctx, filteredRepos)
+	} else {
+		app.addRepositories(ctx, filteredRepos)
+	}
+	if ctx.Err() != nil {
+		logger.Info("Repository scan interrupted")
+		return
+	}
+
+	snapshot := app.cache.Snapshot()
+
+	logger.Debug("Branches have been cached", "branches", snapshot.Branches)
+	logger.Debug("Dependencies have been found", "dependencies", snapshot.Dependencies)
+
+	app.processOrphanedDependencies()
 }
 
-func (app *App) apiHandlerPost(w http.ResponseWriter, r *http.Request) {
-	b, err := ioutil.ReadAll(r.Body)
+// getMatchingRepositories returns repositories of the owner that match rules
+// in the config.
+func (app *App) getMatchingRepositories(ctx context.Context) ([]string, error) {
+	repos, err := app.githubAPI.GetRepositoriesList(ctx, app.cfg.PullRequestDependsOn.Owner, app.cfg.PullRequestDependsOn.Organization, app.cfg.Token)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+		return nil, err
 	}
+	app.setRepositories(repos)
 
-	event := app.githubPayload.GetEvent(r)
-	signature := app.githubPayload.GetSignature(r)
-	if app.cfg.Secret != "" {
-		if !app.githubPayload.VerifySignature([]byte(app.cfg.Secret), signature, &b) {
-			http.Error(w, "Signature verification failed", 401)
-			return
-			// log.Print("Signature verification failed - oh well")
+	filteredRepos := []string{}
+	for _, repo := range app.skipArchivedRepositories(repos) {
+		f := app.checkIfRepoShouldBeIncluded(repo.Name)
+		if f {
+			filteredRepos = append(filteredRepos, repo.Name)
 		}
 	}
 
-	if event != "ping" {
-		err = app.processGitHubPayload(&b, event)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
+	logger.Info("Repositories matching rules in the config file", "repos", strings.Join(filteredRepos, ","))
+	return filteredRepos, nil
+}
+
+// addRepositories fetches open pull requests of the repositories and puts
+// them in the cache. Nothing more is fetched once ctx is cancelled.
+func (app *App) addRepositories(ctx context.Context, repos []string) {
+	// Nasty loop in a loop but this is executed just twice when app is initialized
+	fetchedPullRequests := map[string][]PullRequest{}
+	for _, repo := range repos {
+		if ctx.Err() != nil {
 			return
 		}
+		pullRequests, err := app.githubAPI.GetPullRequestList(ctx, app.cfg.PullRequestDependsOn.Owner, repo, app.cfg.Token)
+		if err != nil {
+			// carry on with other repositories and let consumers know data is incomplete
+			logger.Error("Error fetching pull requests", "owner", app.cfg.PullRequestDependsOn.Owner, "repo", repo, "error", err)
+			app.cache.AddWarning(repo, "Error fetching pull requests: "+err.Error())
+			continue
+		}
+		if app.cfg.SkipDraftsAtStartup {
+			pullRequests = app.skipDrafts(pullRequests)
+		}
+		fetchedPullRequests[repo] = pullRequests
+		logger.Info("Pull requests have been found", "owner", app.cfg.PullRequestDependsOn.Owner, "repo", repo, "count", len(pullRequests))
+
+		for _, pr := range pullRequests {
+			app.updateCache("opened", pr.Repository, pr.Number, pr.Branch, pr.DependsOn, pr.SoftDependsOn, true)
+		}
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("content-type", "application/json")
+	// again same loop - sorry, dependencies have to be added once all PRs are available
+	for _, repo := range repos {
+		for _, pr := range fetchedPullRequests[repo] {
+			app.updateCache("opened", pr.Repository, pr.Number, pr.Branch, pr.DependsOn, pr.SoftDependsOn, false)
+			app.updateLabels("opened", pr.Repository, pr.Number, pr.Labels)
+			app.updateDeclared(pr.Repository, pr.Number, pr.Declared)
+		}
+	}
 }
 
-func (app *App) processGitHubPayload(b *([]byte), event string) error {
-	j := make(map[string]interface{})
-	err := json.Unmarshal(*b, &j)
-	if err != nil {
-		return errors.New("Got non-JSON payload")
+// reconcileRepositories brings a cache loaded from a file up to date. Pull
+// requests which got closed or changed in the meantime are updated and the
+// ones that did not change are left as they are. Nothing is changed once ctx
+// is cancelled.
+func (app *App) reconcileRepositories(ctx context.Context, repos []string) {
+	included := map[string]bool{}
+	for _, repo := range repos {
+		included[repo] = true
+	}
+	for repo := range app.cache.Snapshot().Branches {
+		if !included[repo] {
+			logger.Info("Repository does not match rules anymore. Removing its pull requests", "repo", repo)
+			app.removeRepository(repo)
+		}
 	}
 
-	if app.cfg.PullRequestDependsOn != nil && event == "pull_request" {
-		err = app.processPayloadOnPullRequestDependsOn(j, event)
+	fetchedPullRequests := map[string][]PullRequest{}
+	for _, repo := range repos {
+		if ctx.Err() != nil {
+			return
+		}
+		pullRequests, err := app.githubAPI.GetPullRequestList(ctx, app.cfg.PullRequestDependsOn.Owner, repo, app.cfg.Token)
 		if err != nil {
-			log.Print("Error processing github payload on PullRequestDependsOn. Breaking.")
+			// keep what was loaded and let consumers know it may be outdated
+			logger.Error("Error fetching pull requests", "owner", app.cfg.PullRequestDependsOn.Owner, "repo", repo, "error", err)
+			app.cache.AddWarning(repo, "Error fetching pull requests, loaded data may be outdated: "+err.Error())
+			continue
+		}
+		if app.cfg.SkipDraftsAtStartup {
+			pullRequests = app.skipDrafts(pullRequests)
 		}
+		fetchedPullRequests[repo] = pullRequests
 	}
-	return nil
-}
 
-func (app *App) checkIfRepoShouldBeIncluded(repo string) bool {
-	f := false
-	for _, r := range *app.cfg.PullRequestDependsOn.Repositories {
-		if !r.RegExp {
-			if r.Name == "*" || r.Name == repo {
-				f = true
-				break
-			}
-		} else {
-			m, _ := regexp.MatchString(r.Name, repo)
-			if m {
-				f = true
-				break
+	snapshot := app.cache.Snapshot()
+	changed := []PullRequest{}
+	for repo, pullRequests := range fetchedPullRequests {
+		open := map[int]bool{}
+		for _, pr := range pullRequests {
+			open[pr.Number] = true
+			if !app.isPullRequestCurrent(snapshot, pr) {
+				changed = append(changed, pr)
 			}
 		}
-	}
-	for _, r := range *app.cfg.PullRequestDependsOn.ExcludeRepositories {
-		if !r.RegExp {
-			if r.Name == "*" || r.Name == repo {
-				f = false
-				break
-			}
-		} else {
-			m, _ := regexp.MatchString(r.Name, repo)
-			if m {
-				f = false
-				break
+		for num, branch := range snapshot.Branches[repo] {
+			if !open[num] {
+				logger.Info("Pull request got closed since the cache was saved", "repo", repo, "num", num)
+				app.updateCache("closed", repo, num, branch, []string{}, []string{}, false)
 			}
 		}
 	}
-	return f
-}
-
-func (app *App) processPayloadOnPullRequestDependsOn(j map[string]interface{}, event string) error {
-	log.Print("Got payload")
-
-	repo := app.githubPayload.GetRepository(j, event)
-	// ref := app.githubPayload.GetRef(j, event)
-	branch := app.githubPayload.GetBranch(j, event)
-	action := app.githubPayload.GetAction(j, event)
-	body := app.githubPayload.GetPullRequestBody(j)
-	number := int(app.githubPayload.GetPullRequestNumber(j))
 
-	log.Print(fmt.Sprintf("Got payload with action: %s", action))
-	log.Print(fmt.Sprintf("Got payload with branch details: %s %d %s", repo, number, branch))
-
-	if repo == "" {
-		return nil
+	// branches first so that dependencies between changed pull requests can
+	// be set
+	for _, pr := range changed {
+		app.updateCache("opened", pr.Repository, pr.Number, pr.Branch, pr.DependsOn, pr.SoftDependsOn, true)
 	}
-	if body == "" {
-		return nil
+	for _, pr := range changed {
+		logger.Info("Pull request changed since the cache was saved", "repo", pr.Repository, "num", pr.Number)
+		app.updateCache("opened", pr.Repository, pr.Number, pr.Branch, pr.DependsOn, pr.SoftDependsOn, false)
 	}
-
-	f := app.checkIfRepoShouldBeIncluded(repo)
-	if !f {
-		log.Print(fmt.Sprintf("Payload for %s %s %d %s got rejected due to not matching the rules", action, repo, number, branch))
-		return nil
+	for _, pullRequests := range fetchedPullRequests {
+		for _, pr := range pullRequests {
+			app.updateLabels("opened", pr.Repository, pr.Number, pr.Labels)
+			app.updateDeclared(pr.Repository, pr.Number, pr.Declared)
+		}
 	}
 
-	dependsOn := []string{}
-	lines := strings.Split(body, "\r\n")
-	for _, line := range lines {
-		m, _ := regexp.MatchString("^DependsOn:[a-z0-9\\-_]{3,40}#[0-9]{1,10}$", line)
-		if m {
-			dependsOnLine := strings.Split(line, ":")
-			dependsOn = append(dependsOn, dependsOnLine[1])
+	if app.cfg.PruneClosedDependenciesOnReconcile {
+		fetched := map[string]bool{}
+		for repo := range fetchedPullRequests {
+			fetched[repo] = true
 		}
+		app.pruneClosedDependencies(fetched)
 	}
-	log.Print("Got payload with the following DependsOn:")
-	log.Print(dependsOn)
+}
 
-	app.wg.Add(1)
-	go app.updateCache(action, repo, number, branch, dependsOn, false)
-	app.wg.Wait()
+// pruneClosedDependencies removes dependency edges to pull requests that are
+// not open anymore. Only targets in the given repositories, which open pull
+// requests were just fetched from GitHub, are considered.
+func (app *App) pruneClosedDependencies(repos map[string]bool) {
+	app.cache.mu.Lock()
+	defer app.cache.mu.Unlock()
+	defer app.cache.refreshAllBlocked()
 
-	return nil
+	pruned := 0
+	for _, m := range []struct {
+		deps   DependencyMap
+		remove func(string, int, string, int)
+	}{
+		{app.cache.Dependencies, app.cache.removeDependency},
+		{app.cache.SoftDependencies, func(repo string, num int, depRepo string, depNum int) {
+			app.cache.SoftDependencies.Remove(repo, num, depRepo, depNum)
+		}},
+	} {
+		for _, edge := range m.deps.Edges() {
+			if !repos[edge.DependsOnRepository] || app.cache.IsEvicted(edge.DependsOnRepository, edge.DependsOnNumber) {
+				continue
+			}
+			_, hasKey := app.cache.Branches[edge.DependsOnRepository][edge.DependsOnNumber]
+			if hasKey {
+				continue
+			}
+			logger.Info("Pruning dependency on closed pull request", "repo", edge.Repository, "num", edge.Number, "dependency", fmt.Sprintf("%s#%d", edge.DependsOnRepository, edge.DependsOnNumber))
+			m.remove(edge.Repository, edge.Number, edge.DependsOnKey(), edge.DependsOnNumber)
+			app.cache.Dependents.Remove(edge.DependsOnRepository, edge.DependsOnNumber, edge.Repository, edge.Number)
+			pruned++
+		}
+	}
+	if pruned > 0 {
+		logger.Info("Pruned dependencies on closed pull requests", "count", pruned)
+	}
+}
+
+// isPullRequestCurrent returns true when the cache holds the same branch and
+// dependencies of the pull request as the ones fetched from GitHub.
+func (app *App) isPullRequestCurrent(snapshot *Cache, pr PullRequest) bool {
+	branch, hasKey := snapshot.Branches[pr.Repository][pr.Number]
+	if !hasKey || branch != app.normalizeBranch(pr.Branch) {
+		return false
+	}
+	return sameDependencies(snapshot.Dependencies.Get(pr.Repository, pr.Number), pr.DependsOn) &&
+		sameDependencies(snapshot.SoftDependencies.Get(pr.Repository, pr.Number), pr.SoftDependsOn)
+}
+
+// sameDependencies compares cached dependencies with declared ones, ignoring
+// annotations.
+func sameDependencies(cached []PullRequestRef, declared []string) bool {
+	seen := map[PullRequestRef]bool{}
+	refs := []PullRequestRef{}
+	for _, dep := range declared {
+		ref, err := parseDependsOn(dep)
+		if err != nil {
+			continue
+		}
+		ref.Annotation = ""
+		if !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+	sortPullRequestRefs(refs)
+	return reflect.DeepEqual(cached, refs)
+}
+
+func (app *App) skipDrafts(pullRequests []PullRequest) []PullRequest {
+	ready := []PullRequest{}
+	for _, pr := range pullRequests {
+		if pr.Draft {
+			logger.Info("Skipping draft pull request", "repo", pr.Repository, "num", pr.Number)
+			continue
+		}
+		ready = append(ready, pr)
+	}
+	return ready
+}
+
+// removeRepository drops all pull requests of the repository from the cache
+// as if they were closed.
+func (app *App) removeRepository(repo string) {
+	snapshot := app.cache.Snapshot()
+	for num, branch := range snapshot.Branches[repo] {
+		app.updateCache("closed", repo, num, branch, []string{}, []string{}, false)
+	}
+
+	// pull requests were not closed on GitHub so their states are dropped
+	app.cache.mu.Lock()
+	delete(app.cache.States, repo)
+	app.cache.mu.Unlock()
+}
+
+// processInstallationRepositoriesPayload resyncs repositories added to or
+// removed from the GitHub App installation.
+func (app *App) processInstallationRepositoriesPayload(ctx context.Context, j map[string]interface{}) {
+	for _, repo := range app.githubPayload.GetInstallationRepositories(j, "repositories_removed") {
+		if app.checkIfRepoShouldBeIncluded(repo) {
+			logger.Info("Repository was removed from the installation. Removing its pull requests", "repo", repo)
+			app.removeRepository(repo)
+		}
+	}
+
+	added := []string{}
+	for _, repo := range app.githubPayload.GetInstallationRepositories(j, "repositories_added") {
+		if app.checkIfRepoShouldBeIncluded(repo) {
+			added = append(added, repo)
+		}
+	}
+	if len(added) > 0 {
+		logger.Info("Repositories were added to the installation. Fetching their pull requests", "repos", strings.Join(added, ","))
+		// GitHub gives up on a delivery after 10 seconds, which must not
+		// leave the repositories half scanned, so only the span is kept
+		app.addRepositories(trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx)), added)
+	}
+}
+
+// isAcknowledgedOnlyEvent returns true for events that carry no pull request
+// data and are accepted even when PullRequestDependsOn is not configured.
+func (app *App) isAcknowledgedOnlyEvent(event string) bool {
+	return event == "ping" || event == "installation" || event == "installation_repositories" || event == "meta"
+}
+
+func (app *App) startCacheExport() {
+	interval := app.cfg.CacheExport.Interval
+	if interval <= 0 {
+		interval = 300
+	}
+	exporter := NewCacheExporter(&app.cfg)
+
+	logger.Info("Exporting cache periodically", "destination", app.cfg.CacheExport.Destination, "interval", interval)
+	for {
+		time.Sleep(time.Second * time.Duration(interval))
+
+		b, err := json.Marshal(app.cache.Snapshot())
+		if err != nil {
+			logger.Error("Error marshalling cache for export")
+			continue
+		}
+		err = exporter.Export(b)
+		if err != nil {
+			logger.Error("Error exporting cache", "error", err)
+		}
+	}
+}
+
+// listen binds the address before serving so that an occupied port is
+// reported clearly and distinguished from other bind errors.
+func (app *App) listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		if errors.Is(err, syscall.EADDRINUSE) {
+			return nil, errors.New("Address " + addr + " is already in use. Is another instance running?")
+		}
+		return nil, errors.New("Error binding to " + addr + ": " + err.Error())
+	}
+	return l, nil
+}
+
+// newRouters returns the router of the daemon port and the router of admin
+// endpoints, which is the same one unless AdminPort is set.
+func (app *App) newRouters() (*mux.Router, *mux.Router) {
+	router := mux.NewRouter()
+	router.Use(app.metricsMiddleware)
+	router.HandleFunc("/", app.apiHandlerGet).Methods("GET")
+	router.HandleFunc("/healthz", app.apiHandlerGetHealthz).Methods("GET")
+	router.HandleFunc("/readyz", app.apiHandlerGetReadyz).Methods("GET")
+	router.HandleFunc("/version", app.apiHandlerGetVersion).Methods("GET")
+	for provider, path := range app.cfg.WebhookPaths {
+		if provider != "github" {
+			logger.Warn("Webhook provider is not supported. Ignoring its path", "provider", provider, "path", path)
+		}
+	}
+	router.HandleFunc(app.cfg.GetWebhookPath("github"), app.apiHandlerPost).Methods("POST")
+	router.HandleFunc("/branches/{branch:.+}", app.apiHandlerGetBranch).Methods("GET")
+	router.HandleFunc("/diff", app.apiHandlerPostDiff).Methods("POST")
+	router.HandleFunc("/status/{repo}/{num:[0-9]+}", app.apiHandlerGetStatus).Methods("GET")
+	router.HandleFunc("/branch/{repo}/{num:[0-9]+}", app.apiHandlerDeleteBranch).Methods("DELETE")
+	router.HandleFunc("/dependents/{repo}/{num:[0-9]+}", app.apiHandlerGetDependents).Methods("GET")
+	router.HandleFunc("/closure/{repo}/{num:[0-9]+}", app.apiHandlerGetClosure).Methods("GET")
+	router.HandleFunc("/repos/{repo}/pulls/{num:[0-9]+}/dependencies", app.apiHandlerGetPullRequestDependencies).Methods("GET")
+	router.HandleFunc("/repos/{repo}/pulls/{num:[0-9]+}/raw", app.apiHandlerGetPullRequestRaw).Methods("GET")
+	router.HandleFunc("/stats", app.apiHandlerGetStats).Methods("GET")
+	router.HandleFunc("/pulls", app.apiHandlerGetPulls).Methods("GET")
+	router.HandleFunc("/blocked", app.apiHandlerGetBlocked).Methods("GET")
+	router.HandleFunc("/mergeable", app.apiHandlerGetMergeable).Methods("GET")
+	router.HandleFunc("/policy/violations", app.apiHandlerGetPolicyViolations).Methods("GET")
+
+	// admin endpoints can be moved to a separate port so that they are not
+	// exposed together with the webhook
+	adminRouter := router
+	if app.cfg.AdminPort != "" {
+		adminRouter = mux.NewRouter()
+		adminRouter.Use(app.metricsMiddleware)
+	}
+	adminRouter.HandleFunc("/metrics", app.apiHandlerGetMetrics).Methods("GET")
+	adminRouter.HandleFunc("/verify", app.apiHandlerGetVerify).Methods("GET")
+	adminRouter.HandleFunc("/events", app.apiHandlerGetEvents).Methods("GET")
+	adminRouter.HandleFunc("/errors", app.apiHandlerGetErrors).Methods("GET")
+	adminRouter.HandleFunc("/orphans", app.apiHandlerGetOrphans).Methods("GET")
+	adminRouter.HandleFunc("/drift", app.apiHandlerGetDrift).Methods("GET")
+	adminRouter.HandleFunc("/rescan", app.apiHandlerPostRescan).Methods("POST")
+	return router, adminRouter
+}
+
+func (app *App) startAPI() {
+	router, adminRouter := app.newRouters()
+
+	app.server = app.newServer(":"+app.cfg.Port, router)
+	app.serve(app.server)
+	logger.Info("Starting daemon...", "port", app.cfg.Port, "tls", app.cfg.IsTLSEnabled())
+
+	if app.cfg.AdminPort != "" {
+		app.adminServer = app.newServer(":"+app.cfg.AdminPort, adminRouter)
+		app.serve(app.adminServer)
+		logger.Info("Starting admin endpoints...", "port", app.cfg.AdminPort)
+	}
+}
+
+// newServer returns a server which ends event streams when it is shut down, as
+// Shutdown does not interrupt requests that are still running.
+func (app *App) newServer(addr string, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+	server.RegisterOnShutdown(app.events.Close)
+	return server
+}
+
+// serve binds the server address and serves requests in the background,
+// over HTTPS when TLS certificate and key files are configured.
+func (app *App) serve(server *http.Server) {
+	l, err := app.listen(server.Addr)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	go func() {
+		var err error
+		if app.cfg.IsTLSEnabled() {
+			err = server.ServeTLS(l, app.cfg.TLSCertFile, app.cfg.TLSKeyFile)
+		} else {
+			err = server.Serve(l)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Fatal("Error serving API", "error", err)
+		}
+	}()
+}
+
+func (app *App) checkAPIToken(w http.ResponseWriter, r *http.Request) bool {
+	header, value := app.getAPIToken()
+	if header != "" && value != "" {
+		if r.Header.Get(header) != value {
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}
+	}
+	return true
+}
+
+// apiHandlerGetHealthz reports that the daemon is alive. It does not require
+// the API token so it can be used by probes.
+func (app *App) apiHandlerGetHealthz(w http.ResponseWriter, r *http.Request) {
+	stats := app.cache.Stats()
+	app.writeJSON(w, r, map[string]interface{}{
+		"status": "ok",
+		"repos":  stats.Repositories,
+		"prs":    stats.PullRequests,
+	})
+}
+
+// apiHandlerGetVersion returns version of the running daemon. It does not
+// require the API token.
+func (app *App) apiHandlerGetVersion(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, r, VersionInfo{
+		Version:   VERSION,
+		GitCommit: GitCommit,
+		BuildDate: BuildDate,
+	})
+}
+
+// apiHandlerGetReadyz returns 503 until the initial repository scan has
+// completed and once shutdown has started.
+func (app *App) apiHandlerGetReadyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&app.ready) == 0 {
+		app.writeServiceUnavailable(w, "Not ready")
+		return
+	}
+	app.writeJSON(w, r, map[string]string{"status": "ready"})
+}
+
+// apiHandlerGet dumps the cache. It can be narrowed down to a repository with
+// ?repo= and to a single pull request with additional ?num=.
+func (app *App) apiHandlerGet(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	repo := r.URL.Query().Get("repo")
+	numParam := r.URL.Query().Get("num")
+	if repo == "" && numParam == "" {
+		app.writeJSON(w, r, app.cache.Snapshot())
+		return
+	}
+
+	if repo == "" {
+		http.Error(w, "Parameter num requires repo", http.StatusBadRequest)
+		return
+	}
+	num := 0
+	if numParam != "" {
+		var err error
+		num, err = strconv.Atoi(numParam)
+		if err != nil || num <= 0 {
+			http.Error(w, "Invalid num parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	app.writeJSON(w, r, app.cache.Snapshot().Filter(repo, num))
+}
+
+func (app *App) apiHandlerGetOrphans(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	orphans := app.getOrphanedDependencies(app.cache.Snapshot())
+
+	app.writeJSON(w, r, orphans)
+}
+
+func (app *App) wantsPrettyJSON(r *http.Request) bool {
+	p := r.URL.Query().Get("pretty")
+	if p != "" {
+		return p == "1" || p == "true"
+	}
+	return app.cfg.PrettyJSON
+}
+
+func (app *App) writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	app.writeJSONStatus(w, r, http.StatusOK, v)
+}
+
+// writeJSONStatus is writeJSON with a status other than 200. Headers are set
+// before the status is written as they are ignored afterwards.
+func (app *App) writeJSONStatus(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	if app.cfg.ResponseEnvelope {
+		v = ResponseEnvelope{
+			Data: v,
+			Meta: ResponseMeta{
+				Version:   VERSION,
+				Timestamp: time.Now().UTC().Format(time.RFC3339),
+			},
+		}
+	}
+
+	var b []byte
+	var err error
+	if app.wantsPrettyJSON(r) {
+		b, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		b, err = json.Marshal(v)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// ErrorResponse is the body of errors caused by a malformed request.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// writeJSONError responds with the status and an ErrorResponse body.
+func writeJSONError(w http.ResponseWriter, msg string, status int) {
+	b, _ := json.Marshal(ErrorResponse{Error: msg})
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// getClientIP returns address the request came from. With TrustForwardedFor
+// it is the last address in X-Forwarded-For, which is the one seen by the
+// proxy in front of the daemon, as earlier ones can be set by the client.
+func (app *App) getClientIP(r *http.Request) net.IP {
+	if app.cfg.TrustForwardedFor {
+		addrs := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if addr := strings.TrimSpace(addrs[len(addrs)-1]); addr != "" {
+			return net.ParseIP(addr)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func (app *App) apiHandlerPost(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer().Start(ctx, "apiHandlerPost")
+	defer span.End()
+
+	ip := app.getClientIP(r)
+	if !app.cfg.IsAllowedIP(ip) {
+		logger.Warn("Got payload from an address which is not allowed. Rejecting payload", "ip", ip, "delivery", app.githubPayload.GetDeliveryID(r))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// signature is verified over the raw bytes, before they are decompressed
+	// or decoded
+	r.Body = http.MaxBytesReader(w, r.Body, maxPayloadSize)
+	raw, err := ioutil.ReadAll(r.Body)
+	if err != nil && int64(len(raw)) >= maxPayloadSize {
+		logger.Warn("Got payload above the size limit. Rejecting payload", "delivery", app.githubPayload.GetDeliveryID(r), "limit", maxPayloadSize)
+		writeJSONError(w, errPayloadTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	event := app.githubPayload.GetEvent(r)
+	secret := app.getSecret()
+	if secret != "" {
+		signature256 := app.githubPayload.GetSignature256(r)
+		signature := app.githubPayload.GetSignature(r)
+		if !app.githubPayload.VerifySignature([]byte(secret), signature256, signature, &raw) {
+			logger.Warn("Signature verification failed. Rejecting payload", "event", event, "delivery", app.githubPayload.GetDeliveryID(r))
+			app.metrics.ObserveSignatureFailure()
+			app.recordProcessingError(r, event, "Signature verification failed")
+			http.Error(w, "Signature verification failed", http.StatusUnauthorized)
+			return
+		}
+	}
+	if event == "" {
+		logger.Warn("Got payload without X-GitHub-Event header. Rejecting payload", "delivery", app.githubPayload.GetDeliveryID(r))
+		app.recordProcessingError(r, event, "missing X-GitHub-Event header")
+		writeJSONError(w, "missing X-GitHub-Event header", http.StatusBadRequest)
+		return
+	}
+	b, err := app.githubPayload.DecodeBody(r, raw)
+	if err == errPayloadTooLarge {
+		logger.Warn("Got payload above the size limit once decompressed. Rejecting payload", "event", event, "delivery", app.githubPayload.GetDeliveryID(r), "limit", maxPayloadSize)
+		app.recordProcessingError(r, event, err.Error())
+		writeJSONError(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		logger.Warn("Error decoding payload. Rejecting payload", "event", event, "delivery", app.githubPayload.GetDeliveryID(r), "error", err)
+		app.recordProcessingError(r, event, err.Error())
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	app.metrics.ObserveWebhookReceived()
+
+	if !app.isAcknowledgedOnlyEvent(event) && app.cfg.PullRequestDependsOn == nil {
+		app.writeFeatureDisabled(w, "PullRequestDependsOn is not configured")
+		return
+	}
+
+	if event != "ping" {
+		if !app.acquireWebhookSlot() {
+			logger.Warn("Too many webhooks being processed. Rejecting payload", "event", event, "delivery", app.githubPayload.GetDeliveryID(r))
+			app.writeServiceUnavailable(w, "Too many webhooks being processed")
+			return
+		}
+		defer app.releaseWebhookSlot()
+
+		err = app.processGitHubPayload(ctx, &b, event)
+		if err != nil && err != errIgnoredDelivery {
+			app.recordProcessingError(r, event, err.Error())
+		}
+		if err == errStaleDelivery {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err == errForeignOwner {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err == errInvalidPayload || err == errMissingPullRequest {
+			logger.Warn("Got malformed payload. Rejecting payload", "event", event, "delivery", app.githubPayload.GetDeliveryID(r), "error", err)
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err == errIgnoredDelivery {
+			// acknowledge so that GitHub does not redeliver it
+			http.Error(w, err.Error(), http.StatusOK)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("content-type", "application/json")
+}
+
+// recordProcessingError keeps the error of processing the delivery for
+// /errors.
+func (app *App) recordProcessingError(r *http.Request, event string, msg string) {
+	if app.errorLog == nil {
+		return
+	}
+	app.errorLog.Add(ProcessingError{
+		DeliveryID: app.githubPayload.GetDeliveryID(r),
+		Event:      event,
+		Message:    msg,
+		Time:       time.Now().UTC(),
+	})
+}
+
+// apiHandlerGetErrors lists recent errors of processing webhook deliveries,
+// the most recent first.
+func (app *App) apiHandlerGetErrors(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	list := []ProcessingError{}
+	if app.errorLog != nil {
+		list = app.errorLog.List()
+	}
+	app.writeJSON(w, r, list)
+}
+
+func (app *App) apiHandlerGetBranch(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	branch := app.normalizeBranch(mux.Vars(r)["branch"])
+	prs := app.cache.Snapshot().GetPullRequestsByBranch(branch)
+	if len(prs) == 0 {
+		app.writeJSONStatus(w, r, http.StatusNotFound, prs)
+		return
+	}
+	app.writeJSON(w, r, prs)
+}
+
+func (app *App) apiHandlerPostDiff(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	var previous Cache
+	err = json.Unmarshal(b, &previous)
+	if err != nil {
+		http.Error(w, "Got invalid cache snapshot", http.StatusBadRequest)
+		return
+	}
+
+	app.writeJSON(w, r, app.cache.Snapshot().Diff(&previous))
+}
+
+func (app *App) apiHandlerGetStatus(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	repo := vars["repo"]
+	num, err := strconv.Atoi(vars["num"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	snapshot := app.cache.Snapshot()
+	// evicted dependencies that could not be reloaded from GitHub
+	unreachable := map[PullRequestRef]bool{}
+	if app.cfg.PullRequestDependsOn != nil {
+		reloaded := false
+		if snapshot.IsEvicted(repo, num) {
+			reloaded = app.reloadPullRequest(r.Context(), repo, num) == nil
+		}
+		for _, dep := range snapshot.Dependencies.Get(repo, num) {
+			if snapshot.IsEvicted(dep.Repository, dep.Number) {
+				err := app.reloadPullRequest(r.Context(), dep.Repository, dep.Number)
+				if err != nil {
+					logger.Error("Error reloading pull request from GitHub", "repo", dep.Repository, "num", dep.Number, "error", err)
+					unreachable[PullRequestRef{Repository: dep.Repository, Number: dep.Number}] = true
+				}
+				reloaded = err == nil || reloaded
+			}
+		}
+		if reloaded {
+			snapshot = app.cache.Snapshot()
+		}
+	}
+
+	_, hasKey := snapshot.Branches[repo][num]
+	if !hasKey {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	status := snapshot.GetStatus(repo, num)
+	blockers := status.Blockers
+	status.Blockers = []PullRequestRef{}
+	for _, blocker := range blockers {
+		// evicted blockers are blocking by default, fail-open ignores them
+		// when GitHub could not tell their current state
+		if unreachable[PullRequestRef{Repository: blocker.Repository, Number: blocker.Number}] && app.cfg.GetOnGitHubError() == FailOpen {
+			continue
+		}
+		status.Blockers = append(status.Blockers, blocker)
+	}
+	status.Blocked = len(status.Blockers) > 0
+
+	app.writeJSON(w, r, status)
+}
+
+func (app *App) apiHandlerGetDependents(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	num, err := strconv.Atoi(vars["num"])
+	if err != nil {
+		writeJSONError(w, "invalid pull request number", http.StatusBadRequest)
+		return
+	}
+
+	dependents := app.cache.Snapshot().GetDependents(vars["repo"], num)
+	if len(dependents) == 0 {
+		app.writeJSONStatus(w, r, http.StatusNotFound, dependents)
+		return
+	}
+	app.writeJSON(w, r, dependents)
+}
+
+func (app *App) apiHandlerGetClosure(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	repo := vars["repo"]
+	num, err := strconv.Atoi(vars["num"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	snapshot := app.cache.Snapshot()
+	_, hasKey := snapshot.Branches[repo][num]
+	if !hasKey {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	app.writeJSON(w, r, snapshot.GetClosure(repo, num))
+}
+
+// apiHandlerGetPullRequestDependencies returns dependencies of a pull request
+// along with their state. By default the state comes from the cache; with
+// live=1 every dependency is looked up on GitHub instead.
+func (app *App) apiHandlerGetPullRequestDependencies(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	repo := vars["repo"]
+	num, err := strconv.Atoi(vars["num"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	live := r.URL.Query().Get("live") == "1"
+	if live && app.cfg.PullRequestDependsOn == nil {
+		app.writeFeatureDisabled(w, "PullRequestDependsOn is not configured")
+		return
+	}
+
+	snapshot := app.cache.Snapshot()
+	_, hasKey := snapshot.Branches[repo][num]
+	if !hasKey && !snapshot.IsEvicted(repo, num) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	deps := []DependencyState{}
+	for _, dep := range snapshot.Dependencies.Get(repo, num) {
+		if !live {
+			deps = append(deps, DependencyState{
+				Repository: dep.Repository,
+				Number:     dep.Number,
+				Annotation: snapshot.GetAnnotation(repo, num, dep),
+				State:      snapshot.GetPullRequestState(dep.Repository, dep.Number),
+				Source:     "cache",
+			})
+			continue
+		}
+
+		pr, err := app.githubAPI.GetPullRequest(r.Context(), app.cfg.PullRequestDependsOn.Owner, dep.Repository, dep.Number, app.cfg.Token)
+		if err != nil {
+			logger.Error("Error fetching pull request from GitHub", "repo", dep.Repository, "num", dep.Number, "error", err)
+			if app.cfg.GetOnGitHubError() == FailOpen {
+				deps = append(deps, DependencyState{
+					Repository: dep.Repository,
+					Number:     dep.Number,
+					Annotation: snapshot.GetAnnotation(repo, num, dep),
+					State:      snapshot.GetPullRequestState(dep.Repository, dep.Number),
+					Source:     "cache",
+				})
+				continue
+			}
+			http.Error(w, "Error fetching dependency state from GitHub", http.StatusBadGateway)
+			return
+		}
+		state := pr.State
+		if pr.Merged {
+			state = "merged"
+		}
+		deps = append(deps, DependencyState{
+			Repository: dep.Repository,
+			Number:     dep.Number,
+			Annotation: snapshot.GetAnnotation(repo, num, dep),
+			State:      state,
+			Source:     "github",
+		})
+	}
+
+	app.writeJSON(w, r, deps)
+}
+
+// apiHandlerGetPullRequestRaw returns DependsOn lines of a pull request as they
+// were extracted from its body, before being split into repository and number.
+func (app *App) apiHandlerGetPullRequestRaw(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	repo := vars["repo"]
+	num, err := strconv.Atoi(vars["num"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	snapshot := app.cache.Snapshot()
+	_, hasKey := snapshot.Branches[repo][num]
+	if !hasKey {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	app.writeJSON(w, r, snapshot.GetRawDependsOn(repo, num))
+}
+
+// apiHandlerDeleteBranch removes a pull request from the cache along with its
+// dependencies, as if it was closed, eg. when the closing webhook was missed.
+// Removed entries are returned.
+func (app *App) apiHandlerDeleteBranch(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	repo := vars["repo"]
+	num, err := strconv.Atoi(vars["num"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	removed := app.cache.Snapshot().Filter(repo, num)
+	branch, hasKey := removed.Branches[repo][num]
+	if !hasKey {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	logger.Info("Removing pull request from the cache on request", "repo", repo, "num", num, "branch", branch)
+	app.updateCache("closed", repo, num, branch, []string{}, []string{}, false)
+	// it is not known whether the pull request got merged
+	app.cache.mu.Lock()
+	delete(app.cache.States[repo], num)
+	app.cache.mu.Unlock()
+
+	app.writeJSON(w, r, removed)
+}
+
+// apiHandlerGetEvents streams cache changes as server-sent events.
+func (app *App) apiHandlerGetEvents(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := app.events.Subscribe()
+	defer app.events.Unsubscribe(ch)
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event := <-ch:
+			b, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: cache\ndata: %s\n\n", b)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprintf(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-app.events.Done():
+			return
+		}
+	}
+}
+
+func (app *App) apiHandlerGetVerify(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	anomalies := app.cache.Snapshot().Verify()
+	for _, a := range anomalies {
+		logger.Warn("Cache anomaly", "anomaly", a)
+	}
+	app.writeJSON(w, r, VerifyResult{
+		OK:        len(anomalies) == 0,
+		Anomalies: anomalies,
+	})
+}
+
+func (app *App) apiHandlerGetMetrics(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	if !app.cfg.MetricsEnabled {
+		app.writeFeatureDisabled(w, "Metrics are not enabled")
+		return
+	}
+
+	w.Header().Set("content-type", "text/plain; version=0.0.4")
+	app.metrics.Write(w, app.cfg.GetMetricsPrefix())
+	app.cache.Stats().Write(w, app.cfg.GetMetricsPrefix())
+}
+
+// apiHandlerGetPolicyViolations lists open pull requests in repositories
+// matching RequireDeclaration that declare neither dependencies nor
+// DependsOn:none.
+func (app *App) apiHandlerGetPolicyViolations(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	violations := []PullRequestRef{}
+	app.cfgMu.RLock()
+	required := app.cfg.PullRequestDependsOn != nil && app.cfg.PullRequestDependsOn.RequireDeclaration != nil
+	app.cfgMu.RUnlock()
+	if required {
+		violations = app.cache.Snapshot().GetUndeclared(app.isDeclarationRequired)
+	}
+	app.writeJSON(w, r, violations)
+}
+
+func (app *App) isDeclarationRequired(repo string) bool {
+	details := app.getRepository(repo)
+	app.cfgMu.RLock()
+	defer app.cfgMu.RUnlock()
+	if app.cfg.PullRequestDependsOn == nil || app.cfg.PullRequestDependsOn.RequireDeclaration == nil {
+		return false
+	}
+	for i := range *app.cfg.PullRequestDependsOn.RequireDeclaration {
+		if (*app.cfg.PullRequestDependsOn.RequireDeclaration)[i].Match(details) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiHandlerGetPulls lists statuses of open pull requests, optionally of a
+// single repository. With sort=blocking the blocked ones come first.
+func (app *App) apiHandlerGetPulls(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	order := r.URL.Query().Get("sort")
+	if order != "" && order != "blocking" {
+		http.Error(w, "Invalid sort "+order, http.StatusBadRequest)
+		return
+	}
+
+	statuses := app.cache.Snapshot().GetStatuses(r.URL.Query().Get("repo"))
+	if order == "blocking" {
+		sortStatusesByBlocking(statuses)
+	}
+	app.writeJSON(w, r, statuses)
+}
+
+func (app *App) apiHandlerGetBlocked(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	app.writeJSON(w, r, app.cache.Snapshot().GetBlocked(r.URL.Query().Get("repo")))
+}
+
+// apiHandlerGetMergeable lists open pull requests with all hard dependencies
+// closed, for a merge queue to pick up.
+func (app *App) apiHandlerGetMergeable(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	app.writeJSON(w, r, app.cache.Snapshot().GetMergeable(app.isDeclarationRequired))
+}
+
+func (app *App) apiHandlerGetStats(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	app.writeJSON(w, r, app.cache.Stats())
+}
+
+// writeServiceUnavailable responds with 503 and a Retry-After hint so that
+// GitHub and other clients back off.
+func (app *App) writeServiceUnavailable(w http.ResponseWriter, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(app.cfg.GetRetryAfter()))
+	http.Error(w, msg, http.StatusServiceUnavailable)
+}
+
+// writeFeatureDisabled responds with DisabledFeatureHTTPStatus, which comes
+// with a Retry-After hint when it is 503.
+func (app *App) writeFeatureDisabled(w http.ResponseWriter, msg string) {
+	status := app.cfg.GetDisabledFeatureHTTPStatus()
+	if status == http.StatusServiceUnavailable {
+		app.writeServiceUnavailable(w, msg)
+		return
+	}
+	http.Error(w, msg, status)
+}
+
+// acquireWebhookSlot reserves a slot for processing a payload. It returns false
+// when MaxConcurrentWebhooks payloads are already being processed.
+func (app *App) acquireWebhookSlot() bool {
+	if app.webhookSlots == nil {
+		return true
+	}
+	select {
+	case app.webhookSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (app *App) releaseWebhookSlot() {
+	if app.webhookSlots == nil {
+		return
+	}
+	<-app.webhookSlots
+}
+
+func (app *App) processGitHubPayload(ctx context.Context, b *([]byte), event string) error {
+	ctx, span := tracer().Start(ctx, "processGitHubPayload", trace.WithAttributes(attribute.String("github.event", event)))
+	defer span.End()
+
+	start := time.Now()
+	defer func() {
+		d := time.Since(start)
+		app.metrics.ObserveWebhookProcessing(event, d)
+		logger.Debug("Processed payload", "event", event, "duration", d)
+	}()
+
+	j := make(map[string]interface{})
+	err := json.Unmarshal(*b, &j)
+	if err != nil {
+		return errInvalidPayload
+	}
+	// pull_request_target payload has the same shape as the pull_request one
+	if event == "pull_request_target" && app.cfg.HandlePullRequestTarget {
+		event = "pull_request"
+	}
+	if _, ok := j["pull_request"].(map[string]interface{}); event == "pull_request" && !ok {
+		return errMissingPullRequest
+	}
+	app.metrics.ObserveWebhookEvent(event, app.githubPayload.GetAction(j, event))
+
+	// cache keys are repository names of the configured owner, so a
+	// same-named repository of another owner would be conflated with it
+	if app.cfg.PullRequestDependsOn != nil {
+		owner := app.githubPayload.GetRepositoryOwner(j)
+		if owner != "" && !strings.EqualFold(owner, app.cfg.PullRequestDependsOn.Owner) {
+			logger.Warn("Rejecting payload for repository of another owner", "event", event, "owner", owner)
+			return errForeignOwner
+		}
+	}
+
+	err = app.checkDeliveryAge(j, event)
+	if err != nil {
+		return err
+	}
+
+	// topics or visibility of the repository may have changed since it was
+	// listed
+	if app.cfg.PullRequestDependsOn != nil {
+		if repo := app.githubPayload.GetRepositoryDetails(j); repo.Name != "" {
+			app.setRepositories([]Repository{repo})
+		}
+	}
+
+	if app.cfg.PullRequestDependsOn != nil && event == "pull_request" {
+		err = app.processPayloadOnPullRequestDependsOn(ctx, j, event)
+		if err != nil {
+			logger.Error("Error processing github payload on PullRequestDependsOn", "event", event, "error", err)
+		}
+	}
+
+	if app.cfg.PullRequestDependsOn != nil && app.cfg.RefreshDependentsOnPush && event == "push" {
+		app.processPushPayload(ctx, j, event)
+	}
+
+	if event == "meta" {
+		logger.Warn("Got meta event. The webhook may have been removed", "event", event, "action", app.githubPayload.GetAction(j, event))
+	}
+
+	if app.cfg.PullRequestDependsOn != nil && app.cfg.ResyncOnInstallationChange && event == "installation_repositories" {
+		app.processInstallationRepositoriesPayload(ctx, j)
+	}
+	return nil
+}
+
+// processPushPayload re-triggers jobs for PRs depending on pull requests from
+// a repository which default (base) branch has just advanced.
+func (app *App) processPushPayload(ctx context.Context, j map[string]interface{}, event string) {
+	_, span := tracer().Start(ctx, "processPushPayload")
+	defer span.End()
+
+	repo := app.githubPayload.GetRepository(j, event)
+	branch := app.githubPayload.GetBranch(j, event)
+	if repo == "" || branch == "" || branch != app.githubPayload.GetDefaultBranch(j) {
+		return
+	}
+	if !app.checkIfRepoShouldBeIncluded(repo) {
+		return
+	}
+
+	logger.Info("Got push to base branch. Refreshing dependents", "repo", repo, "branch", branch)
+
+	snapshot := app.cache.Snapshot()
+	for num := range snapshot.Dependents[repo] {
+		for _, dependent := range snapshot.Dependents.Get(repo, num) {
+			app.triggerPRJob(dependent.Repository, dependent.Number)
+		}
+	}
+}
+
+// checkDeliveryAge tells whether the payload is too old to be processed.
+// MaxDeliveryAge takes precedence: a payload whose pull request was last
+// updated before it is rejected with errStaleDelivery, so that GitHub shows
+// the delivery as failed. Only then MaxActionAge is checked, for pull_request
+// events only, and a payload whose action happened before it is acknowledged
+// and skipped with errIgnoredDelivery. Payloads without timestamps pass.
+func (app *App) checkDeliveryAge(j map[string]interface{}, event string) error {
+	if app.cfg.MaxDeliveryAge > 0 {
+		updatedAt, ok := app.githubPayload.GetPullRequestUpdatedAt(j)
+		if ok && time.Since(updatedAt) > time.Second*time.Duration(app.cfg.MaxDeliveryAge) {
+			logger.Warn("Rejecting payload which is too old", "event", event, "updated_at", updatedAt.Format(time.RFC3339), "max_age", app.cfg.MaxDeliveryAge)
+			return errStaleDelivery
+		}
+	}
+	if app.cfg.MaxActionAge > 0 && event == "pull_request" {
+		action := app.githubPayload.GetAction(j, event)
+		actionTime, ok := app.githubPayload.GetPullRequestActionTime(j, action)
+		if ok && time.Since(actionTime) > time.Second*time.Duration(app.cfg.MaxActionAge) {
+			logger.Info("Ignoring payload as the action happened too long ago", "event", event, "action", action, "action_time", actionTime.Format(time.RFC3339), "max_age", app.cfg.MaxActionAge)
+			return errIgnoredDelivery
+		}
+	}
+	return nil
+}
+
+// checkIfRepoShouldBeIncluded matches the repository against rules in the
+// config. Topics and visibility are taken from the repository list and
+// payloads, see setRepositories.
+func (app *App) checkIfRepoShouldBeIncluded(repo string) bool {
+	details := app.getRepository(repo)
+	app.cfgMu.RLock()
+	defer app.cfgMu.RUnlock()
+	f := false
+	for i := range *app.cfg.PullRequestDependsOn.Repositories {
+		if (*app.cfg.PullRequestDependsOn.Repositories)[i].Match(details) {
+			f = true
+			break
+		}
+	}
+	for i := range *app.cfg.PullRequestDependsOn.ExcludeRepositories {
+		if (*app.cfg.PullRequestDependsOn.ExcludeRepositories)[i].Match(details) {
+			f = false
+			break
+		}
+	}
+	return f
+}
+
+// skipArchivedRepositories drops archived and disabled repositories, which
+// pull requests cannot change, unless IncludeArchived is set.
+func (app *App) skipArchivedRepositories(repos []Repository) []Repository {
+	if app.cfg.PullRequestDependsOn.IncludeArchived {
+		return repos
+	}
+	active := []Repository{}
+	for _, repo := range repos {
+		if repo.Archived || repo.Disabled {
+			logger.Debug("Skipping archived or disabled repository", "repo", repo.Name, "archived", repo.Archived, "disabled", repo.Disabled)
+			continue
+		}
+		active = append(active, repo)
+	}
+	if len(active) < len(repos) {
+		logger.Info("Skipped archived or disabled repositories", "count", len(repos)-len(active))
+	}
+	return active
+}
+
+// setRepositories stores details of repositories so that rules can match
+// their topics and visibility.
+func (app *App) setRepositories(repos []Repository) {
+	app.repositoriesMu.Lock()
+	defer app.repositoriesMu.Unlock()
+	if app.repositories == nil {
+		app.repositories = map[string]Repository{}
+	}
+	for _, repo := range repos {
+		app.repositories[repo.Name] = repo
+	}
+}
+
+// getRepository returns stored details of the repository. When there are none,
+// only the name is set so rules on topic or visibility do not match it.
+func (app *App) getRepository(name string) Repository {
+	app.repositoriesMu.RLock()
+	defer app.repositoriesMu.RUnlock()
+	repo, ok := app.repositories[name]
+	if !ok {
+		return Repository{Name: name}
+	}
+	return repo
+}
+
+// getOrphanedDependencies returns dependency edges pointing at pull requests
+// in repositories that are no longer matched by the include/exclude rules.
+// When called on the live cache its mutex must be held by the caller.
+func (app *App) getOrphanedDependencies(c *Cache) []DependencyEdge {
+	orphans := []DependencyEdge{}
+	for _, edge := range c.Dependencies.Edges() {
+		if !app.checkIfRepoShouldBeIncluded(edge.DependsOnRepository) {
+			orphans = append(orphans, edge)
+		}
+	}
+	return orphans
+}
+
+// processOrphanedDependencies logs orphaned dependency edges and removes them
+// from the cache when PruneOrphanedDependencies is enabled.
+func (app *App) processOrphanedDependencies() {
+	app.cache.mu.Lock()
+	defer app.cache.mu.Unlock()
+	defer app.cache.refreshAllBlocked()
+
+	orphans := app.getOrphanedDependencies(&app.cache)
+	if len(orphans) == 0 {
+		return
+	}
+
+	for _, o := range orphans {
+		logger.Warn("Orphaned dependency on a repository that is not included anymore", "repo", o.Repository, "num", o.Number, "dependency", fmt.Sprintf("%s#%d", o.DependsOnRepository, o.DependsOnNumber))
+	}
+
+	if !app.cfg.PruneOrphanedDependencies {
+		return
+	}
+
+	for _, o := range orphans {
+		app.cache.removeDependency(o.Repository, o.Number, o.DependsOnKey(), o.DependsOnNumber)
+		app.cache.Dependents.Remove(o.DependsOnRepository, o.DependsOnNumber, o.Repository, o.Number)
+	}
+	logger.Info("Pruned orphaned dependencies", "count", len(orphans))
+}
+
+func (app *App) isPullRequestActionHandled(action string) bool {
+	return app.isPullRequestUpdated(action) || action == "closed"
+}
+
+// isPullRequestUpdated returns true for actions after which the branch and
+// the body of an open pull request are read again. synchronize, sent on
+// pushes to the pull request, is handled like edited.
+func (app *App) isPullRequestUpdated(action string) bool {
+	return action == "opened" || action == "edited" || action == "reopened" || action == "synchronize"
+}
+
+func (app *App) processPayloadOnPullRequestDependsOn(ctx context.Context, j map[string]interface{}, event string) error {
+	logger.Debug("Got payload", "event", event)
+
+	repo := app.githubPayload.GetRepository(j, event)
+	// ref := app.githubPayload.GetRef(j, event)
+	branch := app.githubPayload.GetBranch(j, event)
+	action := app.githubPayload.GetAction(j, event)
+	body := app.githubPayload.GetPullRequestBody(j)
+	number := int(app.githubPayload.GetPullRequestNumber(j))
+
+	logger.Debug("Got payload with branch details", "event", event, "action", action, "repo", repo, "num", number, "branch", branch)
+
+	if repo == "" {
+		return nil
+	}
+
+	if action == "labeled" || action == "unlabeled" {
+		if app.checkIfRepoShouldBeIncluded(repo) {
+			app.updateLabels(action, repo, number, app.githubPayload.GetPullRequestLabels(j))
+		}
+		return nil
+	}
+
+	// actions such as assigned or review_requested do not change branches
+	// nor dependencies so there is no need to parse the body
+	if !app.isPullRequestActionHandled(action) {
+		logger.Debug("Ignoring payload with unhandled action", "event", event, "action", action, "repo", repo, "num", number)
+		return nil
+	}
+
+	// an empty body is processed like any other, so editing the body to
+	// empty clears dependencies of the pull request and closing a pull
+	// request without a body still removes it from the cache
+	f := app.checkIfRepoShouldBeIncluded(repo)
+	if !f {
+		logger.Info("Payload got rejected due to not matching the rules", "event", event, "action", action, "repo", repo, "num", number, "branch", branch)
+		return nil
+	}
+
+	dependsOn := app.githubAPI.getDependsOnLinesFromBody(body)
+	logger.Debug("Got payload with DependsOn", "repo", repo, "num", number, "depends_on", strings.Join(dependsOn, ","))
+	softDependsOn := app.githubAPI.getSoftDependsOnLinesFromBody(body)
+	logger.Debug("Got payload with SoftDependsOn", "repo", repo, "num", number, "soft_depends_on", strings.Join(softDependsOn, ","))
+
+	_, span := tracer().Start(ctx, "updateCache", trace.WithAttributes(
+		attribute.String("github.repository", repo),
+		attribute.Int("github.pull_request.number", number),
+		attribute.String("github.action", action),
+	))
+	app.updateCache(action, repo, number, branch, dependsOn, softDependsOn, false)
+	span.End()
+
+	if action == "closed" && app.githubPayload.GetPullRequestMerged(j) {
+		app.updateMerged(repo, number)
+	}
+	if action != "closed" {
+		app.updateLabels(action, repo, number, app.githubPayload.GetPullRequestLabels(j))
+		app.updateDeclared(repo, number, len(dependsOn) > 0 || app.githubAPI.declaresNoDependencies(body))
+	}
+
+	return nil
 }
 
 func (app *App) Run() {
 	app.githubPayload = NewGitHubPayload()
-	app.githubAPI = NewGitHubAPI()
+	app.githubAPI = NewGitHubAPI(&app.cfg)
 	app.jenkinsAPI = NewJenkinsAPI()
-	app.cache = Cache{
-		Branches:     map[string]map[int]string{},
-		Dependencies: map[string]map[int]map[string]int{},
-		Dependents:   map[string]map[int]map[string]int{},
-		Version:      "1",
-	}
+	app.metrics = NewMetrics()
+	app.events = NewEventBroker()
+	app.cache.init()
 
 	os.Exit(app.cli.Run(os.Stdout, os.Stderr))
 }
 
+func (app *App) configDumpHandler(c *gocli.CLI) int {
+	app.loadConfig(c.Flag("config"))
+
+	err := app.writeConfigDump(os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+// writeConfigDump prints the effective config with defaults filled in and
+// secrets redacted. Config is validated first, with problems logged, so that
+// an invalid one is not mistaken for what the daemon would run with.
+func (app *App) writeConfigDump(w io.Writer) error {
+	err := app.cfg.Validate()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(app.cfg.WithDefaults().Redact(), "", "  ")
+	if err != nil {
+		return errors.New("Error marshalling config: " + err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", b)
+	return nil
+}
+
+func (app *App) routesHandler(c *gocli.CLI) int {
+	app.loadConfig(c.Flag("config"))
+
+	err := app.writeRoutes(os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listing routes: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+// writeRoutes prints HTTP routes registered with the config, one per line with
+// the port they are served on.
+func (app *App) writeRoutes(w io.Writer) error {
+	router, adminRouter := app.newRouters()
+	routers := []*mux.Router{router}
+	ports := []string{app.cfg.Port}
+	if adminRouter != router {
+		routers = append(routers, adminRouter)
+		ports = append(ports, app.cfg.AdminPort)
+	}
+	for i, r := range routers {
+		err := r.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+			path, err := route.GetPathTemplate()
+			if err != nil {
+				return err
+			}
+			methods, _ := route.GetMethods()
+			line := fmt.Sprintf(":%s %s %s", ports[i], strings.Join(methods, ","), path)
+			if path == "/metrics" && !app.cfg.MetricsEnabled {
+				line += " (disabled)"
+			}
+			fmt.Fprintf(w, "%s\n", line)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (app *App) versionHandler(c *gocli.CLI) int {
 	fmt.Fprintf(os.Stdout, VERSION+"\n")
 	return 0
@@ -504,6 +2172,22 @@ func NewApp() *App {
 	app.cli = gocli.NewCLI("github-pullrequestd", "Tiny API to store GitHub Pull Request dependencies", "Nicholas Gasior <mg@gen64.io>")
 	cmdStart := app.cli.AddCmd("start", "Starts API", app.startHandler)
 	cmdStart.AddFlag("config", "c", "config", "Config file", gocli.TypePathFile|gocli.MustExist|gocli.Required, nil)
+	cmdWatch := app.cli.AddCmd("watch", "Prints cache changes of a running daemon live", app.watchHandler)
+	cmdWatch.AddFlag("config", "c", "config", "Config file", gocli.TypePathFile|gocli.MustExist|gocli.Required, nil)
+	cmdWatch.AddFlag("address", "a", "url", "Daemon URL, defaults to http://127.0.0.1:ADMIN_PORT or PORT", gocli.TypeString, nil)
+	cmdReplay := app.cli.AddCmd("replay", "Processes a saved webhook payload and prints cache changes", app.replayHandler)
+	cmdReplay.AddFlag("config", "c", "config", "Config file", gocli.TypePathFile|gocli.MustExist|gocli.Required, nil)
+	cmdReplay.AddFlag("payload", "p", "file", "Webhook payload file", gocli.TypePathFile|gocli.MustExist|gocli.Required, nil)
+	cmdReplay.AddFlag("event", "e", "event", "GitHub event name, eg. pull_request", gocli.TypeString|gocli.Required, nil)
+	cmdConfigDump := app.cli.AddCmd("config-dump", "Prints effective config with secrets redacted", app.configDumpHandler)
+	cmdConfigDump.AddFlag("config", "c", "config", "Config file", gocli.TypePathFile|gocli.MustExist|gocli.Required, nil)
+	cmdRoutes := app.cli.AddCmd("routes", "Prints HTTP routes the daemon registers with the config", app.routesHandler)
+	cmdRoutes.AddFlag("config", "c", "config", "Config file", gocli.TypePathFile|gocli.MustExist|gocli.Required, nil)
+	cmdQuery := app.cli.AddCmd("query", "Prints branch and dependencies of a pull request cached by a running daemon", app.queryHandler)
+	cmdQuery.AddFlag("config", "c", "config", "Config file", gocli.TypePathFile|gocli.MustExist|gocli.Required, nil)
+	cmdQuery.AddFlag("repo", "r", "repo", "Repository name", gocli.TypeString|gocli.Required, nil)
+	cmdQuery.AddFlag("num", "n", "num", "Pull request number", gocli.TypeInt|gocli.Required, nil)
+	cmdQuery.AddFlag("address", "a", "url", "Daemon URL, defaults to http://127.0.0.1:PORT", gocli.TypeString, nil)
 	_ = app.cli.AddCmd("version", "Prints version", app.versionHandler)
 
 	return app
@@ -0,0 +1,2565 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestApp returns an app set up like Run does, with config taken from
+// JSON.
+func newTestApp(t *testing.T, cfg string) *App {
+	t.Helper()
+	app := NewApp()
+	app.cfg.SetFromJSON([]byte(cfg))
+	app.githubPayload = NewGitHubPayload()
+	app.githubAPI = NewGitHubAPI(&app.cfg)
+	app.jenkinsAPI = NewJenkinsAPI()
+	app.metrics = NewMetrics()
+	app.events = NewEventBroker()
+	app.cache = Cache{
+		Branches:         map[string]map[int]string{},
+		Dependencies:     DependencyMap{},
+		Dependents:       DependencyMap{},
+		SoftDependencies: DependencyMap{},
+		Labels:           map[string]map[int][]string{},
+		Version:          "1",
+	}
+	return app
+}
+
+// openTestPullRequest puts an open pull request depending on deps, such as
+// "repo#1", into the cache. Dependencies must be opened first.
+func openTestPullRequest(app *App, repo string, num int, deps ...string) {
+	app.updateCache("opened", repo, num, fmt.Sprintf("branch-%d", num), deps, []string{}, false)
+}
+
+// captureLogs makes logger write lines from the level up to the returned
+// buffer until the test ends.
+func captureLogs(t *testing.T, level string) *bytes.Buffer {
+	var b bytes.Buffer
+	previous := logger
+	logger = NewLogger(&b)
+	logger.Configure(level, LogFormatText)
+	t.Cleanup(func() {
+		logger = previous
+	})
+	return &b
+}
+
+// postTestWebhook sends a webhook payload to the app and returns the response.
+func postTestWebhook(app *App, event string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	r.Header.Set("X-GitHub-Event", event)
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	app.apiHandlerPost(w, r)
+	return w
+}
+
+// testJenkins is a fake Jenkins recording paths of triggered jobs.
+type testJenkins struct {
+	*httptest.Server
+	mu   sync.Mutex
+	jobs []string
+}
+
+func newTestJenkins(t *testing.T) *testJenkins {
+	jenkins := &testJenkins{}
+	jenkins.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Write([]byte("Jenkins-Crumb:crumb"))
+			return
+		}
+		jenkins.mu.Lock()
+		jenkins.jobs = append(jenkins.jobs, r.URL.Path)
+		jenkins.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(jenkins.Close)
+	return jenkins
+}
+
+// config returns the jenkins section of config pointing at the fake Jenkins.
+func (jenkins *testJenkins) config() string {
+	return fmt.Sprintf(`{"user":"u","token":"t","base_url":"%s","endpoints":[{"id":"pr","path":"job/{{.repository}}/{{.number}}","retry":{"count":"1"},"success":{"http_status":"201"}}]}`, jenkins.URL)
+}
+
+func (jenkins *testJenkins) triggered() []string {
+	jenkins.mu.Lock()
+	defer jenkins.mu.Unlock()
+	jobs := append([]string{}, jenkins.jobs...)
+	sort.Strings(jobs)
+	return jobs
+}
+
+// newTestGitHub starts a fake GitHub API serving responses by request path and
+// makes the default transport, which clients of GitHubAPI are cloned from,
+// connect to it. Paths missing from responses get HTTP 500.
+func newTestGitHub(t *testing.T, responses map[string]string) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response, ok := responses[r.URL.Path]
+		if !ok {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(response))
+	}))
+	previous := http.DefaultTransport
+	http.DefaultTransport = &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	t.Cleanup(func() {
+		http.DefaultTransport = previous
+		server.Close()
+	})
+}
+
+// gzipString returns s compressed with gzip.
+func gzipString(s string) string {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	gz.Write([]byte(s))
+	gz.Close()
+	return b.String()
+}
+
+// pullRequestPayload returns a pull_request webhook payload.
+func pullRequestPayload(action string, repo string, num int, branch string, body string) string {
+	b, _ := json.Marshal(map[string]interface{}{
+		"action": action,
+		"number": num,
+		"pull_request": map[string]interface{}{
+			"number": num,
+			"body":   body,
+			"head": map[string]interface{}{
+				"ref":  branch,
+				"repo": map[string]interface{}{"name": repo},
+			},
+		},
+		"repository": map[string]interface{}{"name": repo},
+	})
+	return string(b)
+}
+
+func TestAPIHandlerGetPrettyJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    string
+		query  string
+		pretty bool
+	}{
+		{"default", `{}`, "", false},
+		{"query", `{}`, "?pretty=1", true},
+		{"query true", `{}`, "?pretty=true", true},
+		{"config", `{"pretty_json":true}`, "", true},
+		{"query overrides config", `{"pretty_json":true}`, "?pretty=0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, tt.cfg)
+			w := httptest.NewRecorder()
+			app.apiHandlerGet(w, httptest.NewRequest("GET", "/"+tt.query, nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d", w.Code)
+			}
+			indented := strings.Contains(w.Body.String(), "\n  \"branches\"")
+			if indented != tt.pretty {
+				t.Errorf("got indented %v, want %v: %s", indented, tt.pretty, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestOrphanedDependencies(t *testing.T) {
+	tests := []struct {
+		name     string
+		prune    bool
+		wantDeps int
+	}{
+		{"reported", false, 1},
+		{"pruned", true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, fmt.Sprintf(`{"prune_orphaned_dependencies":%v,"pull_request_depends_on":{"owner":"o","repositories":[{"name":"a"},{"name":"b"}],"exclude_repositories":[]}}`, tt.prune))
+			openTestPullRequest(app, "b", 2)
+			openTestPullRequest(app, "a", 1, "b#2")
+
+			orphans := app.getOrphanedDependencies(app.cache.Snapshot())
+			if len(orphans) != 0 {
+				t.Fatalf("got orphans %v before rules changed", orphans)
+			}
+
+			*app.cfg.PullRequestDependsOn.Repositories = []DependsOnConditionRepository{{Name: "a"}}
+			orphans = app.getOrphanedDependencies(app.cache.Snapshot())
+			want := DependencyEdge{Repository: "a", Number: 1, DependsOnRepository: "b", DependsOnNumber: 2}
+			if len(orphans) != 1 || orphans[0] != want {
+				t.Fatalf("got orphans %v, want %v", orphans, want)
+			}
+
+			app.processOrphanedDependencies()
+			if got := len(app.cache.Dependencies.Get("a", 1)); got != tt.wantDeps {
+				t.Errorf("got %d dependencies of a#1, want %d", got, tt.wantDeps)
+			}
+		})
+	}
+}
+
+func TestAPIHandlerPostWithoutPullRequestDependsOn(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    string
+		event  string
+		status int
+	}{
+		{"ping", `{}`, "ping", http.StatusOK},
+		{"pull request", `{}`, "pull_request", http.StatusNotImplemented},
+		{"configured status", `{"disabled_feature_http_status":202}`, "pull_request", http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, tt.cfg)
+			w := postTestWebhook(app, tt.event, `{"action":"opened"}`)
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestMaxDependenciesPerRepo(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		want  int
+	}{
+		{"unlimited", 0, 3},
+		{"below limit", 5, 3},
+		{"crossing limit", 2, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, fmt.Sprintf(`{"max_dependencies_per_repo":%d}`, tt.limit))
+			for _, repo := range []string{"b", "c", "d"} {
+				openTestPullRequest(app, repo, 1)
+			}
+			openTestPullRequest(app, "a", 1, "b#1", "c#1")
+			openTestPullRequest(app, "a", 2, "d#1")
+
+			if got := app.countRepoDependencies("a"); got != tt.want {
+				t.Errorf("got %d dependencies, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxConcurrentWebhooks(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		busy   int
+		status int
+	}{
+		{"unlimited", 0, 0, http.StatusOK},
+		{"free slot", 2, 1, http.StatusOK},
+		{"saturated", 2, 2, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			if tt.limit > 0 {
+				app.webhookSlots = make(chan struct{}, tt.limit)
+			}
+			for i := 0; i < tt.busy; i++ {
+				if !app.acquireWebhookSlot() {
+					t.Fatalf("could not acquire slot %d", i)
+				}
+			}
+			w := postTestWebhook(app, "pull_request", pullRequestPayload("opened", "a", 1, "feature", "Some change"))
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+			if got := len(app.webhookSlots); got != tt.busy {
+				t.Errorf("got %d busy slots after request, want %d", got, tt.busy)
+			}
+		})
+	}
+}
+
+func TestIrrelevantPullRequestActions(t *testing.T) {
+	tests := []struct {
+		action   string
+		wantDeps []PullRequestRef
+	}{
+		{"edited", []PullRequestRef{{Repository: "ccc", Number: 3}}},
+		{"reopened", []PullRequestRef{{Repository: "ccc", Number: 3}}},
+		{"assigned", []PullRequestRef{{Repository: "bbb", Number: 2}}},
+		{"labeled", []PullRequestRef{{Repository: "bbb", Number: 2}}},
+		{"review_requested", []PullRequestRef{{Repository: "bbb", Number: 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			openTestPullRequest(app, "bbb", 2)
+			openTestPullRequest(app, "ccc", 3)
+			postTestWebhook(app, "pull_request", pullRequestPayload("opened", "aaa", 1, "feature", "DependsOn:bbb#2"))
+			postTestWebhook(app, "pull_request", pullRequestPayload(tt.action, "aaa", 1, "feature", "DependsOn:ccc#3"))
+
+			got := app.cache.Dependencies.Get("aaa", 1)
+			if !reflect.DeepEqual(got, tt.wantDeps) {
+				t.Errorf("got dependencies %v, want %v", got, tt.wantDeps)
+			}
+		})
+	}
+}
+
+func TestNormalizeBranch(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes string
+		branch   string
+		want     string
+	}{
+		{"no prefixes", `[]`, "feature/foo", "feature/foo"},
+		{"matching prefix", `["feature/"]`, "feature/foo", "foo"},
+		{"not matching prefix", `["feature/"]`, "bugfix/foo", "bugfix/foo"},
+		{"first match only", `["feature/","foo/"]`, "feature/foo/bar", "foo/bar"},
+		{"empty prefix", `[""]`, "feature/foo", "feature/foo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, fmt.Sprintf(`{"branch_prefix_strip":%s}`, tt.prefixes))
+			if got := app.normalizeBranch(tt.branch); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			app.updateCache("opened", "a", 1, tt.branch, []string{}, []string{}, false)
+			if got := app.cache.Branches["a"][1]; got != tt.want {
+				t.Errorf("got cached branch %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIHandlerGetBranch(t *testing.T) {
+	tests := []struct {
+		name   string
+		branch string
+		status int
+		want   string
+	}{
+		{"single pull request", "foo", http.StatusOK, `[{"repository":"a","number":1}]`},
+		{"shared branch", "shared", http.StatusOK, `[{"repository":"a","number":2},{"repository":"b","number":3}]`},
+		{"stripped prefix", "feature/foo", http.StatusOK, `[{"repository":"a","number":1}]`},
+		{"unknown branch", "bar", http.StatusNotFound, `[]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"branch_prefix_strip":["feature/"]}`)
+			app.cache.Branches["a"] = map[int]string{1: "foo", 2: "shared"}
+			app.cache.Branches["b"] = map[int]string{3: "shared"}
+
+			r := httptest.NewRequest("GET", "/branches/"+tt.branch, nil)
+			r = mux.SetURLVars(r, map[string]string{"branch": tt.branch})
+			w := httptest.NewRecorder()
+			app.apiHandlerGetBranch(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Result().Header.Get("content-type"); got != "application/json" {
+				t.Errorf("got content-type %q, want application/json", got)
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxDeliveryAge(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxAge    int
+		updatedAt string
+		status    int
+	}{
+		{"check disabled", 0, time.Now().Add(-time.Hour).Format(time.RFC3339), http.StatusOK},
+		{"fresh delivery", 60, time.Now().Format(time.RFC3339), http.StatusOK},
+		{"stale delivery", 60, time.Now().Add(-time.Hour).Format(time.RFC3339), http.StatusBadRequest},
+		{"no timestamp", 60, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, fmt.Sprintf(`{"max_delivery_age":%d,"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`, tt.maxAge))
+			var j map[string]interface{}
+			json.Unmarshal([]byte(pullRequestPayload("opened", "a", 1, "feature", "Some change")), &j)
+			if tt.updatedAt != "" {
+				j["pull_request"].(map[string]interface{})["updated_at"] = tt.updatedAt
+			}
+			b, _ := json.Marshal(j)
+
+			w := postTestWebhook(app, "pull_request", string(b))
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestRefreshDependentsOnPush(t *testing.T) {
+	tests := []struct {
+		name          string
+		refresh       bool
+		repo          string
+		ref           string
+		defaultBranch string
+		want          []string
+	}{
+		{"push to base branch", true, "b", "refs/heads/main", "main", []string{"/job/a/1", "/job/c/3"}},
+		{"push to other branch", true, "b", "refs/heads/feature", "main", []string{}},
+		{"push to repository without dependents", true, "a", "refs/heads/main", "main", []string{}},
+		{"refresh disabled", false, "b", "refs/heads/main", "main", []string{}},
+		{"tag named like base branch", true, "b", "refs/tags/main", "main", []string{}},
+		{"base branch with slash", true, "b", "refs/heads/release/2.x", "release/2.x", []string{"/job/a/1", "/job/c/3"}},
+		{"branch prefixed like base branch", true, "b", "refs/heads/release/3.x", "release", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jenkins := newTestJenkins(t)
+			app := newTestApp(t, fmt.Sprintf(`{"refresh_dependents_on_push":%v,"jenkins":%s,
+				"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`, tt.refresh, jenkins.config()))
+			openTestPullRequest(app, "b", 2)
+			openTestPullRequest(app, "a", 1, "b#2")
+			openTestPullRequest(app, "c", 3, "b#2")
+
+			payload := fmt.Sprintf(`{"ref":"%s","repository":{"name":"%s","default_branch":"%s"}}`, tt.ref, tt.repo, tt.defaultBranch)
+			postTestWebhook(app, "push", payload)
+
+			if got := jenkins.triggered(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got triggered jobs %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSoftAndHardDependencies(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		wantBlockers string
+		wantSoft     string
+	}{
+		{"hard only", "DependsOn:bbb#2", `[{"repository":"bbb","number":2}]`, `[]`},
+		{"soft only", "SoftDependsOn:bbb#2", `[]`, `[{"repository":"bbb","number":2}]`},
+		{"hard and soft", "DependsOn:bbb#2\r\nSoftDependsOn:ccc#3", `[{"repository":"bbb","number":2}]`, `[{"repository":"ccc","number":3}]`},
+		{"neither", "Some change", `[]`, `[]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			openTestPullRequest(app, "bbb", 2)
+			openTestPullRequest(app, "ccc", 3)
+			postTestWebhook(app, "pull_request", pullRequestPayload("opened", "aaa", 1, "feature", tt.body))
+
+			r := httptest.NewRequest("GET", "/status/aaa/1", nil)
+			r = mux.SetURLVars(r, map[string]string{"repo": "aaa", "num": "1"})
+			w := httptest.NewRecorder()
+			app.apiHandlerGetStatus(w, r)
+
+			var status struct {
+				Blocked          bool            `json:"blocked"`
+				Blockers         json.RawMessage `json:"blockers"`
+				SoftDependencies json.RawMessage `json:"soft_dependencies"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+				t.Fatalf("got invalid JSON: %s", w.Body.String())
+			}
+			if string(status.Blockers) != tt.wantBlockers {
+				t.Errorf("got blockers %s, want %s", status.Blockers, tt.wantBlockers)
+			}
+			if string(status.SoftDependencies) != tt.wantSoft {
+				t.Errorf("got soft dependencies %s, want %s", status.SoftDependencies, tt.wantSoft)
+			}
+			if status.Blocked != (tt.wantBlockers != `[]`) {
+				t.Errorf("got blocked %v", status.Blocked)
+			}
+		})
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		timeout     int
+		requestTime time.Duration
+		wantErr     bool
+	}{
+		{"request finishes", 2, 100 * time.Millisecond, false},
+		{"request is forcibly closed", 1, 10 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, fmt.Sprintf(`{"shutdown_timeout":%d}`, tt.timeout))
+			started := make(chan bool)
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				started <- true
+				select {
+				case <-time.After(tt.requestTime):
+				case <-r.Context().Done():
+				}
+			})
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			app.server = server.Config
+
+			errs := make(chan error)
+			go func() {
+				_, err := http.Get(server.URL)
+				errs <- err
+			}()
+			<-started
+
+			start := time.Now()
+			app.shutdown()
+			elapsed := time.Since(start)
+
+			if elapsed > time.Second*time.Duration(tt.timeout)+500*time.Millisecond {
+				t.Errorf("shutdown took %s, longer than timeout of %ds", elapsed, tt.timeout)
+			}
+			if tt.wantErr && elapsed < time.Second*time.Duration(tt.timeout) {
+				t.Errorf("shutdown took %s, did not wait for timeout of %ds", elapsed, tt.timeout)
+			}
+			if err := <-errs; (err != nil) != tt.wantErr {
+				t.Errorf("got request error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestShutdownEndsEventStreams(t *testing.T) {
+	tests := []struct {
+		name    string
+		streams int
+	}{
+		{"no streams", 0},
+		{"one stream", 1},
+		{"many streams", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"shutdown_timeout":5}`)
+			router, _ := app.newRouters()
+			server := httptest.NewUnstartedServer(router)
+			server.Config = app.newServer("", router)
+			server.Start()
+			defer server.Close()
+			app.server = server.Config
+
+			ended := make(chan error, tt.streams)
+			for i := 0; i < tt.streams; i++ {
+				resp, err := http.Get(server.URL + "/events")
+				if err != nil {
+					t.Fatal(err)
+				}
+				go func() {
+					_, err := ioutil.ReadAll(resp.Body)
+					resp.Body.Close()
+					ended <- err
+				}()
+			}
+
+			start := time.Now()
+			app.shutdown()
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("shutdown took %s, event streams were not ended", elapsed)
+			}
+			for i := 0; i < tt.streams; i++ {
+				if err := <-ended; err != nil {
+					t.Errorf("stream ended with error %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestListen(t *testing.T) {
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+
+	tests := []struct {
+		name    string
+		addr    string
+		wantErr string
+	}{
+		{"free port", "127.0.0.1:0", ""},
+		{"port in use", occupied.Addr().String(), "is already in use"},
+		{"invalid address", "127.0.0.1:-1", "Error binding to"},
+	}
+	app := newTestApp(t, `{}`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := app.listen(tt.addr)
+			if l != nil {
+				l.Close()
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("got error %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPopulateCacheCancelled(t *testing.T) {
+	tests := []struct {
+		name         string
+		loaded       bool
+		cancelled    bool
+		wantBranches map[string]map[int]string
+	}{
+		{"scan", false, false, map[string]map[int]string{"a": {1: "foo"}, "b": {2: "bar"}}},
+		{"scan cancelled", false, true, map[string]map[int]string{}},
+		{"reconcile", true, false, map[string]map[int]string{"a": {1: "foo"}, "b": {2: "bar"}}},
+		{"reconcile cancelled", true, true, map[string]map[int]string{"a": {3: "old"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestGitHub(t, map[string]string{
+				"/orgs/o/repos":    `[{"name":"a"},{"name":"b"}]`,
+				"/repos/o/a/pulls": `[{"number":1,"head":{"ref":"foo"},"body":""}]`,
+				"/repos/o/b/pulls": `[{"number":2,"head":{"ref":"bar"},"body":""}]`,
+			})
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","organization":true,"repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			if tt.loaded {
+				app.updateCache("opened", "a", 3, "old", []string{}, []string{}, false)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.cancelled {
+				cancel()
+			}
+			defer cancel()
+			app.populateCache(ctx, tt.loaded)
+
+			branches := app.cache.Snapshot().Branches
+			for repo, prs := range branches {
+				if len(prs) == 0 {
+					delete(branches, repo)
+				}
+			}
+			if !reflect.DeepEqual(branches, tt.wantBranches) {
+				t.Errorf("got branches %v, want %v", branches, tt.wantBranches)
+			}
+		})
+	}
+}
+
+func TestNotifyShutdown(t *testing.T) {
+	app := newTestApp(t, `{}`)
+	ctx := app.notifyShutdown()
+	if ctx.Err() != nil {
+		t.Fatalf("got context done before a signal")
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Errorf("got context not done after SIGTERM")
+	}
+}
+
+func TestPopulateCacheWarnings(t *testing.T) {
+	tests := []struct {
+		name         string
+		failing      []string
+		wantBranches int
+		wantWarnings []string
+	}{
+		{"all repositories fetched", []string{}, 2, []string{}},
+		{"one repository failed", []string{"b"}, 1, []string{"b"}},
+		{"all repositories failed", []string{"a", "b"}, 0, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responses := map[string]string{
+				"/orgs/o/repos":    `[{"name":"a"},{"name":"b"}]`,
+				"/repos/o/a/pulls": `[{"number":1,"head":{"ref":"foo"},"body":""}]`,
+				"/repos/o/b/pulls": `[{"number":2,"head":{"ref":"bar"},"body":""}]`,
+			}
+			for _, repo := range tt.failing {
+				delete(responses, "/repos/o/"+repo+"/pulls")
+			}
+			newTestGitHub(t, responses)
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","organization":true,"repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			app.populateCache(context.Background(), false)
+
+			w := httptest.NewRecorder()
+			app.apiHandlerGet(w, httptest.NewRequest("GET", "/", nil))
+			var c Cache
+			json.Unmarshal(w.Body.Bytes(), &c)
+
+			branches := 0
+			for _, prs := range c.Branches {
+				branches += len(prs)
+			}
+			if branches != tt.wantBranches {
+				t.Errorf("got %d branches, want %d", branches, tt.wantBranches)
+			}
+			warnings := []string{}
+			for _, warning := range c.Warnings {
+				warnings = append(warnings, warning.Repository)
+			}
+			sort.Strings(warnings)
+			if !reflect.DeepEqual(warnings, tt.wantWarnings) {
+				t.Errorf("got warnings for %v, want %v", warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	dependsOn := `"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}`
+	tests := []struct {
+		name       string
+		cfg        string
+		saturated  bool
+		status     int
+		retryAfter string
+	}{
+		{"saturated", `{"max_concurrent_webhooks":1,` + dependsOn + `}`, true, http.StatusServiceUnavailable, "10"},
+		{"saturated with configured value", `{"retry_after":60,` + dependsOn + `}`, true, http.StatusServiceUnavailable, "60"},
+		{"not configured with 503", `{"disabled_feature_http_status":503}`, false, http.StatusServiceUnavailable, "10"},
+		{"not configured with 501", `{}`, false, http.StatusNotImplemented, ""},
+		{"processed", `{` + dependsOn + `}`, false, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, tt.cfg)
+			if tt.saturated {
+				app.webhookSlots = make(chan struct{}, 1)
+				app.acquireWebhookSlot()
+			}
+			w := postTestWebhook(app, "pull_request", pullRequestPayload("opened", "a", 1, "feature", "Some change"))
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("got Retry-After %q, want %q", got, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestDisabledFeatureRetryAfter(t *testing.T) {
+	paths := []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/metrics"},
+		{"GET", "/repos/aaa/pulls/1/dependencies?live=1"},
+		{"GET", "/drift"},
+		{"POST", "/rescan"},
+	}
+	tests := []struct {
+		name       string
+		cfg        string
+		status     int
+		retryAfter string
+	}{
+		{"503", `{"disabled_feature_http_status":503,"retry_after":60}`, http.StatusServiceUnavailable, "60"},
+		{"501", `{}`, http.StatusNotImplemented, ""},
+	}
+	for _, tt := range tests {
+		for _, p := range paths {
+			t.Run(tt.name+" "+p.path, func(t *testing.T) {
+				app := newTestApp(t, tt.cfg)
+				router, _ := app.newRouters()
+
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest(p.method, p.path, nil))
+				if w.Code != tt.status {
+					t.Errorf("got status %d, want %d", w.Code, tt.status)
+				}
+				if got := w.Result().Header.Get("Retry-After"); got != tt.retryAfter {
+					t.Errorf("got Retry-After %q, want %q", got, tt.retryAfter)
+				}
+			})
+		}
+	}
+}
+
+func TestMultipleDependenciesFromSameRepository(t *testing.T) {
+	tests := []struct {
+		name         string
+		closed       []int
+		wantBlockers []PullRequestRef
+	}{
+		{"both open", []int{}, []PullRequestRef{{Repository: "bbb", Number: 5}, {Repository: "bbb", Number: 7}}},
+		{"first closed", []int{5}, []PullRequestRef{{Repository: "bbb", Number: 7}}},
+		{"second closed", []int{7}, []PullRequestRef{{Repository: "bbb", Number: 5}}},
+		{"both closed", []int{5, 7}, []PullRequestRef{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{}`)
+			openTestPullRequest(app, "bbb", 5)
+			openTestPullRequest(app, "bbb", 7)
+			openTestPullRequest(app, "aaa", 1, "bbb#5", "bbb#7")
+			if got := app.cache.Dependencies.Get("aaa", 1); len(got) != 2 {
+				t.Fatalf("got dependencies %v, want both tracked", got)
+			}
+
+			for _, num := range tt.closed {
+				app.updateCache("closed", "bbb", num, fmt.Sprintf("branch-%d", num), []string{}, []string{}, false)
+			}
+			if got := app.cache.Snapshot().GetBlockers("aaa", 1); !reflect.DeepEqual(got, tt.wantBlockers) {
+				t.Errorf("got blockers %v, want %v", got, tt.wantBlockers)
+			}
+		})
+	}
+}
+
+func TestReloadEvictedPullRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		state      string
+		wantStatus int
+	}{
+		{"still open", "open", http.StatusOK},
+		{"closed meanwhile", "closed", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestGitHub(t, map[string]string{
+				"/repos/o/aaa/pulls/1": fmt.Sprintf(`{"number":1,"state":"%s","head":{"ref":"foo"},"body":"DependsOn:bbb#2"}`, tt.state),
+			})
+			app := newTestApp(t, `{"max_cached_pull_requests":2,"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			openTestPullRequest(app, "bbb", 2)
+			openTestPullRequest(app, "aaa", 1, "bbb#2")
+			openTestPullRequest(app, "ccc", 3)
+			openTestPullRequest(app, "ddd", 4)
+			if !app.cache.IsEvicted("aaa", 1) {
+				t.Fatalf("aaa#1 was not evicted")
+			}
+
+			r := httptest.NewRequest("GET", "/status/aaa/1", nil)
+			r = mux.SetURLVars(r, map[string]string{"repo": "aaa", "num": "1"})
+			w := httptest.NewRecorder()
+			app.apiHandlerGetStatus(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if app.cache.IsEvicted("aaa", 1) {
+				t.Errorf("aaa#1 was not reloaded")
+			}
+			if tt.wantStatus == http.StatusOK && !strings.Contains(w.Body.String(), `"blocked":true`) {
+				t.Errorf("got %s, want reloaded pull request blocked by evicted bbb#2", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAPIHandlerGetPullRequestDependencies(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		github     map[string]string
+		wantStatus int
+		want       string
+	}{
+		{
+			"from cache",
+			"",
+			map[string]string{},
+			http.StatusOK,
+			`[{"repository":"bbb","number":2,"state":"open","source":"cache"},{"repository":"ccc","number":3,"state":"closed","source":"cache"}]`,
+		},
+		{
+			"live",
+			"?live=1",
+			map[string]string{
+				"/repos/o/bbb/pulls/2": `{"number":2,"state":"closed","merged":true,"head":{"ref":"b"}}`,
+				"/repos/o/ccc/pulls/3": `{"number":3,"state":"closed","merged":false,"head":{"ref":"c"}}`,
+			},
+			http.StatusOK,
+			`[{"repository":"bbb","number":2,"state":"merged","source":"github"},{"repository":"ccc","number":3,"state":"closed","source":"github"}]`,
+		},
+		{
+			"live with GitHub error",
+			"?live=1",
+			map[string]string{
+				"/repos/o/bbb/pulls/2": `{"number":2,"state":"open","head":{"ref":"b"}}`,
+			},
+			http.StatusBadGateway,
+			"Error fetching dependency state from GitHub",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestGitHub(t, tt.github)
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			openTestPullRequest(app, "bbb", 2)
+			openTestPullRequest(app, "ccc", 3)
+			openTestPullRequest(app, "aaa", 1, "bbb#2", "ccc#3")
+			delete(app.cache.Branches["ccc"], 3)
+
+			r := httptest.NewRequest("GET", "/repos/aaa/pulls/1/dependencies"+tt.query, nil)
+			r = mux.SetURLVars(r, map[string]string{"repo": "aaa", "num": "1"})
+			w := httptest.NewRecorder()
+			app.apiHandlerGetPullRequestDependencies(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// freePort returns a port that was free a moment ago.
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestAdminPort(t *testing.T) {
+	port := freePort(t)
+	adminPort := freePort(t)
+	app := newTestApp(t, fmt.Sprintf(`{"port":"%s","admin_port":"%s","shutdown_timeout":1,"metrics_enabled":true}`, port, adminPort))
+	app.startAPI()
+	defer app.shutdown()
+
+	disabled := app.cfg.GetDisabledFeatureHTTPStatus()
+	tests := []struct {
+		port   string
+		method string
+		path   string
+		status int
+	}{
+		{port, "GET", "/", http.StatusOK},
+		{port, "GET", "/metrics", http.StatusNotFound},
+		{port, "GET", "/verify", http.StatusNotFound},
+		{port, "GET", "/events", http.StatusNotFound},
+		{port, "GET", "/errors", http.StatusNotFound},
+		{port, "GET", "/orphans", http.StatusNotFound},
+		{port, "GET", "/drift", http.StatusNotFound},
+		{port, "POST", "/rescan", http.StatusNotFound},
+		{adminPort, "GET", "/metrics", http.StatusOK},
+		{adminPort, "GET", "/verify", http.StatusOK},
+		{adminPort, "GET", "/events", http.StatusOK},
+		{adminPort, "GET", "/errors", http.StatusOK},
+		{adminPort, "GET", "/orphans", http.StatusOK},
+		{adminPort, "GET", "/drift", disabled},
+		{adminPort, "POST", "/rescan", disabled},
+		{adminPort, "GET", "/", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.port+tt.path, func(t *testing.T) {
+			r, _ := http.NewRequest(tt.method, "http://127.0.0.1:"+tt.port+tt.path, nil)
+			resp, err := http.DefaultClient.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestMaxActionAge(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour).Format(time.RFC3339)
+	recent := time.Now().Format(time.RFC3339)
+	tests := []struct {
+		name       string
+		maxAge     int
+		action     string
+		field      string
+		time       string
+		wantCached bool
+	}{
+		{"check disabled", 0, "opened", "created_at", old, true},
+		{"recently opened", 3600, "opened", "created_at", recent, true},
+		{"opened long ago", 3600, "opened", "created_at", old, false},
+		{"edited long ago", 3600, "edited", "updated_at", old, false},
+		{"closed long ago", 3600, "closed", "closed_at", old, true},
+		{"recently closed", 3600, "closed", "closed_at", recent, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, fmt.Sprintf(`{"max_action_age":%d,"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`, tt.maxAge))
+			if tt.action == "closed" {
+				openTestPullRequest(app, "a", 1)
+			}
+			var j map[string]interface{}
+			json.Unmarshal([]byte(pullRequestPayload(tt.action, "a", 1, "branch-1", "Some change")), &j)
+			j["pull_request"].(map[string]interface{})[tt.field] = tt.time
+			b, _ := json.Marshal(j)
+
+			w := postTestWebhook(app, "pull_request", string(b))
+			if w.Code != http.StatusOK {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+			}
+			if _, cached := app.cache.Branches["a"][1]; cached != tt.wantCached {
+				t.Errorf("got a#1 cached %v, want %v", cached, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestPullRequestLabels(t *testing.T) {
+	steps := []struct {
+		action string
+		labels []string
+		want   []string
+	}{
+		{"opened", []string{"bug"}, []string{"bug"}},
+		{"labeled", []string{"ui", "bug"}, []string{"bug", "ui"}},
+		{"assigned", []string{"other"}, []string{"bug", "ui"}},
+		{"unlabeled", []string{"ui"}, []string{"ui"}},
+		{"unlabeled", []string{}, []string{}},
+		{"edited", []string{"docs"}, []string{"docs"}},
+		{"closed", []string{"docs"}, []string{}},
+		{"labeled", []string{"late"}, []string{}},
+	}
+	app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+	for i, step := range steps {
+		var j map[string]interface{}
+		json.Unmarshal([]byte(pullRequestPayload(step.action, "a", 1, "feature", "Some change")), &j)
+		labels := []interface{}{}
+		for _, label := range step.labels {
+			labels = append(labels, map[string]interface{}{"name": label})
+		}
+		j["pull_request"].(map[string]interface{})["labels"] = labels
+		b, _ := json.Marshal(j)
+		postTestWebhook(app, "pull_request", string(b))
+
+		if got := app.cache.Snapshot().GetLabels("a", 1); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("step %d %s: got labels %v, want %v", i, step.action, got, step.want)
+		}
+	}
+}
+
+func TestOnGitHubError(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		wantStatus  int
+		wantDeps    string
+		wantBlocked bool
+	}{
+		{"default", "", http.StatusBadGateway, "Error fetching dependency state from GitHub", true},
+		{"fail closed", "closed", http.StatusBadGateway, "Error fetching dependency state from GitHub", true},
+		{"fail open", "open", http.StatusOK, `[{"repository":"bbb","number":2,"state":"unknown","source":"cache"}]`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// GitHub fails every request
+			newTestGitHub(t, map[string]string{})
+			app := newTestApp(t, fmt.Sprintf(`{"on_github_error":"%s","max_cached_pull_requests":3,
+				"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`, tt.mode))
+			openTestPullRequest(app, "bbb", 2)
+			openTestPullRequest(app, "aaa", 1, "bbb#2")
+			openTestPullRequest(app, "ccc", 3)
+			openTestPullRequest(app, "ddd", 4)
+			if !app.cache.IsEvicted("bbb", 2) {
+				t.Fatalf("bbb#2 was not evicted")
+			}
+
+			r := httptest.NewRequest("GET", "/repos/aaa/pulls/1/dependencies?live=1", nil)
+			r = mux.SetURLVars(r, map[string]string{"repo": "aaa", "num": "1"})
+			w := httptest.NewRecorder()
+			app.apiHandlerGetPullRequestDependencies(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("got live lookup status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tt.wantDeps {
+				t.Errorf("got live lookup %s, want %s", got, tt.wantDeps)
+			}
+
+			r = httptest.NewRequest("GET", "/status/aaa/1", nil)
+			r = mux.SetURLVars(r, map[string]string{"repo": "aaa", "num": "1"})
+			w = httptest.NewRecorder()
+			app.apiHandlerGetStatus(w, r)
+			var status PullRequestStatus
+			json.Unmarshal(w.Body.Bytes(), &status)
+			if status.Blocked != tt.wantBlocked {
+				t.Errorf("got blocked %v, want %v: %s", status.Blocked, tt.wantBlocked, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestPathQualifiedDependencies(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		wantDeps     []PullRequestRef
+		wantBlockers int
+	}{
+		{
+			"plain",
+			"DependsOn:mono#2",
+			[]PullRequestRef{{Repository: "mono", Number: 2}},
+			1,
+		},
+		{
+			"path qualified",
+			"DependsOn:mono/services/api#2",
+			[]PullRequestRef{{Repository: "mono", Number: 2, Path: "services/api"}},
+			1,
+		},
+		{
+			"same pull request with different paths",
+			"DependsOn:mono/services/api#2\r\nDependsOn:mono/web#2",
+			[]PullRequestRef{{Repository: "mono", Number: 2, Path: "services/api"}, {Repository: "mono", Number: 2, Path: "web"}},
+			2,
+		},
+		{
+			"pull request which is not open",
+			"DependsOn:mono/web#3",
+			[]PullRequestRef{{Repository: "mono", Number: 3, Path: "web"}},
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			openTestPullRequest(app, "mono", 2)
+			postTestWebhook(app, "pull_request", pullRequestPayload("opened", "aaa", 1, "feature", tt.body))
+
+			snapshot := app.cache.Snapshot()
+			if got := snapshot.Dependencies.Get("aaa", 1); !reflect.DeepEqual(got, tt.wantDeps) {
+				t.Errorf("got dependencies %v, want %v", got, tt.wantDeps)
+			}
+			if got := snapshot.GetBlockers("aaa", 1); len(got) != tt.wantBlockers {
+				t.Errorf("got blockers %v, want %d", got, tt.wantBlockers)
+			}
+			if got := snapshot.Verify(); len(got) != 0 {
+				t.Errorf("got anomalies %v", got)
+			}
+		})
+	}
+}
+
+func TestInstallationEvents(t *testing.T) {
+	dependsOn := `"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[{"name":"skipped"}]}`
+	tests := []struct {
+		name         string
+		cfg          string
+		event        string
+		payload      string
+		wantStatus   int
+		wantBranches map[string]int
+	}{
+		{
+			"installation without PullRequestDependsOn",
+			`{}`,
+			"installation",
+			`{"action":"created"}`,
+			http.StatusOK,
+			map[string]int{"a": 1},
+		},
+		{
+			"meta without PullRequestDependsOn",
+			`{}`,
+			"meta",
+			`{"action":"deleted"}`,
+			http.StatusOK,
+			map[string]int{"a": 1},
+		},
+		{
+			"repositories added without resync",
+			`{` + dependsOn + `}`,
+			"installation_repositories",
+			`{"action":"added","repositories_added":[{"name":"b"}]}`,
+			http.StatusOK,
+			map[string]int{"a": 1},
+		},
+		{
+			"repositories added with resync",
+			`{"resync_on_installation_change":true,` + dependsOn + `}`,
+			"installation_repositories",
+			`{"action":"added","repositories_added":[{"name":"b"},{"name":"skipped"}]}`,
+			http.StatusOK,
+			map[string]int{"a": 1, "b": 2},
+		},
+		{
+			"repositories removed with resync",
+			`{"resync_on_installation_change":true,` + dependsOn + `}`,
+			"installation_repositories",
+			`{"action":"removed","repositories_removed":[{"name":"a"}]}`,
+			http.StatusOK,
+			map[string]int{"a": 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestGitHub(t, map[string]string{
+				"/repos/o/b/pulls":       `[{"number":2,"head":{"ref":"b2"},"body":""},{"number":3,"head":{"ref":"b3"},"body":""}]`,
+				"/repos/o/skipped/pulls": `[{"number":4,"head":{"ref":"s4"},"body":""}]`,
+			})
+			app := newTestApp(t, tt.cfg)
+			openTestPullRequest(app, "a", 1)
+
+			w := postTestWebhook(app, tt.event, tt.payload)
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			got := map[string]int{}
+			for repo := range tt.wantBranches {
+				got[repo] = len(app.cache.Branches[repo])
+			}
+			if _, hasKey := app.cache.Branches["skipped"]; hasKey {
+				t.Errorf("excluded repository got cached")
+			}
+			if !reflect.DeepEqual(got, tt.wantBranches) {
+				t.Errorf("got pull requests per repository %v, want %v", got, tt.wantBranches)
+			}
+		})
+	}
+}
+
+func TestPolicyViolations(t *testing.T) {
+	dependsOn := `"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]%s}`
+	tests := []struct {
+		name string
+		cfg  string
+		want string
+	}{
+		{"no policy", fmt.Sprintf(dependsOn, ""), `[]`},
+		{"all repositories", fmt.Sprintf(dependsOn, `,"require_declaration":[{"name":"*"}]`), `[{"repository":"app","number":2},{"repository":"lib","number":5}]`},
+		{"selected repositories", fmt.Sprintf(dependsOn, `,"require_declaration":[{"name":"lib"}]`), `[{"repository":"lib","number":5}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, "{"+tt.cfg+"}")
+			for _, pr := range []struct {
+				action string
+				repo   string
+				num    int
+				body   string
+			}{
+				{"opened", "app", 1, "DependsOn:none"},
+				{"opened", "app", 2, "No declaration"},
+				{"opened", "app", 3, "DependsOn:app#1"},
+				{"opened", "lib", 4, "Nothing yet"},
+				{"edited", "lib", 4, "DependsOn:none"},
+				{"opened", "lib", 5, "<!-- DependsOn:none -->"},
+				{"opened", "lib", 6, "Closed before declaring"},
+				{"closed", "lib", 6, "Closed before declaring"},
+			} {
+				w := postTestWebhook(app, "pull_request", pullRequestPayload(pr.action, pr.repo, pr.num, fmt.Sprintf("branch-%d", pr.num), pr.body))
+				if w.Code != http.StatusOK {
+					t.Fatalf("got status %d posting %s#%d", w.Code, pr.repo, pr.num)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			app.apiHandlerGetPolicyViolations(w, httptest.NewRequest("GET", "/policy/violations", nil))
+			if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRejectForeignOwner(t *testing.T) {
+	tests := []struct {
+		name   string
+		owner  string
+		status int
+		cached bool
+	}{
+		{"configured owner", "o", http.StatusOK, true},
+		{"owner in different case", "O", http.StatusOK, true},
+		{"foreign owner", "other", http.StatusForbidden, false},
+		{"no owner in payload", "", http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+
+			w := postTestWebhook(app, "pull_request", ownedPullRequestPayload("opened", tt.owner, "app", 1, "foo", "DependsOn:none"))
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+			if _, got := app.cache.Branches["app"][1]; got != tt.cached {
+				t.Errorf("got cached %v, want %v", got, tt.cached)
+			}
+		})
+	}
+}
+
+func TestSameNamedRepositoriesOfTwoOwners(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"foreign dependent", ownedPullRequestPayload("opened", "other", "app", 3, "bar", "DependsOn:lib#1")},
+		{"foreign dependency closed", ownedPullRequestPayload("closed", "other", "lib", 1, "lib", "")},
+		{"foreign dependent edited", ownedPullRequestPayload("edited", "other", "app", 2, "foo", "DependsOn:none")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			postTestWebhook(app, "pull_request", ownedPullRequestPayload("opened", "o", "lib", 1, "lib", "DependsOn:none"))
+			postTestWebhook(app, "pull_request", ownedPullRequestPayload("opened", "o", "app", 2, "foo", "DependsOn:lib#1"))
+
+			w := postTestWebhook(app, "pull_request", tt.payload)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusForbidden)
+			}
+			want := []BranchEntry{{Repository: "app", Number: 2, Branch: "foo"}}
+			if got := app.cache.GetDependents("lib", 1); !reflect.DeepEqual(got, want) {
+				t.Errorf("got dependents %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// ownedPullRequestPayload is pullRequestPayload with the repository owner
+// set, unless owner is empty.
+func ownedPullRequestPayload(action string, owner string, repo string, num int, branch string, body string) string {
+	var j map[string]interface{}
+	json.Unmarshal([]byte(pullRequestPayload(action, repo, num, branch, body)), &j)
+	if owner != "" {
+		j["repository"].(map[string]interface{})["owner"] = map[string]interface{}{"login": owner}
+	}
+	b, _ := json.Marshal(j)
+	return string(b)
+}
+
+func TestParseDependsOn(t *testing.T) {
+	tests := []struct {
+		name    string
+		dep     string
+		want    PullRequestRef
+		wantErr bool
+	}{
+		{"plain", "bbb#2", PullRequestRef{Repository: "bbb", Number: 2}, false},
+		{"path qualified", "mono/services/api#2", PullRequestRef{Repository: "mono", Number: 2, Path: "services/api"}, false},
+		{"annotated", "bbb#2 [JIRA-123]", PullRequestRef{Repository: "bbb", Number: 2, Annotation: "JIRA-123"}, false},
+		{"annotated path", "mono/api#2 [see JIRA-1]", PullRequestRef{Repository: "mono", Number: 2, Path: "api", Annotation: "see JIRA-1"}, false},
+		{"zero padded", "bbb#007", PullRequestRef{Repository: "bbb", Number: 7}, false},
+		{"zero", "bbb#000", PullRequestRef{}, true},
+		{"negative", "bbb#-1", PullRequestRef{}, true},
+		{"no number", "bbb", PullRequestRef{}, true},
+		{"invalid number", "bbb#x [JIRA-123]", PullRequestRef{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDependsOn(tt.dep)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnnotatedDependencies(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		wantBlockers string
+		wantDeps     string
+	}{
+		{
+			"without annotation",
+			"DependsOn:lib#1",
+			`[{"repository":"lib","number":1}]`,
+			`[{"repository":"lib","number":1,"state":"open","source":"cache"}]`,
+		},
+		{
+			"with annotation",
+			"DependsOn:lib#1 [JIRA-123]\r\nDependsOn:api#2",
+			`[{"repository":"api","number":2},{"repository":"lib","number":1,"annotation":"JIRA-123"}]`,
+			`[{"repository":"api","number":2,"state":"open","source":"cache"},{"repository":"lib","number":1,"annotation":"JIRA-123","state":"open","source":"cache"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			for _, pr := range []struct {
+				repo string
+				num  int
+				body string
+			}{{"lib", 1, "Fix"}, {"api", 2, "Fix"}, {"app", 3, tt.body}} {
+				postTestWebhook(app, "pull_request", pullRequestPayload("opened", pr.repo, pr.num, fmt.Sprintf("branch-%d", pr.num), pr.body))
+			}
+
+			b, _ := json.Marshal(app.cache.Snapshot().GetBlockers("app", 3))
+			if got := string(b); got != tt.wantBlockers {
+				t.Errorf("got blockers %s, want %s", got, tt.wantBlockers)
+			}
+
+			r := httptest.NewRequest("GET", "/repos/app/pulls/3/dependencies", nil)
+			r = mux.SetURLVars(r, map[string]string{"repo": "app", "num": "3"})
+			w := httptest.NewRecorder()
+			app.apiHandlerGetPullRequestDependencies(w, r)
+			if got := strings.TrimSpace(w.Body.String()); got != tt.wantDeps {
+				t.Errorf("got dependencies %s, want %s", got, tt.wantDeps)
+			}
+
+			// edit dropping the annotated dependency removes its annotation
+			postTestWebhook(app, "pull_request", pullRequestPayload("edited", "app", 3, "branch-3", "DependsOn:api#2"))
+			if got := app.cache.GetAnnotation("app", 3, PullRequestRef{Repository: "lib", Number: 1}); got != "" {
+				t.Errorf("got annotation %q after edit, want none", got)
+			}
+		})
+	}
+}
+
+func TestAPIHandlerGetPulls(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		want   []string
+	}{
+		{"default order", "", http.StatusOK, []string{"aaa#1", "aaa#2", "bbb#3", "bbb#4", "ccc#5"}},
+		{"blocking order", "?sort=blocking", http.StatusOK, []string{"ccc#5", "aaa#2", "bbb#4", "aaa#1", "bbb#3"}},
+		{"single repository", "?repo=bbb&sort=blocking", http.StatusOK, []string{"bbb#4", "bbb#3"}},
+		{"unknown repository", "?repo=zzz", http.StatusOK, []string{}},
+		{"invalid sort", "?sort=age", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{}`)
+			openTestPullRequest(app, "aaa", 1)
+			openTestPullRequest(app, "aaa", 2, "aaa#1")
+			openTestPullRequest(app, "bbb", 3)
+			openTestPullRequest(app, "bbb", 4, "bbb#3")
+			openTestPullRequest(app, "ccc", 5, "aaa#1", "aaa#2", "bbb#3")
+
+			w := httptest.NewRecorder()
+			app.apiHandlerGetPulls(w, httptest.NewRequest("GET", "/pulls"+tt.query, nil))
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d", w.Code, tt.status)
+			}
+			if tt.want == nil {
+				return
+			}
+			statuses := []PullRequestStatus{}
+			if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, s := range statuses {
+				got = append(got, fmt.Sprintf("%s#%d", s.Repository, s.Number))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSkipDraftsAtStartup(t *testing.T) {
+	tests := []struct {
+		name string
+		skip bool
+		want map[int]string
+	}{
+		{"drafts included", false, map[int]string{1: "ready", 2: "draft", 3: "unset"}},
+		{"drafts skipped", true, map[int]string{1: "ready", 3: "unset"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestGitHub(t, map[string]string{
+				"/orgs/o/repos": `[{"name":"app"}]`,
+				"/repos/o/app/pulls": `[{"number":1,"draft":false,"head":{"ref":"ready"},"body":""},` +
+					`{"number":2,"draft":true,"head":{"ref":"draft"},"body":""},` +
+					`{"number":3,"head":{"ref":"unset"},"body":""}]`,
+			})
+			app := newTestApp(t, fmt.Sprintf(`{"skip_drafts_at_startup":%v,"pull_request_depends_on":{"owner":"o","organization":true,"repositories":[{"name":"*"}],"exclude_repositories":[]}}`, tt.skip))
+			app.populateCache(context.Background(), false)
+
+			if got := app.cache.Branches["app"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIHandlerPostSignature(t *testing.T) {
+	body := pullRequestPayload("opened", "app", 1, "foo", "DependsOn:none")
+	gzipped := gzipString(body)
+	form := "payload=" + url.QueryEscape(body)
+	tests := []struct {
+		name    string
+		secret  string
+		body    string
+		headers map[string]string
+		status  int
+	}{
+		{"no secret and unsigned", "", body, map[string]string{}, http.StatusOK},
+		{"valid sha256", "secret", body, map[string]string{"X-Hub-Signature-256": testSignature(sha256.New, "sha256=", "secret", body)}, http.StatusOK},
+		{"valid sha1", "secret", body, map[string]string{"X-Hub-Signature": testSignature(sha1.New, "sha1=", "secret", body)}, http.StatusOK},
+		{"invalid signature", "secret", body, map[string]string{"X-Hub-Signature-256": testSignature(sha256.New, "sha256=", "wrong", body)}, http.StatusUnauthorized},
+		{"missing header", "secret", body, map[string]string{}, http.StatusUnauthorized},
+		{"empty body", "secret", "", map[string]string{"X-Hub-Signature-256": testSignature(sha256.New, "sha256=", "secret", body)}, http.StatusUnauthorized},
+		{"gzip signed over raw bytes", "secret", gzipped, map[string]string{"Content-Encoding": "gzip", "X-Hub-Signature-256": testSignature(sha256.New, "sha256=", "secret", gzipped)}, http.StatusOK},
+		{"gzip signed over decompressed body", "secret", gzipped, map[string]string{"Content-Encoding": "gzip", "X-Hub-Signature-256": testSignature(sha256.New, "sha256=", "secret", body)}, http.StatusUnauthorized},
+		{"form signed over raw bytes", "secret", form, map[string]string{"Content-Type": "application/x-www-form-urlencoded", "X-Hub-Signature-256": testSignature(sha256.New, "sha256=", "secret", form)}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, fmt.Sprintf(`{"incoming_webhook_secret":%q,"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`, tt.secret))
+
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			r.Header.Set("X-GitHub-Event", "pull_request")
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			app.apiHandlerPost(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+			if _, cached := app.cache.Branches["app"][1]; cached != (tt.status == http.StatusOK) {
+				t.Errorf("got cached %v for status %d", cached, w.Code)
+			}
+		})
+	}
+}
+
+func TestAPIHandlerPostPayloadSize(t *testing.T) {
+	body := pullRequestPayload("opened", "app", 1, "foo", "DependsOn:none")
+	previous := maxPayloadSize
+	maxPayloadSize = int64(len(body))
+	t.Cleanup(func() {
+		maxPayloadSize = previous
+	})
+	padded := pullRequestPayload("opened", "app", 1, "foo", "DependsOn:none"+strings.Repeat(" ", 1000))
+	tests := []struct {
+		name    string
+		body    string
+		headers map[string]string
+		status  int
+	}{
+		{"within limit", body, map[string]string{}, http.StatusOK},
+		{"above limit", padded, map[string]string{}, http.StatusRequestEntityTooLarge},
+		{"gzip within limit", gzipString(body), map[string]string{"Content-Encoding": "gzip"}, http.StatusOK},
+		{"gzip above limit once decompressed", gzipString(padded), map[string]string{"Content-Encoding": "gzip"}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			if int64(len(tt.body)) > maxPayloadSize && tt.headers["Content-Encoding"] != "" {
+				t.Fatalf("compressed body of %d bytes is above the limit", len(tt.body))
+			}
+
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			r.Header.Set("X-GitHub-Event", "pull_request")
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			app.apiHandlerPost(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+			if _, cached := app.cache.Branches["app"][1]; cached != (tt.status == http.StatusOK) {
+				t.Errorf("got cached %v for status %d", cached, w.Code)
+			}
+		})
+	}
+}
+
+func TestZeroPaddedDependencies(t *testing.T) {
+	tests := []struct {
+		name     string
+		deps     []string
+		wantDeps []PullRequestRef
+	}{
+		{"padded", []string{"lib#007"}, []PullRequestRef{{Repository: "lib", Number: 7}}},
+		{"padded and plain are one edge", []string{"lib#7", "lib#007"}, []PullRequestRef{{Repository: "lib", Number: 7}}},
+		{"zero", []string{"lib#000"}, []PullRequestRef{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{}`)
+			openTestPullRequest(app, "lib", 7)
+			openTestPullRequest(app, "app", 1, tt.deps...)
+
+			if got := app.cache.Dependencies.Get("app", 1); !reflect.DeepEqual(got, tt.wantDeps) {
+				t.Errorf("got dependencies %v, want %v", got, tt.wantDeps)
+			}
+			if got := app.cache.Snapshot().GetBlockers("app", 1); len(got) != len(tt.wantDeps) {
+				t.Errorf("got blockers %v, want %v", got, tt.wantDeps)
+			}
+			if got := app.cache.Dependents.Get("lib", 7); len(got) != len(tt.wantDeps) {
+				t.Errorf("got dependents %v", got)
+			}
+		})
+	}
+}
+
+func TestAPIHandlerGetDependents(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		status int
+		want   string
+	}{
+		{"dependents", "/dependents/lib/1", "t", http.StatusOK, `[{"repository":"api","number":2,"branch":"branch-2"},{"repository":"app","number":3,"branch":"branch-3"}]`},
+		{"path qualified dependent", "/dependents/api/2", "t", http.StatusOK, `[{"repository":"app","number":3,"branch":"branch-3"}]`},
+		{"nothing depends on it", "/dependents/app/3", "t", http.StatusNotFound, `[]`},
+		{"number out of range", "/dependents/lib/99999999999999999999", "t", http.StatusBadRequest, `{"error":"invalid pull request number"}`},
+		{"invalid token", "/dependents/lib/1", "wrong", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"incoming_api_token_header":"X-Token","incoming_api_token_value":"t"}`)
+			openTestPullRequest(app, "lib", 1)
+			openTestPullRequest(app, "api", 2, "lib#1")
+			openTestPullRequest(app, "app", 3, "lib#1", "api/server#2")
+
+			router := mux.NewRouter()
+			router.HandleFunc("/dependents/{repo}/{num:[0-9]+}", app.apiHandlerGetDependents)
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Header.Set("X-Token", tt.token)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+			if tt.want != "" {
+				if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+					t.Errorf("got %s, want %s", got, tt.want)
+				}
+				if got := w.Result().Header.Get("content-type"); got != "application/json" {
+					t.Errorf("got content-type %q, want application/json", got)
+				}
+			}
+		})
+	}
+}
+
+func TestEditBodyToEmpty(t *testing.T) {
+	tests := []struct {
+		name           string
+		action         string
+		body           string
+		wantCached     bool
+		wantDeps       []PullRequestRef
+		wantSoft       []PullRequestRef
+		wantDependents []PullRequestRef
+	}{
+		{"edited to empty", "edited", "", true, []PullRequestRef{}, []PullRequestRef{}, []PullRequestRef{}},
+		{"edited keeping dependency", "edited", "DependsOn:lib#1", true, []PullRequestRef{{Repository: "lib", Number: 1}}, []PullRequestRef{}, []PullRequestRef{{Repository: "app", Number: 2}}},
+		{"closed with empty body", "closed", "", false, []PullRequestRef{}, []PullRequestRef{}, []PullRequestRef{}},
+		{"synchronize to empty", "synchronize", "", true, []PullRequestRef{}, []PullRequestRef{}, []PullRequestRef{}},
+		{"synchronize keeping dependency", "synchronize", "DependsOn:lib#1", true, []PullRequestRef{{Repository: "lib", Number: 1}}, []PullRequestRef{}, []PullRequestRef{{Repository: "app", Number: 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			postTestWebhook(app, "pull_request", pullRequestPayload("opened", "lib", 1, "lib", "Fix"))
+			postTestWebhook(app, "pull_request", pullRequestPayload("opened", "lib", 3, "soft", "Fix"))
+			postTestWebhook(app, "pull_request", pullRequestPayload("opened", "app", 2, "app", "DependsOn:lib#1\r\nSoftDependsOn:lib#3"))
+
+			w := postTestWebhook(app, "pull_request", pullRequestPayload(tt.action, "app", 2, "app", tt.body))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d", w.Code)
+			}
+			if _, got := app.cache.Branches["app"][2]; got != tt.wantCached {
+				t.Errorf("got cached %v, want %v", got, tt.wantCached)
+			}
+			if got := app.cache.Dependencies.Get("app", 2); !reflect.DeepEqual(got, tt.wantDeps) {
+				t.Errorf("got dependencies %v, want %v", got, tt.wantDeps)
+			}
+			if got := app.cache.SoftDependencies.Get("app", 2); !reflect.DeepEqual(got, tt.wantSoft) {
+				t.Errorf("got soft dependencies %v, want %v", got, tt.wantSoft)
+			}
+			if got := app.cache.Dependents.Get("lib", 1); !reflect.DeepEqual(got, tt.wantDependents) {
+				t.Errorf("got dependents %v, want %v", got, tt.wantDependents)
+			}
+		})
+	}
+}
+
+func TestStrictDependencies(t *testing.T) {
+	tests := []struct {
+		name        string
+		strict      bool
+		body        string
+		wantDeps    []PullRequestRef
+		wantLog     string
+		wantBlocked bool
+	}{
+		{"open target", false, "DependsOn:lib#1", []PullRequestRef{{Repository: "lib", Number: 1}}, "", true},
+		{"repeated target", false, "DependsOn:lib#1\r\nDependsOn:lib#1 [JIRA-1]", []PullRequestRef{{Repository: "lib", Number: 1}}, "", true},
+		{"lenient pull request not open", false, "DependsOn:lib#9", []PullRequestRef{{Repository: "lib", Number: 9}}, "Dependency on a pull request which is not open", true},
+		{"lenient repository not tracked", false, "DependsOn:skipped#1", []PullRequestRef{{Repository: "skipped", Number: 1}}, "Dependency on a repository which is not tracked", false},
+		{"strict pull request not open", true, "DependsOn:lib#9", []PullRequestRef{}, "Dependency on a pull request which is not open. Ignoring it", false},
+		{"strict repository not tracked", true, "DependsOn:skipped#1", []PullRequestRef{}, "Dependency on a repository which is not tracked. Ignoring it", false},
+		{"strict open target", true, "DependsOn:lib#1", []PullRequestRef{{Repository: "lib", Number: 1}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, fmt.Sprintf(`{"strict_dependencies":%v,"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[{"name":"skipped"}]}}`, tt.strict))
+			postTestWebhook(app, "pull_request", pullRequestPayload("opened", "lib", 1, "lib", "DependsOn:none"))
+			logs := captureLogs(t, LogLevelWarn)
+			postTestWebhook(app, "pull_request", pullRequestPayload("opened", "app", 2, "app", tt.body))
+
+			if got := app.cache.Dependencies.Get("app", 2); !reflect.DeepEqual(got, tt.wantDeps) {
+				t.Errorf("got dependencies %v, want %v", got, tt.wantDeps)
+			}
+			if tt.wantLog != "" && !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("missing %q in logs:\n%s", tt.wantLog, logs.String())
+			}
+			if tt.wantLog == "" && logs.Len() > 0 {
+				t.Errorf("got unexpected logs:\n%s", logs.String())
+			}
+
+			// a stored target blocks its dependent once it gets opened
+			postTestWebhook(app, "pull_request", pullRequestPayload("opened", "lib", 9, "lib-9", "DependsOn:none"))
+			if got := app.cache.IsBlocked("app", 2); got != tt.wantBlocked {
+				t.Errorf("got blocked %v, want %v", got, tt.wantBlocked)
+			}
+		})
+	}
+}
+
+func TestSharedDependencyNotOpen(t *testing.T) {
+	tests := []struct {
+		name           string
+		action         string
+		body           string
+		wantDependents []BranchEntry
+	}{
+		{"dependent edited", "edited", "Fix\r\nDependsOn:lib#9", []BranchEntry{{Repository: "app", Number: 2, Branch: "app"}, {Repository: "web", Number: 5, Branch: "web"}}},
+		{"dependency edited out", "edited", "DependsOn:none", []BranchEntry{{Repository: "web", Number: 5, Branch: "web"}}},
+		{"dependent closed", "closed", "DependsOn:lib#9", []BranchEntry{{Repository: "web", Number: 5, Branch: "web"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			postTestWebhook(app, "pull_request", pullRequestPayload("opened", "app", 2, "app", "DependsOn:lib#9"))
+			postTestWebhook(app, "pull_request", pullRequestPayload("opened", "web", 5, "web", "DependsOn:lib#9"))
+			postTestWebhook(app, "pull_request", pullRequestPayload(tt.action, "app", 2, "app", tt.body))
+			postTestWebhook(app, "pull_request", pullRequestPayload("opened", "lib", 9, "lib", "DependsOn:none"))
+
+			if got := app.cache.GetDependents("lib", 9); !reflect.DeepEqual(got, tt.wantDependents) {
+				t.Errorf("got dependents %v, want %v", got, tt.wantDependents)
+			}
+			if got := app.cache.Verify(); len(got) != 0 {
+				t.Errorf("got anomalies %v", got)
+			}
+			if !app.cache.IsBlocked("web", 5) {
+				t.Errorf("got web#5 not blocked")
+			}
+		})
+	}
+}
+
+func TestMixedCaseDependencyRepository(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []PullRequestRef
+	}{
+		{"cached case", "DependsOn:mylib#1", []PullRequestRef{{Repository: "mylib", Number: 1}}},
+		{"other case", "DependsOn:MyLib#1", []PullRequestRef{{Repository: "mylib", Number: 1}}},
+		{"relaxed syntax", "Depends-On : MYLIB # 1", []PullRequestRef{{Repository: "mylib", Number: 1}}},
+		{"unknown repository", "DependsOn:other#1", []PullRequestRef{{Repository: "other", Number: 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			postTestWebhook(app, "pull_request", pullRequestPayload("opened", "mylib", 1, "lib", "Fix"))
+			postTestWebhook(app, "pull_request", pullRequestPayload("opened", "app", 2, "app", tt.body))
+
+			if got := app.cache.Dependencies.Get("app", 2); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got dependencies %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIHandlerGetPullRequestRaw(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+		want   string
+	}{
+		{"plain", "/repos/app/pulls/2/raw", "DependsOn:lib#1", http.StatusOK, `["lib#1"]`},
+		{"zero padded and annotated", "/repos/app/pulls/2/raw", "DependsOn:lib#001 [JIRA-1]\r\nDependsOn:mono/api#3", http.StatusOK, `["lib#001 [JIRA-1]","mono/api#3"]`},
+		{"unknown target kept", "/repos/app/pulls/2/raw", "DependsOn:unknown#9", http.StatusOK, `["unknown#9"]`},
+		{"no dependencies", "/repos/app/pulls/2/raw", "Fix", http.StatusOK, `[]`},
+		{"not cached", "/repos/app/pulls/3/raw", "DependsOn:lib#1", http.StatusNotFound, ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			postTestWebhook(app, "pull_request", pullRequestPayload("opened", "lib", 1, "lib", "Fix"))
+			postTestWebhook(app, "pull_request", pullRequestPayload("opened", "app", 2, "app", tt.body))
+
+			router := mux.NewRouter()
+			router.HandleFunc("/repos/{repo}/pulls/{num:[0-9]+}/raw", app.apiHandlerGetPullRequestRaw)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+
+			if w.Code != tt.status {
+				t.Errorf("got status %d, want %d", w.Code, tt.status)
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+
+			// closing drops the raw lines
+			postTestWebhook(app, "pull_request", pullRequestPayload("closed", "app", 2, "app", tt.body))
+			if got := app.cache.GetRawDependsOn("app", 2); len(got) != 0 {
+				t.Errorf("got raw lines %v after close", got)
+			}
+		})
+	}
+}
+
+func TestConcurrentCacheUpdates(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+	}{
+		{"single worker", 1},
+		{"many workers", 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			postTestWebhook(app, "pull_request", pullRequestPayload("opened", "lib", 1, "lib", "Fix"))
+
+			var wg sync.WaitGroup
+			for i := 0; i < tt.workers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for n := 0; n < 20; n++ {
+						num := 100*i + n + 2
+						postTestWebhook(app, "pull_request", pullRequestPayload("opened", "app", num, fmt.Sprintf("branch-%d", num), "DependsOn:lib#1"))
+						app.cache.Snapshot().GetBlockers("app", num)
+						if n%2 == 0 {
+							postTestWebhook(app, "pull_request", pullRequestPayload("closed", "app", num, fmt.Sprintf("branch-%d", num), "DependsOn:lib#1"))
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			want := tt.workers * 10
+			if got := len(app.cache.Branches["app"]); got != want {
+				t.Errorf("got %d open pull requests, want %d", got, want)
+			}
+			if got := len(app.cache.Dependents.Get("lib", 1)); got != want {
+				t.Errorf("got %d dependents, want %d", got, want)
+			}
+			if anomalies := app.cache.Snapshot().Verify(); len(anomalies) > 0 {
+				t.Errorf("got anomalies %v", anomalies)
+			}
+		})
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	tests := []struct {
+		name        string
+		ready       bool
+		shutdown    bool
+		wantHealthz string
+		wantReadyz  int
+	}{
+		{"scanning", false, false, `{"prs":2,"repos":1,"status":"ok"}`, http.StatusServiceUnavailable},
+		{"ready", true, false, `{"prs":2,"repos":1,"status":"ok"}`, http.StatusOK},
+		{"shutting down", true, true, `{"prs":2,"repos":1,"status":"ok"}`, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"incoming_api_token_header":"X-Token","incoming_api_token_value":"t"}`)
+			openTestPullRequest(app, "app", 1)
+			openTestPullRequest(app, "app", 2)
+			if tt.ready {
+				app.ready = 1
+			}
+			if tt.shutdown {
+				app.shutdown()
+			}
+
+			// probes do not send the API token
+			w := httptest.NewRecorder()
+			app.apiHandlerGetHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("got healthz status %d", w.Code)
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tt.wantHealthz {
+				t.Errorf("got healthz %s, want %s", got, tt.wantHealthz)
+			}
+
+			w = httptest.NewRecorder()
+			app.apiHandlerGetReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+			if w.Code != tt.wantReadyz {
+				t.Errorf("got readyz status %d, want %d", w.Code, tt.wantReadyz)
+			}
+		})
+	}
+}
+
+func TestResponseEnvelope(t *testing.T) {
+	tests := []struct {
+		name     string
+		envelope bool
+	}{
+		{"raw", false},
+		{"envelope", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"response_envelope":`+strconv.FormatBool(tt.envelope)+`}`)
+			openTestPullRequest(app, "aaa", 1)
+
+			w := httptest.NewRecorder()
+			app.apiHandlerGetPulls(w, httptest.NewRequest("GET", "/pulls", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d", w.Code)
+			}
+
+			data := w.Body.Bytes()
+			if tt.envelope {
+				var env struct {
+					Data json.RawMessage `json:"data"`
+					Meta ResponseMeta    `json:"meta"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+					t.Fatal(err)
+				}
+				if env.Meta.Version != VERSION {
+					t.Errorf("got version %q, want %q", env.Meta.Version, VERSION)
+				}
+				if _, err := time.Parse(time.RFC3339, env.Meta.Timestamp); err != nil {
+					t.Errorf("got invalid timestamp %q", env.Meta.Timestamp)
+				}
+				data = env.Data
+			}
+			statuses := []PullRequestStatus{}
+			if err := json.Unmarshal(data, &statuses); err != nil {
+				t.Fatal(err)
+			}
+			if len(statuses) != 1 || statuses[0].Repository != "aaa" || statuses[0].Number != 1 {
+				t.Errorf("got %v", statuses)
+			}
+		})
+	}
+}
+
+func TestAPIHandlerGetFiltered(t *testing.T) {
+	tests := []struct {
+		name         string
+		query        string
+		status       int
+		wantBranches map[string]map[int]string
+	}{
+		{"all", "", http.StatusOK, map[string]map[int]string{"aaa": {1: "branch-1", 2: "branch-2"}, "bbb": {3: "branch-3"}}},
+		{"repository", "?repo=aaa", http.StatusOK, map[string]map[int]string{"aaa": {1: "branch-1", 2: "branch-2"}}},
+		{"pull request", "?repo=aaa&num=2", http.StatusOK, map[string]map[int]string{"aaa": {2: "branch-2"}}},
+		{"unknown pull request", "?repo=aaa&num=9", http.StatusOK, map[string]map[int]string{}},
+		{"num without repo", "?num=2", http.StatusBadRequest, nil},
+		{"invalid num", "?repo=aaa&num=x", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{}`)
+			openTestPullRequest(app, "aaa", 1)
+			openTestPullRequest(app, "aaa", 2, "bbb#3")
+			openTestPullRequest(app, "bbb", 3)
+
+			w := httptest.NewRecorder()
+			app.apiHandlerGet(w, httptest.NewRequest("GET", "/"+tt.query, nil))
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d", w.Code, tt.status)
+			}
+			if tt.wantBranches == nil {
+				return
+			}
+			var c Cache
+			if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(c.Branches, tt.wantBranches) {
+				t.Errorf("got branches %v, want %v", c.Branches, tt.wantBranches)
+			}
+		})
+	}
+}
+
+func TestBlockedFlags(t *testing.T) {
+	steps := []struct {
+		name   string
+		action string
+		repo   string
+		num    int
+		deps   []string
+		want   []PullRequestRef
+	}{
+		{"open dependency", "opened", "lib", 1, []string{}, []PullRequestRef{}},
+		{"open dependent", "opened", "app", 2, []string{"lib#1"}, []PullRequestRef{{Repository: "app", Number: 2}}},
+		{"open transitive dependent", "opened", "web", 3, []string{"app#2"}, []PullRequestRef{{Repository: "app", Number: 2}, {Repository: "web", Number: 3}}},
+		{"close dependency", "closed", "lib", 1, []string{}, []PullRequestRef{{Repository: "web", Number: 3}}},
+		{"reopen dependency", "reopened", "lib", 1, []string{}, []PullRequestRef{{Repository: "app", Number: 2}, {Repository: "web", Number: 3}}},
+		{"edit out dependency", "edited", "app", 2, []string{}, []PullRequestRef{{Repository: "web", Number: 3}}},
+		{"close blocked", "closed", "web", 3, []string{"app#2"}, []PullRequestRef{}},
+		{"depend on closed", "opened", "api", 4, []string{"web#3"}, []PullRequestRef{}},
+		{"reopen closed dependency", "reopened", "web", 3, []string{"app#2"}, []PullRequestRef{{Repository: "api", Number: 4}, {Repository: "web", Number: 3}}},
+		{"edit in dependency", "edited", "api", 4, []string{"web#3"}, []PullRequestRef{{Repository: "api", Number: 4}, {Repository: "web", Number: 3}}},
+		{"close transitive dependency", "closed", "app", 2, []string{}, []PullRequestRef{{Repository: "api", Number: 4}}},
+	}
+	app := newTestApp(t, `{}`)
+	for _, step := range steps {
+		app.updateCache(step.action, step.repo, step.num, fmt.Sprintf("branch-%d", step.num), step.deps, []string{}, false)
+		if got := app.cache.GetBlocked(""); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: got blocked %v, want %v", step.name, got, step.want)
+		}
+		for repo, prs := range app.cache.Branches {
+			for num := range prs {
+				want := len(app.cache.GetBlockers(repo, num)) > 0
+				if got := app.cache.GetStatus(repo, num).Blocked; got != want {
+					t.Errorf("%s: got %s#%d blocked %v, want %v", step.name, repo, num, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestWriteRoutes(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		want      []string
+		wantNotIn []string
+	}{
+		{"default", `{"port":"8080"}`, []string{":8080 GET /\n", ":8080 POST /\n", ":8080 GET /metrics (disabled)\n", ":8080 GET /verify\n"}, []string{}},
+		{"metrics enabled", `{"port":"8080","metrics_enabled":true}`, []string{":8080 GET /metrics\n"}, []string{"(disabled)"}},
+		{"admin port", `{"port":"8080","admin_port":"9090"}`, []string{":8080 GET /pulls\n", ":9090 GET /metrics (disabled)\n", ":9090 GET /verify\n", ":9090 GET /events\n", ":9090 GET /errors\n", ":9090 GET /orphans\n", ":9090 GET /drift\n", ":9090 POST /rescan\n"}, []string{":8080 GET /metrics", ":8080 GET /verify", ":8080 GET /events", ":8080 GET /errors", ":8080 GET /orphans", ":8080 GET /drift", ":8080 POST /rescan"}},
+		{"webhook path", `{"port":"8080","webhook_paths":{"github":"/hooks/github"}}`, []string{":8080 POST /hooks/github\n"}, []string{":8080 POST /\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, tt.config)
+			var b strings.Builder
+			if err := app.writeRoutes(&b); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(b.String(), want) {
+					t.Errorf("missing %q in:\n%s", want, b.String())
+				}
+			}
+			for _, notWant := range tt.wantNotIn {
+				if strings.Contains(b.String(), notWant) {
+					t.Errorf("unexpected %q in:\n%s", notWant, b.String())
+				}
+			}
+		})
+	}
+}
+
+func TestMalformedWebhookPayloads(t *testing.T) {
+	tests := []struct {
+		name      string
+		event     string
+		body      string
+		status    int
+		wantError string
+	}{
+		{"empty body", "pull_request", ``, http.StatusBadRequest, "invalid JSON payload"},
+		{"truncated JSON", "pull_request", `{"action":"opened","pull_request":{`, http.StatusBadRequest, "invalid JSON payload"},
+		{"not an object", "push", `[]`, http.StatusBadRequest, "invalid JSON payload"},
+		{"missing pull_request", "pull_request", `{"action":"opened"}`, http.StatusBadRequest, "pull_request payload has no pull_request object"},
+		{"missing event header", "", `{}`, http.StatusBadRequest, "missing X-GitHub-Event header"},
+		{"valid", "pull_request", pullRequestPayload("opened", "aaa", 1, "feature", ""), http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			w := postTestWebhook(app, tt.event, tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d", w.Code, tt.status)
+			}
+			if tt.wantError == "" {
+				return
+			}
+			var resp ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Error != tt.wantError {
+				t.Errorf("got error %q, want %q", resp.Error, tt.wantError)
+			}
+		})
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and its
+// key to a temporary directory and returns paths of both files.
+func writeTestCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	tests := []struct {
+		name       string
+		tls        bool
+		wantScheme string
+	}{
+		{"http", false, "http://"},
+		{"https", true, "https://"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := fmt.Sprintf(`{"port":"%s","shutdown_timeout":1}`, freePort(t))
+			if tt.tls {
+				config = fmt.Sprintf(`{"port":"%s","shutdown_timeout":1,"tls_cert_file":%q,"tls_key_file":%q}`, freePort(t), certFile, keyFile)
+			}
+			app := newTestApp(t, config)
+			app.startAPI()
+			defer app.shutdown()
+
+			address := app.getDaemonURL("")
+			if !strings.HasPrefix(address, tt.wantScheme) {
+				t.Fatalf("got address %s, want scheme %s", address, tt.wantScheme)
+			}
+			resp, err := app.getDaemonClient().Get(address + "/healthz")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("got status %d", resp.StatusCode)
+			}
+			if (resp.TLS != nil) != tt.tls {
+				t.Errorf("got TLS %v, want %v", resp.TLS != nil, tt.tls)
+			}
+		})
+	}
+}
+
+func TestAPIHandlerGetMergeable(t *testing.T) {
+	dependsOn := `"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]%s}`
+	tests := []struct {
+		name string
+		cfg  string
+		want []BranchEntry
+	}{
+		{"no policy", fmt.Sprintf(dependsOn, ""), []BranchEntry{
+			{Repository: "app", Number: 1, Branch: "branch-1"},
+			{Repository: "app", Number: 4, Branch: "branch-4"},
+			{Repository: "lib", Number: 5, Branch: "branch-5"},
+		}},
+		{"declaration required", fmt.Sprintf(dependsOn, `,"require_declaration":[{"name":"lib"}]`), []BranchEntry{
+			{Repository: "app", Number: 1, Branch: "branch-1"},
+			{Repository: "app", Number: 4, Branch: "branch-4"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, "{"+tt.cfg+"}")
+			for _, pr := range []struct {
+				action string
+				repo   string
+				num    int
+				body   string
+			}{
+				{"opened", "app", 1, "DependsOn:none"},
+				{"opened", "app", 2, "DependsOn:app#1"},
+				{"opened", "app", 3, "DependsOn:app#2"},
+				{"opened", "lib", 6, "DependsOn:none"},
+				{"opened", "app", 4, "DependsOn:lib#6"},
+				{"closed", "lib", 6, "DependsOn:none"},
+				{"opened", "lib", 5, "No declaration"},
+			} {
+				w := postTestWebhook(app, "pull_request", pullRequestPayload(pr.action, pr.repo, pr.num, fmt.Sprintf("branch-%d", pr.num), pr.body))
+				if w.Code != http.StatusOK {
+					t.Fatalf("got status %d", w.Code)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			app.apiHandlerGetMergeable(w, httptest.NewRequest("GET", "/mergeable", nil))
+			got := []BranchEntry{}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIHandlerGetErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		event     string
+		body      string
+		headers   map[string]string
+		wantEvent string
+		want      string
+	}{
+		{"invalid JSON", "pull_request", `{`, map[string]string{}, "pull_request", "invalid JSON payload"},
+		{"missing event header", "", `{}`, map[string]string{}, "", "missing X-GitHub-Event header"},
+		{"invalid gzip", "push", `{}`, map[string]string{"Content-Encoding": "gzip"}, "push", "invalid gzip payload"},
+		{"invalid signature", "push", `{}`, map[string]string{"X-Hub-Signature-256": "sha256=00"}, "push", "Signature verification failed"},
+		{"success", "pull_request", pullRequestPayload("opened", "aaa", 1, "feature", ""), map[string]string{}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := ""
+			if tt.headers["X-Hub-Signature-256"] != "" {
+				secret = "secret"
+			}
+			app := newTestApp(t, `{"incoming_webhook_secret":"`+secret+`","pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			app.errorLog = NewErrorLog(app.cfg.GetMaxRecentErrors())
+
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			r.Header.Set("X-GitHub-Event", tt.event)
+			r.Header.Set("X-GitHub-Delivery", "delivery-1")
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			app.apiHandlerPost(httptest.NewRecorder(), r)
+
+			w := httptest.NewRecorder()
+			app.apiHandlerGetErrors(w, httptest.NewRequest("GET", "/errors", nil))
+			got := []ProcessingError{}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				if len(got) != 0 {
+					t.Errorf("got errors %v", got)
+				}
+				return
+			}
+			if len(got) != 1 {
+				t.Fatalf("got %d errors, want 1", len(got))
+			}
+			if got[0].Message != tt.want || got[0].Event != tt.wantEvent || got[0].DeliveryID != "delivery-1" {
+				t.Errorf("got %+v, want message %q and event %q", got[0], tt.want, tt.wantEvent)
+			}
+		})
+	}
+}
+
+func TestPullRequestTargetEvent(t *testing.T) {
+	tests := []struct {
+		name       string
+		handle     bool
+		wantCached bool
+		wantDeps   []PullRequestRef
+	}{
+		{"ignored by default", false, false, []PullRequestRef{}},
+		{"handled like pull_request", true, true, []PullRequestRef{{Repository: "lib", Number: 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"handle_pull_request_target":`+strconv.FormatBool(tt.handle)+`,"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			openTestPullRequest(app, "lib", 1)
+
+			w := postTestWebhook(app, "pull_request_target", pullRequestPayload("opened", "app", 2, "feature", "DependsOn:lib#1"))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d", w.Code)
+			}
+			if _, got := app.cache.Branches["app"][2]; got != tt.wantCached {
+				t.Errorf("got cached %v, want %v", got, tt.wantCached)
+			}
+			if got := app.cache.Dependencies.Get("app", 2); !reflect.DeepEqual(got, tt.wantDeps) {
+				t.Errorf("got dependencies %v, want %v", got, tt.wantDeps)
+			}
+		})
+	}
+}
+
+func TestPullRequestStates(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions []string
+		merged  bool
+		want    string
+	}{
+		{"opened", []string{"opened"}, false, PullRequestStateOpen},
+		{"closed", []string{"opened", "closed"}, false, PullRequestStateClosed},
+		{"merged", []string{"opened", "closed"}, true, PullRequestStateMerged},
+		{"reopened", []string{"opened", "closed", "reopened"}, false, PullRequestStateOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			for _, action := range tt.actions {
+				j := map[string]interface{}{}
+				json.Unmarshal([]byte(pullRequestPayload(action, "app", 1, "feature", "")), &j)
+				j["pull_request"].(map[string]interface{})["merged"] = tt.merged && action == "closed"
+				b, _ := json.Marshal(j)
+				if w := postTestWebhook(app, "pull_request", string(b)); w.Code != http.StatusOK {
+					t.Fatalf("got status %d", w.Code)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			app.apiHandlerGet(w, httptest.NewRequest("GET", "/", nil))
+			var c Cache
+			if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+				t.Fatal(err)
+			}
+			if got := c.States["app"][1]; got != tt.want {
+				t.Errorf("got state %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIHandlerDeleteBranch(t *testing.T) {
+	tests := []struct {
+		name           string
+		repo           string
+		num            string
+		wantStatus     int
+		wantBranch     string
+		wantDependents int
+	}{
+		{"dependency", "app", "1", http.StatusOK, "branch-1", 0},
+		{"dependent", "app", "2", http.StatusOK, "branch-2", 0},
+		{"not cached", "app", "9", http.StatusNotFound, "", 1},
+		{"unknown repository", "lib", "1", http.StatusNotFound, "", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			openTestPullRequest(app, "app", 1)
+			openTestPullRequest(app, "app", 2, "app#1")
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("DELETE", "/branch/"+tt.repo+"/"+tt.num, nil)
+			r = mux.SetURLVars(r, map[string]string{"repo": tt.repo, "num": tt.num})
+			app.apiHandlerDeleteBranch(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if w.Code == http.StatusOK {
+				removed := struct {
+					Branches map[string]map[string]string `json:"branches"`
+				}{}
+				if err := json.Unmarshal(w.Body.Bytes(), &removed); err != nil {
+					t.Fatal(err)
+				}
+				if got := removed.Branches[tt.repo][tt.num]; got != tt.wantBranch {
+					t.Errorf("got removed branch %q, want %q", got, tt.wantBranch)
+				}
+				num, _ := strconv.Atoi(tt.num)
+				if _, ok := app.cache.Branches[tt.repo][num]; ok {
+					t.Errorf("branch still in the cache")
+				}
+				if _, ok := app.cache.States[tt.repo][num]; ok {
+					t.Errorf("state still in the cache")
+				}
+			}
+			if got := len(app.cache.Dependents.Get("app", 1)); got != tt.wantDependents {
+				t.Errorf("got %d dependents of app#1, want %d", got, tt.wantDependents)
+			}
+		})
+	}
+}
+
+func TestAllowedCIDRs(t *testing.T) {
+	tests := []struct {
+		name          string
+		cidrs         string
+		trust         bool
+		remoteAddr    string
+		forwardedFor  string
+		wantForbidden bool
+	}{
+		{"empty list", `[]`, false, "203.0.113.5:1234", "", false},
+		{"allowed address", `["192.30.252.0/22","203.0.113.0/24"]`, false, "203.0.113.5:1234", "", false},
+		{"other address", `["192.30.252.0/22"]`, false, "203.0.113.5:1234", "", true},
+		{"ipv6 address", `["2001:db8::/32"]`, false, "[2001:db8::1]:1234", "", false},
+		{"forwarded for ignored", `["192.30.252.0/22"]`, false, "203.0.113.5:1234", "192.30.252.1", true},
+		{"forwarded for trusted", `["192.30.252.0/22"]`, true, "10.0.0.1:1234", "192.30.252.1", false},
+		{"last forwarded address used", `["192.30.252.0/22"]`, true, "10.0.0.1:1234", "192.30.252.1, 203.0.113.5", true},
+		{"no forwarded for", `["10.0.0.0/8"]`, true, "10.0.0.1:1234", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, fmt.Sprintf(`{"allowed_cidrs":%s,"trust_forwarded_for":%v,"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`, tt.cidrs, tt.trust))
+			r := httptest.NewRequest("POST", "/", strings.NewReader(pullRequestPayload("opened", "app", 1, "branch-1", "DependsOn:none")))
+			r.RemoteAddr = tt.remoteAddr
+			r.Header.Set("X-GitHub-Event", "pull_request")
+			r.Header.Set("Content-Type", "application/json")
+			if tt.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			w := httptest.NewRecorder()
+			app.apiHandlerPost(w, r)
+			if (w.Code == http.StatusForbidden) != tt.wantForbidden {
+				t.Errorf("got status %d, want forbidden %v", w.Code, tt.wantForbidden)
+			}
+			if _, cached := app.cache.Branches["app"][1]; cached == tt.wantForbidden {
+				t.Errorf("got pull request cached %v", cached)
+			}
+		})
+	}
+}
+
+func TestAPIHandlerGetVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		gitCommit string
+		buildDate string
+		want      string
+	}{
+		{"without build info", "", "", `{"version":"` + VERSION + `"}`},
+		{"with build info", "abc1234", "2026-01-02T03:04:05Z", `{"version":"` + VERSION + `","git_commit":"abc1234","build_date":"2026-01-02T03:04:05Z"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gitCommit, buildDate := GitCommit, BuildDate
+			GitCommit, BuildDate = tt.gitCommit, tt.buildDate
+			defer func() {
+				GitCommit, BuildDate = gitCommit, buildDate
+			}()
+
+			app := newTestApp(t, `{"incoming_api_token_value":"secret"}`)
+			w := httptest.NewRecorder()
+			app.apiHandlerGetVersion(w, httptest.NewRequest("GET", "/version", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d", w.Code)
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeliveryAgePrecedence(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour).Format(time.RFC3339)
+	recent := time.Now().Format(time.RFC3339)
+	tests := []struct {
+		name           string
+		maxDeliveryAge int
+		maxActionAge   int
+		event          string
+		createdAt      string
+		updatedAt      string
+		wantStatus     int
+		wantCached     bool
+	}{
+		{"both fresh", 3600, 3600, "pull_request", recent, recent, http.StatusOK, true},
+		{"stale delivery wins over old action", 3600, 3600, "pull_request", old, old, http.StatusBadRequest, false},
+		{"old action of fresh delivery", 3600, 3600, "pull_request", old, recent, http.StatusOK, false},
+		{"only delivery age set", 3600, 0, "pull_request", old, recent, http.StatusOK, true},
+		{"only action age set", 0, 3600, "pull_request", old, old, http.StatusOK, false},
+		{"action age ignored for other events", 0, 3600, "pull_request_review", old, recent, http.StatusOK, false},
+		{"delivery age applies to other events", 3600, 0, "pull_request_review", recent, old, http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, fmt.Sprintf(`{"max_delivery_age":%d,"max_action_age":%d,"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`, tt.maxDeliveryAge, tt.maxActionAge))
+			var j map[string]interface{}
+			json.Unmarshal([]byte(pullRequestPayload("opened", "a", 1, "branch-1", "Some change")), &j)
+			j["pull_request"].(map[string]interface{})["created_at"] = tt.createdAt
+			j["pull_request"].(map[string]interface{})["updated_at"] = tt.updatedAt
+			b, _ := json.Marshal(j)
+
+			w := postTestWebhook(app, tt.event, string(b))
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if _, cached := app.cache.Branches["a"][1]; cached != tt.wantCached {
+				t.Errorf("got a#1 cached %v, want %v", cached, tt.wantCached)
+			}
+		})
+	}
+}
@@ -1,13 +1,1364 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PullRequestStateOpen   = "open"
+	PullRequestStateClosed = "closed"
+	PullRequestStateMerged = "merged"
 )
 
 type Cache struct {
-	Branches     map[string]map[int]string         `json:"branches"`
-	Dependencies map[string]map[int]map[string]int `json:"dependencies"`
-	Dependents   map[string]map[int]map[string]int `json:"dependents"`
-	Version      string
-	mu           sync.Mutex
+	Branches         map[string]map[int]string            `json:"branches"`
+	Dependencies     DependencyMap                        `json:"dependencies"`
+	Dependents       DependencyMap                        `json:"dependents"`
+	SoftDependencies DependencyMap                        `json:"soft_dependencies"`
+	Labels           map[string]map[int][]string          `json:"labels"`
+	RawDependsOn     map[string]map[int][]string          `json:"raw_depends_on"`
+	Annotations      map[string]map[int]map[string]string `json:"annotations"`
+	States           map[string]map[int]string            `json:"states"`
+	Warnings         []CacheWarning                       `json:"warnings,omitempty"`
+	Version          string
+	mu               sync.RWMutex
+	lastUpdated      map[string]map[int]time.Time
+	evicted          map[string]map[int]bool
+	undeclared       map[string]map[int]bool
+	blocked          map[string]map[int]bool
+	counters         cacheCounters
+}
+
+// init sets up empty maps of the cache.
+func (cache *Cache) init() {
+	cache.Branches = map[string]map[int]string{}
+	cache.Dependencies = DependencyMap{}
+	cache.Dependents = DependencyMap{}
+	cache.SoftDependencies = DependencyMap{}
+	cache.Labels = map[string]map[int][]string{}
+	cache.RawDependsOn = map[string]map[int][]string{}
+	cache.Annotations = map[string]map[int]map[string]string{}
+	cache.States = map[string]map[int]string{}
+	cache.Version = "1"
+}
+
+// replace swaps contents of the cache for the ones of other at once, so that
+// readers see either of them and never a mix. other must not be used
+// afterwards.
+func (cache *Cache) replace(other *Cache) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.Branches = other.Branches
+	cache.Dependencies = other.Dependencies
+	cache.Dependents = other.Dependents
+	cache.SoftDependencies = other.SoftDependencies
+	cache.Labels = other.Labels
+	cache.RawDependsOn = other.RawDependsOn
+	cache.Annotations = other.Annotations
+	cache.States = other.States
+	cache.Warnings = other.Warnings
+	cache.lastUpdated = other.lastUpdated
+	cache.evicted = other.evicted
+	cache.undeclared = other.undeclared
+	cache.blocked = other.blocked
+	cache.refreshCounters()
+}
+
+// Snapshot returns a deep copy of the cache taken under the read lock so that
+// readers never touch the live maps.
+func (cache *Cache) Snapshot() *Cache {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+
+	snapshot := &Cache{
+		Branches:         map[string]map[int]string{},
+		Dependencies:     cache.Dependencies.Copy(),
+		Dependents:       cache.Dependents.Copy(),
+		SoftDependencies: cache.SoftDependencies.Copy(),
+		Labels:           map[string]map[int][]string{},
+		RawDependsOn:     map[string]map[int][]string{},
+		Annotations:      map[string]map[int]map[string]string{},
+		States:           map[string]map[int]string{},
+		Version:          cache.Version,
+	}
+	for repo, prs := range cache.States {
+		snapshot.States[repo] = map[int]string{}
+		for num, state := range prs {
+			snapshot.States[repo][num] = state
+		}
+	}
+	for repo, prs := range cache.Annotations {
+		snapshot.Annotations[repo] = map[int]map[string]string{}
+		for num, annotations := range prs {
+			snapshot.Annotations[repo][num] = map[string]string{}
+			for dep, annotation := range annotations {
+				snapshot.Annotations[repo][num][dep] = annotation
+			}
+		}
+	}
+	for repo, prs := range cache.Labels {
+		snapshot.Labels[repo] = map[int][]string{}
+		for num, labels := range prs {
+			snapshot.Labels[repo][num] = append([]string{}, labels...)
+		}
+	}
+	for repo, prs := range cache.RawDependsOn {
+		snapshot.RawDependsOn[repo] = map[int][]string{}
+		for num, deps := range prs {
+			snapshot.RawDependsOn[repo][num] = append([]string{}, deps...)
+		}
+	}
+	for repo, prs := range cache.evicted {
+		for num, evicted := range prs {
+			if evicted {
+				if snapshot.evicted == nil {
+					snapshot.evicted = map[string]map[int]bool{}
+				}
+				_, hasKey := snapshot.evicted[repo]
+				if !hasKey {
+					snapshot.evicted[repo] = map[int]bool{}
+				}
+				snapshot.evicted[repo][num] = true
+			}
+		}
+	}
+	for repo, prs := range cache.undeclared {
+		for num := range prs {
+			snapshot.SetDeclared(repo, num, false)
+		}
+	}
+	for repo, prs := range cache.blocked {
+		for num := range prs {
+			snapshot.setBlocked(repo, num, true)
+		}
+	}
+	if len(cache.Warnings) > 0 {
+		snapshot.Warnings = append([]CacheWarning{}, cache.Warnings...)
+	}
+	for repo, prs := range cache.Branches {
+		snapshot.Branches[repo] = map[int]string{}
+		for num, branch := range prs {
+			snapshot.Branches[repo][num] = branch
+		}
+	}
+	snapshot.counters = cacheCounters{
+		repositories: atomic.LoadInt64(&cache.counters.repositories),
+		pullRequests: atomic.LoadInt64(&cache.counters.pullRequests),
+		dependencies: atomic.LoadInt64(&cache.counters.dependencies),
+	}
+	return snapshot
+}
+
+// cacheCounters hold sizes of the cache. They are updated by setBranch,
+// deleteBranch and the dependency helpers on every write so that readers get
+// them without taking the lock or scanning the maps. Writes that swap whole
+// maps, eg. Load and replace, recount them with refreshCounters.
+type cacheCounters struct {
+	repositories int64
+	pullRequests int64
+	dependencies int64
+}
+
+// setBranch stores the branch of an open pull request. Cache mutex must be
+// held by the caller.
+func (cache *Cache) setBranch(repo string, num int, branch string) {
+	prs, hasKey := cache.Branches[repo]
+	if !hasKey {
+		prs = map[int]string{}
+		cache.Branches[repo] = prs
+	}
+	if _, hasKey := prs[num]; !hasKey {
+		if len(prs) == 0 {
+			atomic.AddInt64(&cache.counters.repositories, 1)
+		}
+		atomic.AddInt64(&cache.counters.pullRequests, 1)
+	}
+	prs[num] = branch
+}
+
+// deleteBranch removes the branch of a pull request that is not open anymore.
+// Cache mutex must be held by the caller.
+func (cache *Cache) deleteBranch(repo string, num int) {
+	if _, hasKey := cache.Branches[repo][num]; !hasKey {
+		return
+	}
+	delete(cache.Branches[repo], num)
+	atomic.AddInt64(&cache.counters.pullRequests, -1)
+	if len(cache.Branches[repo]) == 0 {
+		atomic.AddInt64(&cache.counters.repositories, -1)
+	}
+}
+
+// addDependency connects repo#num with the pull request it depends on in
+// Dependencies. Cache mutex must be held by the caller.
+func (cache *Cache) addDependency(repo string, num int, depRepo string, depNum int) {
+	if cache.Dependencies.Add(repo, num, depRepo, depNum) {
+		atomic.AddInt64(&cache.counters.dependencies, 1)
+	}
+}
+
+// removeDependency disconnects repo#num from the pull request it depends on
+// in Dependencies. Cache mutex must be held by the caller.
+func (cache *Cache) removeDependency(repo string, num int, depRepo string, depNum int) {
+	if cache.Dependencies.Remove(repo, num, depRepo, depNum) {
+		atomic.AddInt64(&cache.counters.dependencies, -1)
+	}
+}
+
+// deleteDependencies removes all dependencies of repo#num from Dependencies.
+// Cache mutex must be held by the caller.
+func (cache *Cache) deleteDependencies(repo string, num int) {
+	if n := cache.Dependencies.Delete(repo, num); n > 0 {
+		atomic.AddInt64(&cache.counters.dependencies, -int64(n))
+	}
+}
+
+// refreshCounters recounts cache entries. Cache mutex must be held by the
+// caller.
+func (cache *Cache) refreshCounters() {
+	repos := 0
+	prs := 0
+	for _, nums := range cache.Branches {
+		if len(nums) > 0 {
+			repos++
+		}
+		prs += len(nums)
+	}
+	deps := 0
+	for repo := range cache.Dependencies {
+		deps += cache.Dependencies.Count(repo)
+	}
+	atomic.StoreInt64(&cache.counters.repositories, int64(repos))
+	atomic.StoreInt64(&cache.counters.pullRequests, int64(prs))
+	atomic.StoreInt64(&cache.counters.dependencies, int64(deps))
+}
+
+// Stats returns counts of repositories and pull requests that are open and
+// of dependencies between them.
+func (cache *Cache) Stats() CacheStats {
+	return CacheStats{
+		Repositories: atomic.LoadInt64(&cache.counters.repositories),
+		PullRequests: atomic.LoadInt64(&cache.counters.pullRequests),
+		Dependencies: atomic.LoadInt64(&cache.counters.dependencies),
+	}
+}
+
+// AddWarning records that data for a repository could not be fetched and the
+// cache is incomplete.
+func (cache *Cache) AddWarning(repo string, message string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.Warnings = append(cache.Warnings, CacheWarning{Repository: repo, Message: message})
+}
+
+// touch marks the pull request as recently updated. Cache mutex must be held
+// by the caller.
+func (cache *Cache) touch(repo string, num int) {
+	if cache.lastUpdated == nil {
+		cache.lastUpdated = map[string]map[int]time.Time{}
+	}
+	_, hasKey := cache.lastUpdated[repo]
+	if !hasKey {
+		cache.lastUpdated[repo] = map[int]time.Time{}
+	}
+	cache.lastUpdated[repo][num] = time.Now()
+
+	_, hasKey = cache.evicted[repo][num]
+	if hasKey {
+		delete(cache.evicted[repo], num)
+	}
+}
+
+// forget removes the pull request from the LRU tracking. Cache mutex must be
+// held by the caller.
+func (cache *Cache) forget(repo string, num int) {
+	_, hasKey := cache.lastUpdated[repo][num]
+	if hasKey {
+		delete(cache.lastUpdated[repo], num)
+	}
+	_, hasKey = cache.evicted[repo][num]
+	if hasKey {
+		delete(cache.evicted[repo], num)
+	}
+}
+
+// getLeastRecentlyUpdated returns the pull request updated longest ago.
+// Cache mutex must be held by the caller.
+func (cache *Cache) getLeastRecentlyUpdated() (PullRequestRef, bool) {
+	found := false
+	oldest := PullRequestRef{}
+	oldestTime := time.Time{}
+	for repo, prs := range cache.lastUpdated {
+		for num, t := range prs {
+			if !found || t.Before(oldestTime) {
+				found = true
+				oldest = PullRequestRef{Repository: repo, Number: num}
+				oldestTime = t
+			}
+		}
+	}
+	return oldest, found
+}
+
+// evict removes the pull request from the cache while remembering that it was
+// open so it can be reloaded on demand. Cache mutex must be held by the caller.
+func (cache *Cache) evict(repo string, num int) {
+	cache.deleteBranch(repo, num)
+	for _, dep := range cache.Dependencies.Get(repo, num) {
+		cache.Dependents.Remove(dep.Repository, dep.Number, repo, num)
+	}
+	cache.deleteDependencies(repo, num)
+	cache.SoftDependencies.Delete(repo, num)
+	cache.SetLabels(repo, num, nil)
+	cache.SetRawDependsOn(repo, num, nil)
+	cache.SetDeclared(repo, num, true)
+	cache.DeleteAnnotations(repo, num)
+	cache.setBlocked(repo, num, false)
+	// Dependents are kept as PRs depending on the evicted one still reference it
+	cache.forget(repo, num)
+
+	if cache.evicted == nil {
+		cache.evicted = map[string]map[int]bool{}
+	}
+	_, hasKey := cache.evicted[repo]
+	if !hasKey {
+		cache.evicted[repo] = map[int]bool{}
+	}
+	cache.evicted[repo][num] = true
+}
+
+// SetLabels replaces labels of the pull request, removing the entry when there
+// are none. Cache mutex must be held by the caller.
+func (cache *Cache) SetLabels(repo string, num int, labels []string) {
+	if len(labels) == 0 {
+		_, hasKey := cache.Labels[repo][num]
+		if hasKey {
+			delete(cache.Labels[repo], num)
+		}
+		return
+	}
+	if cache.Labels == nil {
+		cache.Labels = map[string]map[int][]string{}
+	}
+	_, hasKey := cache.Labels[repo]
+	if !hasKey {
+		cache.Labels[repo] = map[int][]string{}
+	}
+	sorted := append([]string{}, labels...)
+	sort.Strings(sorted)
+	cache.Labels[repo][num] = sorted
+}
+
+// SetState records whether the pull request is open, closed or merged. States
+// of closed pull requests are kept so that it can be told whether a dependency
+// got merged or abandoned. Cache mutex must be held by the caller.
+func (cache *Cache) SetState(repo string, num int, state string) {
+	if cache.States == nil {
+		cache.States = map[string]map[int]string{}
+	}
+	_, hasKey := cache.States[repo]
+	if !hasKey {
+		cache.States[repo] = map[int]string{}
+	}
+	cache.States[repo][num] = state
+}
+
+// SetRawDependsOn stores DependsOn lines of the pull request as extracted by
+// the parser, removing the entry when there are none. Cache mutex must be held
+// by the caller.
+func (cache *Cache) SetRawDependsOn(repo string, num int, deps []string) {
+	if len(deps) == 0 {
+		_, hasKey := cache.RawDependsOn[repo][num]
+		if hasKey {
+			delete(cache.RawDependsOn[repo], num)
+		}
+		return
+	}
+	if cache.RawDependsOn == nil {
+		cache.RawDependsOn = map[string]map[int][]string{}
+	}
+	_, hasKey := cache.RawDependsOn[repo]
+	if !hasKey {
+		cache.RawDependsOn[repo] = map[int][]string{}
+	}
+	cache.RawDependsOn[repo][num] = append([]string{}, deps...)
+}
+
+// SetDeclared records whether the pull request declares its dependencies.
+// Cache mutex must be held by the caller.
+func (cache *Cache) SetDeclared(repo string, num int, declared bool) {
+	if declared {
+		_, hasKey := cache.undeclared[repo][num]
+		if hasKey {
+			delete(cache.undeclared[repo], num)
+		}
+		return
+	}
+	if cache.undeclared == nil {
+		cache.undeclared = map[string]map[int]bool{}
+	}
+	_, hasKey := cache.undeclared[repo]
+	if !hasKey {
+		cache.undeclared[repo] = map[int]bool{}
+	}
+	cache.undeclared[repo][num] = true
+}
+
+// GetUndeclared returns open pull requests in repositories accepted by match
+// which declare neither dependencies nor DependsOn:none.
+func (cache *Cache) GetUndeclared(match func(string) bool) []PullRequestRef {
+	prs := []PullRequestRef{}
+	for repo, nums := range cache.undeclared {
+		if !match(repo) {
+			continue
+		}
+		for num := range nums {
+			_, hasKey := cache.Branches[repo][num]
+			if hasKey {
+				prs = append(prs, PullRequestRef{Repository: repo, Number: num})
+			}
+		}
+	}
+	sortPullRequestRefs(prs)
+	return prs
+}
+
+// SetAnnotation stores annotation of the repo#num dependency on dep, eg. a
+// ticket reference. Cache mutex must be held by the caller.
+func (cache *Cache) SetAnnotation(repo string, num int, dep PullRequestRef) {
+	if dep.Annotation == "" {
+		return
+	}
+	if cache.Annotations == nil {
+		cache.Annotations = map[string]map[int]map[string]string{}
+	}
+	_, hasKey := cache.Annotations[repo]
+	if !hasKey {
+		cache.Annotations[repo] = map[int]map[string]string{}
+	}
+	_, hasKey = cache.Annotations[repo][num]
+	if !hasKey {
+		cache.Annotations[repo][num] = map[string]string{}
+	}
+	cache.Annotations[repo][num][fmt.Sprintf("%s#%d", dep.Key(), dep.Number)] = dep.Annotation
+}
+
+// GetAnnotation returns annotation of the repo#num dependency on dep.
+func (cache *Cache) GetAnnotation(repo string, num int, dep PullRequestRef) string {
+	return cache.Annotations[repo][num][fmt.Sprintf("%s#%d", dep.Key(), dep.Number)]
+}
+
+// DeleteAnnotations removes annotations of all dependencies of repo#num.
+// Cache mutex must be held by the caller.
+func (cache *Cache) DeleteAnnotations(repo string, num int) {
+	_, hasKey := cache.Annotations[repo][num]
+	if hasKey {
+		delete(cache.Annotations[repo], num)
+	}
+}
+
+// GetRawDependsOn returns DependsOn lines of the pull request as extracted by
+// the parser.
+func (cache *Cache) GetRawDependsOn(repo string, num int) []string {
+	return append([]string{}, cache.RawDependsOn[repo][num]...)
+}
+
+// GetLabels returns labels of the pull request.
+func (cache *Cache) GetLabels(repo string, num int) []string {
+	return append([]string{}, cache.Labels[repo][num]...)
+}
+
+// IsEvicted returns true when the pull request was evicted from the cache due
+// to its size limit and was not reloaded since.
+func (cache *Cache) IsEvicted(repo string, num int) bool {
+	return cache.evicted[repo][num]
+}
+
+var repositoryNameRegexp = regexp.MustCompile("^[A-Za-z0-9\\-_.]+$")
+
+// Verify checks internal invariants of the cache and returns found anomalies.
+func (cache *Cache) Verify() []string {
+	anomalies := []string{}
+	for repo, prs := range cache.Branches {
+		if !repositoryNameRegexp.MatchString(repo) {
+			anomalies = append(anomalies, fmt.Sprintf("Branches: malformed repository name %q", repo))
+		}
+		for num, branch := range prs {
+			if num <= 0 {
+				anomalies = append(anomalies, fmt.Sprintf("Branches: invalid pull request number %s#%d", repo, num))
+			}
+			if branch == "" {
+				anomalies = append(anomalies, fmt.Sprintf("Branches: empty branch for %s#%d", repo, num))
+			}
+		}
+	}
+
+	anomalies = append(anomalies, verifyDependencyMap("Dependencies", cache.Dependencies)...)
+	anomalies = append(anomalies, verifyDependencyMap("Dependents", cache.Dependents)...)
+	anomalies = append(anomalies, verifyDependencyMap("SoftDependencies", cache.SoftDependencies)...)
+
+	// every dependency on an open pull request must be reflected in dependents
+	// and the other way round; closed ones are only kept in dependencies
+	for _, edge := range cache.Dependencies.Edges() {
+		if cache.GetPullRequestState(edge.DependsOnRepository, edge.DependsOnNumber) == "closed" {
+			continue
+		}
+		if !cache.Dependents.Has(edge.DependsOnRepository, edge.DependsOnNumber, edge.Repository, edge.Number) {
+			anomalies = append(anomalies, fmt.Sprintf("Dependencies: %s#%d -> %s#%d is missing in Dependents", edge.Repository, edge.Number, edge.DependsOnRepository, edge.DependsOnNumber))
+		}
+	}
+	for _, edge := range cache.Dependents.Edges() {
+		if !cache.Dependencies.HasAnyPath(edge.DependsOnRepository, edge.DependsOnNumber, edge.Repository, edge.Number) {
+			anomalies = append(anomalies, fmt.Sprintf("Dependents: %s#%d <- %s#%d is missing in Dependencies", edge.Repository, edge.Number, edge.DependsOnRepository, edge.DependsOnNumber))
+		}
+	}
+	return anomalies
+}
+
+func verifyDependencyMap(name string, m DependencyMap) []string {
+	anomalies := []string{}
+	for repo, prs := range m {
+		if !repositoryNameRegexp.MatchString(repo) {
+			anomalies = append(anomalies, fmt.Sprintf("%s: malformed repository name %q", name, repo))
+		}
+		for num, deps := range prs {
+			if num <= 0 {
+				anomalies = append(anomalies, fmt.Sprintf("%s: invalid pull request number %s#%d", name, repo, num))
+			}
+			for depRepo, nums := range deps {
+				repoName, _ := splitDependencyKey(depRepo)
+				if !repositoryNameRegexp.MatchString(repoName) {
+					anomalies = append(anomalies, fmt.Sprintf("%s: malformed repository name %q in %s#%d", name, depRepo, repo, num))
+				}
+				seen := map[int]bool{}
+				for _, n := range nums {
+					if n <= 0 {
+						anomalies = append(anomalies, fmt.Sprintf("%s: invalid pull request number %s#%d in %s#%d", name, depRepo, n, repo, num))
+					}
+					if seen[n] {
+						anomalies = append(anomalies, fmt.Sprintf("%s: duplicate %s#%d in %s#%d", name, depRepo, n, repo, num))
+					}
+					seen[n] = true
+				}
+			}
+		}
+	}
+	return anomalies
+}
+
+// GetBlockers returns hard dependencies of a pull request that are still open.
+// Soft dependencies are never taken into account.
+func (cache *Cache) GetBlockers(repo string, num int) []PullRequestRef {
+	blockers := []PullRequestRef{}
+	for _, dep := range cache.Dependencies.Get(repo, num) {
+		// evicted PRs are unknown so be conservative and treat them as open
+		_, hasKey := cache.Branches[dep.Repository][dep.Number]
+		if hasKey || cache.IsEvicted(dep.Repository, dep.Number) {
+			dep.Annotation = cache.GetAnnotation(repo, num, dep)
+			blockers = append(blockers, dep)
+		}
+	}
+	return blockers
+}
+
+// setBlocked stores the blocked flag of the pull request, removing the entry
+// when it is not blocked. Cache mutex must be held by the caller.
+func (cache *Cache) setBlocked(repo string, num int, blocked bool) {
+	if !blocked {
+		_, hasKey := cache.blocked[repo][num]
+		if hasKey {
+			delete(cache.blocked[repo], num)
+		}
+		return
+	}
+	if cache.blocked == nil {
+		cache.blocked = map[string]map[int]bool{}
+	}
+	_, hasKey := cache.blocked[repo]
+	if !hasKey {
+		cache.blocked[repo] = map[int]bool{}
+	}
+	cache.blocked[repo][num] = true
+}
+
+// refreshBlocked recomputes the blocked flag of the given pull requests. Only
+// open ones can be blocked. Cache mutex must be held by the caller.
+func (cache *Cache) refreshBlocked(prs []PullRequestRef) {
+	for _, pr := range prs {
+		_, hasKey := cache.Branches[pr.Repository][pr.Number]
+		cache.setBlocked(pr.Repository, pr.Number, hasKey && len(cache.GetBlockers(pr.Repository, pr.Number)) > 0)
+	}
+}
+
+// refreshAllBlocked recomputes blocked flags of all pull requests. It is used
+// after changes touching many edges at once. Cache mutex must be held by the
+// caller.
+func (cache *Cache) refreshAllBlocked() {
+	cache.blocked = nil
+	for repo, prs := range cache.Branches {
+		for num := range prs {
+			if len(cache.GetBlockers(repo, num)) > 0 {
+				cache.setBlocked(repo, num, true)
+			}
+		}
+	}
+}
+
+// IsBlocked returns the precomputed blocked flag of the pull request.
+func (cache *Cache) IsBlocked(repo string, num int) bool {
+	return cache.blocked[repo][num]
+}
+
+// GetBlocked returns blocked pull requests in the repository, or in all
+// repositories when repo is empty, sorted by repository and number.
+func (cache *Cache) GetBlocked(repo string) []PullRequestRef {
+	blocked := []PullRequestRef{}
+	for r, prs := range cache.blocked {
+		if repo != "" && r != repo {
+			continue
+		}
+		for num := range prs {
+			blocked = append(blocked, PullRequestRef{Repository: r, Number: num})
+		}
+	}
+	sortPullRequestRefs(blocked)
+	return blocked
+}
+
+// GetMergeable returns open pull requests which are not blocked, ie. all their
+// hard dependencies are closed, and which the policy does not hold back because
+// they lack the required declaration of dependencies. isDeclarationRequired
+// tells whether repository requires the declaration.
+func (cache *Cache) GetMergeable(isDeclarationRequired func(string) bool) []BranchEntry {
+	mergeable := []BranchEntry{}
+	for repo, prs := range cache.Branches {
+		for num, branch := range prs {
+			if cache.IsBlocked(repo, num) {
+				continue
+			}
+			if cache.undeclared[repo][num] && isDeclarationRequired(repo) {
+				continue
+			}
+			mergeable = append(mergeable, BranchEntry{Repository: repo, Number: num, Branch: branch})
+		}
+	}
+	sortBranchEntries(mergeable)
+	return mergeable
+}
+
+// GetStatus returns blocking status of the pull request.
+func (cache *Cache) GetStatus(repo string, num int) PullRequestStatus {
+	status := PullRequestStatus{
+		Repository:       repo,
+		Number:           num,
+		Blockers:         cache.GetBlockers(repo, num),
+		SoftDependencies: cache.SoftDependencies.Get(repo, num),
+		Labels:           cache.GetLabels(repo, num),
+	}
+	status.Blocked = cache.IsBlocked(repo, num)
+	return status
+}
+
+// GetStatuses returns statuses of open pull requests in the repository, or
+// in all repositories when repo is empty, sorted by repository and number.
+func (cache *Cache) GetStatuses(repo string) []PullRequestStatus {
+	statuses := []PullRequestStatus{}
+	for r, prs := range cache.Branches {
+		if repo != "" && r != repo {
+			continue
+		}
+		for num := range prs {
+			statuses = append(statuses, cache.GetStatus(r, num))
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Repository != statuses[j].Repository {
+			return statuses[i].Repository < statuses[j].Repository
+		}
+		return statuses[i].Number < statuses[j].Number
+	})
+	return statuses
+}
+
+// sortStatusesByBlocking moves blocked pull requests first, the ones with
+// most open blockers at the top. Order of equally blocked ones is kept.
+func sortStatusesByBlocking(statuses []PullRequestStatus) {
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return len(statuses[i].Blockers) > len(statuses[j].Blockers)
+	})
+}
+
+// DetectCycles returns cycles in Dependencies as ordered lists of "repo#num"
+// nodes, each starting with its lowest node. A pull request depending on
+// itself is returned as a single node cycle.
+func (cache *Cache) DetectCycles() [][]string {
+	graph := cache.dependencyGraph()
+	nodes := []string{}
+	for node := range graph {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	cycles := [][]string{}
+	seen := map[string]bool{}
+	// 1 is being visited, 2 is done
+	state := map[string]int{}
+	for _, node := range nodes {
+		if state[node] != 0 {
+			continue
+		}
+		// depth-first search with an explicit stack as graphs can be deep
+		stack := []string{node}
+		next := []int{0}
+		state[node] = 1
+		for len(stack) > 0 {
+			top := len(stack) - 1
+			current := stack[top]
+			if next[top] == len(graph[current]) {
+				stack = stack[:top]
+				next = next[:top]
+				state[current] = 2
+				continue
+			}
+			dep := graph[current][next[top]]
+			next[top]++
+			if state[dep] == 1 {
+				// back edge, the cycle is the stack from dep onwards
+				for i := top; i >= 0; i-- {
+					if stack[i] == dep {
+						cycle := normalizeCycle(stack[i:])
+						key := strings.Join(cycle, " ")
+						if !seen[key] {
+							seen[key] = true
+							cycles = append(cycles, cycle)
+						}
+						break
+					}
+				}
+				continue
+			}
+			if state[dep] == 0 {
+				state[dep] = 1
+				stack = append(stack, dep)
+				next = append(next, 0)
+			}
+		}
+	}
+	return cycles
+}
+
+// maxClosureSize bounds how many pull requests GetClosure visits so that
+// a huge graph cannot make a single request arbitrarily expensive.
+const maxClosureSize = 100000
+
+// GetClosure returns all pull requests the given one transitively depends on,
+// each once and in topological order, ie. a pull request comes after the ones
+// it depends on. When a cycle is found its back edge is not followed and
+// Cycle is set, so the order is only partial. When there are more than
+// maxClosureSize pull requests the walk stops and Truncated is set.
+func (cache *Cache) GetClosure(repo string, num int) DependencyClosure {
+	closure := DependencyClosure{
+		Repository:   repo,
+		Number:       num,
+		Dependencies: []PullRequestRef{},
+	}
+
+	type frame struct {
+		node PullRequestRef
+		deps []PullRequestRef
+		next int
+	}
+	newFrame := func(node PullRequestRef) *frame {
+		deps := []PullRequestRef{}
+		for _, dep := range cache.Dependencies.Get(node.Repository, node.Number) {
+			deps = append(deps, PullRequestRef{Repository: dep.Repository, Number: dep.Number})
+		}
+		sortPullRequestRefs(deps)
+		return &frame{node: node, deps: deps}
+	}
+
+	start := PullRequestRef{Repository: repo, Number: num}
+	// 1 is being visited, 2 is done
+	state := map[PullRequestRef]int{start: 1}
+	// depth-first search with an explicit stack as graphs can be deep
+	stack := []*frame{newFrame(start)}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		if top.next == len(top.deps) {
+			stack = stack[:len(stack)-1]
+			state[top.node] = 2
+			if top.node != start {
+				closure.Dependencies = append(closure.Dependencies, top.node)
+			}
+			continue
+		}
+		dep := top.deps[top.next]
+		top.next++
+		if state[dep] == 1 {
+			closure.Cycle = true
+			continue
+		}
+		if state[dep] == 0 {
+			if len(state) > maxClosureSize {
+				closure.Truncated = true
+				continue
+			}
+			state[dep] = 1
+			stack = append(stack, newFrame(dep))
+		}
+	}
+	return closure
+}
+
+// dependencyGraph returns Dependencies as "repo#num" adjacency lists, sorted
+// and ignoring path qualifiers.
+func (cache *Cache) dependencyGraph() map[string][]string {
+	graph := map[string][]string{}
+	for _, edge := range cache.Dependencies.Edges() {
+		from := fmt.Sprintf("%s#%d", edge.Repository, edge.Number)
+		to := fmt.Sprintf("%s#%d", edge.DependsOnRepository, edge.DependsOnNumber)
+		n := len(graph[from])
+		if n > 0 && graph[from][n-1] == to {
+			continue
+		}
+		graph[from] = append(graph[from], to)
+	}
+	return graph
+}
+
+// normalizeCycle rotates the cycle so that it starts with its lowest node.
+func normalizeCycle(cycle []string) []string {
+	lowest := 0
+	for i := range cycle {
+		if cycle[i] < cycle[lowest] {
+			lowest = i
+		}
+	}
+	return append(append([]string{}, cycle[lowest:]...), cycle[:lowest]...)
+}
+
+// findDependencyPath returns pull requests on the way from one pull request to
+// another following Dependencies, or nil when there is no such way.
+func (cache *Cache) findDependencyPath(from PullRequestRef, to PullRequestRef) []PullRequestRef {
+	start := PullRequestRef{Repository: from.Repository, Number: from.Number}
+	target := PullRequestRef{Repository: to.Repository, Number: to.Number}
+	previous := map[PullRequestRef]PullRequestRef{}
+	visited := map[PullRequestRef]bool{start: true}
+	queue := []PullRequestRef{start}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if current == target {
+			path := []PullRequestRef{current}
+			for current != start {
+				current = previous[current]
+				path = append([]PullRequestRef{current}, path...)
+			}
+			return path
+		}
+		for _, dep := range cache.Dependencies.Get(current.Repository, current.Number) {
+			next := PullRequestRef{Repository: dep.Repository, Number: dep.Number}
+			if !visited[next] {
+				visited[next] = true
+				previous[next] = current
+				queue = append(queue, next)
+			}
+		}
+	}
+	return nil
+}
+
+// GetPullRequestState returns "open" for a pull request that is cached,
+// "unknown" for an evicted one and "closed" otherwise.
+func (cache *Cache) GetPullRequestState(repo string, num int) string {
+	_, hasKey := cache.Branches[repo][num]
+	if hasKey {
+		return "open"
+	}
+	if cache.IsEvicted(repo, num) {
+		return "unknown"
+	}
+	return "closed"
+}
+
+// GetPullRequestsByBranch returns pull requests which use the given branch,
+// sorted by repository and number.
+func (cache *Cache) GetPullRequestsByBranch(branch string) []PullRequestRef {
+	prs := []PullRequestRef{}
+	for repo, branches := range cache.Branches {
+		for num, b := range branches {
+			if b == branch {
+				prs = append(prs, PullRequestRef{Repository: repo, Number: num})
+			}
+		}
+	}
+	sortPullRequestRefs(prs)
+	return prs
+}
+
+// Filter returns a copy of the cache with pull requests of the repository
+// only, or just one pull request when num is greater than 0. It is meant to be
+// called on a snapshot.
+func (cache *Cache) Filter(repo string, num int) *Cache {
+	filtered := &Cache{
+		Branches:         map[string]map[int]string{},
+		Dependencies:     DependencyMap{},
+		Dependents:       DependencyMap{},
+		SoftDependencies: DependencyMap{},
+		Labels:           map[string]map[int][]string{},
+		RawDependsOn:     map[string]map[int][]string{},
+		Annotations:      map[string]map[int]map[string]string{},
+		States:           map[string]map[int]string{},
+		Version:          cache.Version,
+	}
+	match := func(n int) bool {
+		return num <= 0 || n == num
+	}
+	for n, branch := range cache.Branches[repo] {
+		if match(n) {
+			if filtered.Branches[repo] == nil {
+				filtered.Branches[repo] = map[int]string{}
+			}
+			filtered.Branches[repo][n] = branch
+		}
+	}
+	for _, m := range []struct{ from, to DependencyMap }{
+		{cache.Dependencies, filtered.Dependencies},
+		{cache.Dependents, filtered.Dependents},
+		{cache.SoftDependencies, filtered.SoftDependencies},
+	} {
+		for n, deps := range m.from[repo] {
+			if match(n) {
+				if m.to[repo] == nil {
+					m.to[repo] = map[int]map[string][]int{}
+				}
+				m.to[repo][n] = deps
+			}
+		}
+	}
+	for n, labels := range cache.Labels[repo] {
+		if match(n) {
+			if filtered.Labels[repo] == nil {
+				filtered.Labels[repo] = map[int][]string{}
+			}
+			filtered.Labels[repo][n] = labels
+		}
+	}
+	for n, deps := range cache.RawDependsOn[repo] {
+		if match(n) {
+			if filtered.RawDependsOn[repo] == nil {
+				filtered.RawDependsOn[repo] = map[int][]string{}
+			}
+			filtered.RawDependsOn[repo][n] = deps
+		}
+	}
+	for n, annotations := range cache.Annotations[repo] {
+		if match(n) {
+			if filtered.Annotations[repo] == nil {
+				filtered.Annotations[repo] = map[int]map[string]string{}
+			}
+			filtered.Annotations[repo][n] = annotations
+		}
+	}
+	for n, state := range cache.States[repo] {
+		if match(n) {
+			if filtered.States[repo] == nil {
+				filtered.States[repo] = map[int]string{}
+			}
+			filtered.States[repo][n] = state
+		}
+	}
+	for _, warning := range cache.Warnings {
+		if warning.Repository == repo {
+			filtered.Warnings = append(filtered.Warnings, warning)
+		}
+	}
+	return filtered
+}
+
+// GetDependents returns pull requests that depend on the given one, along
+// with their branches. It walks Dependencies rather than trusting Dependents
+// so that the result reflects what pull requests actually declare.
+func (cache *Cache) GetDependents(repo string, num int) []BranchEntry {
+	entries := []BranchEntry{}
+	for depRepo, prs := range cache.Dependencies {
+		for depNum := range prs {
+			if cache.Dependencies.HasAnyPath(depRepo, depNum, repo, num) {
+				entries = append(entries, BranchEntry{Repository: depRepo, Number: depNum, Branch: cache.Branches[depRepo][depNum]})
+			}
+		}
+	}
+	sortBranchEntries(entries)
+	return entries
+}
+
+// GetRepositoryName returns the name a repository is cached under when it only
+// differs in case, as GitHub repository names are case-insensitive. Otherwise
+// the name is returned as is. Cache mutex must be held by the caller.
+func (cache *Cache) GetRepositoryName(name string) string {
+	_, hasKey := cache.Branches[name]
+	if hasKey {
+		return name
+	}
+	for repo := range cache.Branches {
+		if strings.EqualFold(repo, name) {
+			return repo
+		}
+	}
+	return name
+}
+
+// GetBranches returns branches of all cached pull requests sorted by
+// repository and number.
+func (cache *Cache) GetBranches() []BranchEntry {
+	entries := []BranchEntry{}
+	for repo, prs := range cache.Branches {
+		for num, branch := range prs {
+			entries = append(entries, BranchEntry{Repository: repo, Number: num, Branch: branch})
+		}
+	}
+	sortBranchEntries(entries)
+	return entries
+}
+
+func sortBranchEntries(entries []BranchEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Repository != entries[j].Repository {
+			return entries[i].Repository < entries[j].Repository
+		}
+		return entries[i].Number < entries[j].Number
+	})
+}
+
+func sortPullRequestRefs(prs []PullRequestRef) {
+	sort.Slice(prs, func(i, j int) bool {
+		if prs[i].Repository != prs[j].Repository {
+			return prs[i].Repository < prs[j].Repository
+		}
+		if prs[i].Number != prs[j].Number {
+			return prs[i].Number < prs[j].Number
+		}
+		return prs[i].Path < prs[j].Path
+	})
+}
+
+// splitDependencyKey splits a dependency key, which is a repository name
+// optionally followed by a path qualifier, eg. "monorepo/services/api".
+func splitDependencyKey(key string) (string, string) {
+	vals := strings.SplitN(key, "/", 2)
+	if len(vals) == 1 {
+		return vals[0], ""
+	}
+	return vals[0], vals[1]
+}
+
+func dependencyKey(repo string, path string) string {
+	if path == "" {
+		return repo
+	}
+	return repo + "/" + path
+}
+
+// Diff returns branches and dependency edges added and removed in the cache
+// compared to the previous snapshot.
+func (cache *Cache) Diff(previous *Cache) *CacheDiff {
+	diff := &CacheDiff{
+		AddedBranches:       diffBranches(cache.Branches, previous.Branches),
+		RemovedBranches:     diffBranches(previous.Branches, cache.Branches),
+		AddedDependencies:   diffDependencies(cache.Dependencies, previous.Dependencies),
+		RemovedDependencies: diffDependencies(previous.Dependencies, cache.Dependencies),
+	}
+	return diff
+}
+
+// diffBranches returns branches from a that are missing or different in b.
+func diffBranches(a map[string]map[int]string, b map[string]map[int]string) []BranchEntry {
+	entries := []BranchEntry{}
+	for repo, prs := range a {
+		for num, branch := range prs {
+			other, hasKey := b[repo][num]
+			if !hasKey || other != branch {
+				entries = append(entries, BranchEntry{Repository: repo, Number: num, Branch: branch})
+			}
+		}
+	}
+	sortBranchEntries(entries)
+	return entries
+}
+
+// diffDependencies returns dependency edges from a that are missing in b.
+func diffDependencies(a DependencyMap, b DependencyMap) []DependencyEdge {
+	edges := []DependencyEdge{}
+	for _, edge := range a.Edges() {
+		if !b.Has(edge.Repository, edge.Number, edge.DependsOnKey(), edge.DependsOnNumber) {
+			edges = append(edges, edge)
+		}
+	}
+	return edges
+}
+
+// DependencyMap maps a pull request (repository and number) to pull requests
+// it is connected with, grouped by repository. One pull request can be
+// connected with many pull requests from the same repository. Repository of a
+// connected pull request may carry a path qualifier, eg. "monorepo/api", and
+// the same pull request with different paths is a different connection.
+type DependencyMap map[string]map[int]map[string][]int
+
+// Init makes sure that an entry for the pull request exists, even when it
+// has no connections.
+func (m DependencyMap) Init(repo string, num int) {
+	_, hasKey := m[repo]
+	if !hasKey {
+		m[repo] = map[int]map[string][]int{}
+	}
+	_, hasKey = m[repo][num]
+	if !hasKey {
+		m[repo][num] = map[string][]int{}
+	}
+}
+
+// Add connects repo#num with depRepo#depNum and returns false when they were
+// connected already.
+func (m DependencyMap) Add(repo string, num int, depRepo string, depNum int) bool {
+	if m.Has(repo, num, depRepo, depNum) {
+		return false
+	}
+	m.Init(repo, num)
+	nums := append(m[repo][num][depRepo], depNum)
+	sort.Ints(nums)
+	m[repo][num][depRepo] = nums
+	return true
+}
+
+// Remove disconnects repo#num from depRepo#depNum and returns false when they
+// were not connected.
+func (m DependencyMap) Remove(repo string, num int, depRepo string, depNum int) bool {
+	nums, hasKey := m[repo][num][depRepo]
+	if !hasKey {
+		return false
+	}
+	left := []int{}
+	for _, n := range nums {
+		if n != depNum {
+			left = append(left, n)
+		}
+	}
+	if len(left) == len(nums) {
+		return false
+	}
+	if len(left) == 0 {
+		delete(m[repo][num], depRepo)
+		return true
+	}
+	m[repo][num][depRepo] = left
+	return true
+}
+
+// Delete removes the pull request entry along with all its connections and
+// returns how many connections there were.
+func (m DependencyMap) Delete(repo string, num int) int {
+	deps, hasKey := m[repo][num]
+	if !hasKey {
+		return 0
+	}
+	n := 0
+	for _, nums := range deps {
+		n += len(nums)
+	}
+	delete(m[repo], num)
+	return n
+}
+
+func (m DependencyMap) Has(repo string, num int, depRepo string, depNum int) bool {
+	for _, n := range m[repo][num][depRepo] {
+		if n == depNum {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAnyPath returns true when repo#num is connected with depRepo#depNum
+// regardless of the path qualifier.
+func (m DependencyMap) HasAnyPath(repo string, num int, depRepo string, depNum int) bool {
+	for _, dep := range m.Get(repo, num) {
+		if dep.Repository == depRepo && dep.Number == depNum {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns pull requests connected with repo#num sorted by repository and
+// number.
+func (m DependencyMap) Get(repo string, num int) []PullRequestRef {
+	prs := []PullRequestRef{}
+	for key, nums := range m[repo][num] {
+		depRepo, path := splitDependencyKey(key)
+		for _, n := range nums {
+			prs = append(prs, PullRequestRef{Repository: depRepo, Number: n, Path: path})
+		}
+	}
+	sortPullRequestRefs(prs)
+	return prs
+}
+
+// Count returns number of connections of pull requests in a repository.
+func (m DependencyMap) Count(repo string) int {
+	n := 0
+	for _, deps := range m[repo] {
+		for _, nums := range deps {
+			n += len(nums)
+		}
+	}
+	return n
+}
+
+// Edges returns all connections sorted.
+func (m DependencyMap) Edges() []DependencyEdge {
+	edges := []DependencyEdge{}
+	for repo, prs := range m {
+		for num, deps := range prs {
+			for key, nums := range deps {
+				depRepo, path := splitDependencyKey(key)
+				for _, depNum := range nums {
+					edges = append(edges, DependencyEdge{
+						Repository:          repo,
+						Number:              num,
+						DependsOnRepository: depRepo,
+						DependsOnNumber:     depNum,
+						DependsOnPath:       path,
+					})
+				}
+			}
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].Repository != edges[j].Repository {
+			return edges[i].Repository < edges[j].Repository
+		}
+		if edges[i].Number != edges[j].Number {
+			return edges[i].Number < edges[j].Number
+		}
+		if edges[i].DependsOnRepository != edges[j].DependsOnRepository {
+			return edges[i].DependsOnRepository < edges[j].DependsOnRepository
+		}
+		if edges[i].DependsOnNumber != edges[j].DependsOnNumber {
+			return edges[i].DependsOnNumber < edges[j].DependsOnNumber
+		}
+		return edges[i].DependsOnPath < edges[j].DependsOnPath
+	})
+	return edges
+}
+
+// MarshalJSON writes an empty object instead of null for a map that was never
+// initialized so that consumers always get the same shape.
+func (m DependencyMap) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(map[string]map[int]map[string][]int(m))
+}
+
+func (m DependencyMap) Copy() DependencyMap {
+	c := DependencyMap{}
+	for repo, prs := range m {
+		c[repo] = map[int]map[string][]int{}
+		for num, deps := range prs {
+			c[repo][num] = map[string][]int{}
+			for r, nums := range deps {
+				c[repo][num][r] = append([]int{}, nums...)
+			}
+		}
+	}
+	return c
+}
+
+type PullRequestRef struct {
+	Repository string `json:"repository"`
+	Number     int    `json:"number"`
+	Path       string `json:"path,omitempty"`
+	Annotation string `json:"annotation,omitempty"`
+}
+
+// Key returns the key the pull request is stored under in DependencyMap.
+func (ref PullRequestRef) Key() string {
+	return dependencyKey(ref.Repository, ref.Path)
+}
+
+type CacheWarning struct {
+	Repository string `json:"repository"`
+	Message    string `json:"message"`
+}
+
+type PullRequestStatus struct {
+	Repository       string           `json:"repository"`
+	Number           int              `json:"number"`
+	Blocked          bool             `json:"blocked"`
+	Blockers         []PullRequestRef `json:"blockers"`
+	SoftDependencies []PullRequestRef `json:"soft_dependencies"`
+	Labels           []string         `json:"labels"`
+}
+
+type DependencyState struct {
+	Repository string `json:"repository"`
+	Number     int    `json:"number"`
+	Annotation string `json:"annotation,omitempty"`
+	State      string `json:"state"`
+	Source     string `json:"source"`
+}
+
+type DependencyClosure struct {
+	Repository   string           `json:"repository"`
+	Number       int              `json:"number"`
+	Dependencies []PullRequestRef `json:"dependencies"`
+	Cycle        bool             `json:"cycle"`
+	Truncated    bool             `json:"truncated,omitempty"`
+}
+
+type CacheStats struct {
+	Repositories int64 `json:"repositories"`
+	PullRequests int64 `json:"pull_requests"`
+	Dependencies int64 `json:"dependencies"`
+}
+
+type VerifyResult struct {
+	OK        bool     `json:"ok"`
+	Anomalies []string `json:"anomalies"`
+}
+
+type BranchEntry struct {
+	Repository string `json:"repository"`
+	Number     int    `json:"number"`
+	Branch     string `json:"branch"`
+}
+
+type CacheDiff struct {
+	AddedBranches       []BranchEntry    `json:"added_branches"`
+	RemovedBranches     []BranchEntry    `json:"removed_branches"`
+	AddedDependencies   []DependencyEdge `json:"added_dependencies"`
+	RemovedDependencies []DependencyEdge `json:"removed_dependencies"`
+}
+
+type DependencyEdge struct {
+	Repository          string `json:"repository"`
+	Number              int    `json:"number"`
+	DependsOnRepository string `json:"depends_on_repository"`
+	DependsOnNumber     int    `json:"depends_on_number"`
+	DependsOnPath       string `json:"depends_on_path,omitempty"`
+}
+
+// DependsOnKey returns the key the edge target is stored under in
+// DependencyMap.
+func (edge DependencyEdge) DependsOnKey() string {
+	return dependencyKey(edge.DependsOnRepository, edge.DependsOnPath)
 }
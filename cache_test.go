@@ -0,0 +1,617 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSnapshotIsolation is meant to be run with -race as well.
+func TestSnapshotIsolation(t *testing.T) {
+	app := newTestApp(t, `{}`)
+	openTestPullRequest(app, "b", 1)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 2; i < 200; i++ {
+			openTestPullRequest(app, "a", i, "b#1")
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		snapshot := app.cache.Snapshot()
+		for repo := range snapshot.Branches {
+			snapshot.Branches[repo][0] = "changed"
+		}
+		for num := range snapshot.Dependents["b"] {
+			snapshot.Dependents.Add("b", num, "x", 1)
+		}
+	}
+	wg.Wait()
+
+	snapshot := app.cache.Snapshot()
+	if _, hasKey := snapshot.Branches["b"][0]; hasKey {
+		t.Errorf("change of a snapshot got into the cache")
+	}
+	if _, hasKey := snapshot.Dependents["b"][1]["x"]; hasKey {
+		t.Errorf("change of a snapshot got into the cache")
+	}
+	if len(snapshot.Branches["a"]) != 198 {
+		t.Errorf("got %d pull requests, want 198", len(snapshot.Branches["a"]))
+	}
+}
+
+func TestCacheDiff(t *testing.T) {
+	previous := &Cache{
+		Branches:     map[string]map[int]string{"a": {1: "foo", 2: "bar"}, "b": {3: "baz"}},
+		Dependencies: DependencyMap{"a": {1: {"b": {3}}}},
+	}
+	tests := []struct {
+		name    string
+		current *Cache
+		want    CacheDiff
+	}{
+		{
+			"no changes",
+			previous,
+			CacheDiff{[]BranchEntry{}, []BranchEntry{}, []DependencyEdge{}, []DependencyEdge{}},
+		},
+		{
+			"branch added and removed",
+			&Cache{
+				Branches:     map[string]map[int]string{"a": {1: "foo", 4: "qux"}, "b": {3: "baz"}},
+				Dependencies: DependencyMap{"a": {1: {"b": {3}}}},
+			},
+			CacheDiff{
+				[]BranchEntry{{"a", 4, "qux"}},
+				[]BranchEntry{{"a", 2, "bar"}},
+				[]DependencyEdge{},
+				[]DependencyEdge{},
+			},
+		},
+		{
+			"branch renamed",
+			&Cache{
+				Branches:     map[string]map[int]string{"a": {1: "foo", 2: "bar2"}, "b": {3: "baz"}},
+				Dependencies: DependencyMap{"a": {1: {"b": {3}}}},
+			},
+			CacheDiff{
+				[]BranchEntry{{"a", 2, "bar2"}},
+				[]BranchEntry{{"a", 2, "bar"}},
+				[]DependencyEdge{},
+				[]DependencyEdge{},
+			},
+		},
+		{
+			"dependency changed",
+			&Cache{
+				Branches:     map[string]map[int]string{"a": {1: "foo", 2: "bar"}, "b": {3: "baz"}},
+				Dependencies: DependencyMap{"a": {1: {}, 2: {"b": {3}}}},
+			},
+			CacheDiff{
+				[]BranchEntry{},
+				[]BranchEntry{},
+				[]DependencyEdge{{Repository: "a", Number: 2, DependsOnRepository: "b", DependsOnNumber: 3}},
+				[]DependencyEdge{{Repository: "a", Number: 1, DependsOnRepository: "b", DependsOnNumber: 3}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.current.Diff(previous)
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDependencyMap(t *testing.T) {
+	tests := []struct {
+		name      string
+		change    func(m DependencyMap)
+		wantEdges []DependencyEdge
+	}{
+		{
+			"same repository twice",
+			func(m DependencyMap) {
+				m.Add("a", 1, "b", 7)
+				m.Add("a", 1, "b", 5)
+			},
+			[]DependencyEdge{{Repository: "a", Number: 1, DependsOnRepository: "b", DependsOnNumber: 5}, {Repository: "a", Number: 1, DependsOnRepository: "b", DependsOnNumber: 7}},
+		},
+		{
+			"duplicate",
+			func(m DependencyMap) {
+				m.Add("a", 1, "b", 5)
+				m.Add("a", 1, "b", 5)
+			},
+			[]DependencyEdge{{Repository: "a", Number: 1, DependsOnRepository: "b", DependsOnNumber: 5}},
+		},
+		{
+			"remove one of many",
+			func(m DependencyMap) {
+				m.Add("a", 1, "b", 5)
+				m.Add("a", 1, "b", 7)
+				m.Remove("a", 1, "b", 5)
+			},
+			[]DependencyEdge{{Repository: "a", Number: 1, DependsOnRepository: "b", DependsOnNumber: 7}},
+		},
+		{
+			"delete",
+			func(m DependencyMap) {
+				m.Add("a", 1, "b", 5)
+				m.Add("a", 2, "b", 7)
+				m.Delete("a", 1)
+			},
+			[]DependencyEdge{{Repository: "a", Number: 2, DependsOnRepository: "b", DependsOnNumber: 7}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := DependencyMap{}
+			tt.change(m)
+			if got := m.Edges(); !reflect.DeepEqual(got, tt.wantEdges) {
+				t.Errorf("got edges %v, want %v", got, tt.wantEdges)
+			}
+			if got := m.Count("a"); got != len(tt.wantEdges) {
+				t.Errorf("got count %d, want %d", got, len(tt.wantEdges))
+			}
+		})
+	}
+}
+
+func TestDependencyMapChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(m DependencyMap) int
+		want   int
+	}{
+		{"add new", func(m DependencyMap) int { return boolToInt(m.Add("a", 1, "b", 9)) }, 1},
+		{"add existing", func(m DependencyMap) int { return boolToInt(m.Add("a", 1, "b", 5)) }, 0},
+		{"remove existing", func(m DependencyMap) int { return boolToInt(m.Remove("a", 1, "b", 5)) }, 1},
+		{"remove other number", func(m DependencyMap) int { return boolToInt(m.Remove("a", 1, "b", 6)) }, 0},
+		{"remove unknown", func(m DependencyMap) int { return boolToInt(m.Remove("x", 1, "b", 5)) }, 0},
+		{"delete", func(m DependencyMap) int { return m.Delete("a", 1) }, 3},
+		{"delete without connections", func(m DependencyMap) int { return m.Delete("a", 2) }, 0},
+		{"delete unknown", func(m DependencyMap) int { return m.Delete("x", 1) }, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := DependencyMap{}
+			m.Add("a", 1, "b", 5)
+			m.Add("a", 1, "b", 7)
+			m.Add("a", 1, "c", 5)
+			m.Init("a", 2)
+			if got := tt.change(m); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestEvictPullRequests(t *testing.T) {
+	tests := []struct {
+		name        string
+		max         int
+		wantCount   int
+		wantEvicted []PullRequestRef
+	}{
+		{"unlimited", 0, 4, []PullRequestRef{}},
+		{"under the cap", 5, 4, []PullRequestRef{}},
+		{"at the cap", 4, 4, []PullRequestRef{}},
+		{"over the cap", 3, 3, []PullRequestRef{{Repository: "a", Number: 1}}},
+		{"well over the cap", 2, 2, []PullRequestRef{{Repository: "a", Number: 1}, {Repository: "b", Number: 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, fmt.Sprintf(`{"max_cached_pull_requests":%d}`, tt.max))
+			openTestPullRequest(app, "a", 1)
+			openTestPullRequest(app, "b", 2)
+			openTestPullRequest(app, "c", 3)
+			openTestPullRequest(app, "d", 4, "a#1")
+
+			if got := app.cache.Stats().PullRequests; got != int64(tt.wantCount) {
+				t.Errorf("got %d cached pull requests, want %d", got, tt.wantCount)
+			}
+			branches := 0
+			for _, prs := range app.cache.Branches {
+				branches += len(prs)
+			}
+			if branches != tt.wantCount {
+				t.Errorf("got %d cached branches, want %d", branches, tt.wantCount)
+			}
+			evicted := []PullRequestRef{}
+			for _, pr := range []PullRequestRef{{Repository: "a", Number: 1}, {Repository: "b", Number: 2}, {Repository: "c", Number: 3}, {Repository: "d", Number: 4}} {
+				if app.cache.IsEvicted(pr.Repository, pr.Number) {
+					evicted = append(evicted, pr)
+				}
+			}
+			if !reflect.DeepEqual(evicted, tt.wantEvicted) {
+				t.Errorf("got evicted %v, want %v", evicted, tt.wantEvicted)
+			}
+			// dependency on an evicted pull request is kept and still blocks
+			if got := app.cache.Snapshot().GetBlockers("d", 4); len(got) != 1 {
+				t.Errorf("got blockers %v, want a#1", got)
+			}
+		})
+	}
+}
+
+func TestCacheVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(app *App)
+		want    []string
+	}{
+		{"consistent", func(app *App) {}, []string{}},
+		{
+			"invalid number",
+			func(app *App) { app.cache.Branches["a"][-1] = "foo" },
+			[]string{"Branches: invalid pull request number a#-1"},
+		},
+		{
+			"malformed repository name",
+			func(app *App) { app.cache.Branches["a b"] = map[int]string{1: "foo"} },
+			[]string{`Branches: malformed repository name "a b"`},
+		},
+		{
+			"duplicate dependency",
+			func(app *App) { app.cache.Dependencies["a"][1]["b"] = []int{2, 2} },
+			[]string{"Dependencies: duplicate b#2 in a#1"},
+		},
+		{
+			"missing dependent",
+			func(app *App) { app.cache.Dependents.Delete("b", 2) },
+			[]string{"Dependencies: a#1 -> b#2 is missing in Dependents"},
+		},
+		{
+			"missing dependency",
+			func(app *App) { app.cache.Dependents.Add("b", 2, "c", 3) },
+			[]string{"Dependents: b#2 <- c#3 is missing in Dependencies"},
+		},
+		{
+			"dependency on closed pull request",
+			func(app *App) {
+				app.updateCache("closed", "b", 2, "branch-2", []string{}, []string{}, false)
+			},
+			[]string{},
+		},
+		{
+			"evicted pull request",
+			func(app *App) { app.cache.evict("a", 1) },
+			[]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{}`)
+			openTestPullRequest(app, "b", 2)
+			openTestPullRequest(app, "a", 1, "b#2")
+			tt.corrupt(app)
+
+			if got := app.cache.Snapshot().Verify(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got anomalies %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheJSONHasNoNullMaps(t *testing.T) {
+	if b, _ := json.Marshal(DependencyMap(nil)); string(b) != "{}" {
+		t.Errorf("got %s for uninitialized dependency map, want {}", b)
+	}
+
+	tests := []struct {
+		name  string
+		cache *Cache
+	}{
+		{"uninitialized maps", &Cache{Branches: map[string]map[int]string{}, Version: "1"}},
+		{"empty maps", &Cache{Branches: map[string]map[int]string{}, Dependencies: DependencyMap{}, Dependents: DependencyMap{}, SoftDependencies: DependencyMap{}, Version: "1"}},
+		{"pull request without dependencies", func() *Cache {
+			c := &Cache{Branches: map[string]map[int]string{"a": {1: "foo"}}, Dependencies: DependencyMap{}, Version: "1"}
+			c.Dependencies.Init("a", 1)
+			return c
+		}()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(tt.cache.Snapshot())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(b), "null") {
+				t.Errorf("got null in %s", b)
+			}
+			var j map[string]interface{}
+			json.Unmarshal(b, &j)
+			for _, key := range []string{"branches", "dependencies", "dependents", "soft_dependencies", "labels"} {
+				if _, ok := j[key].(map[string]interface{}); !ok {
+					t.Errorf("got %s %v, want an object", key, j[key])
+				}
+			}
+		})
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	type op struct {
+		action string
+		repo   string
+		num    int
+		deps   []string
+	}
+	tests := []struct {
+		name string
+		cfg  string
+		ops  []op
+	}{
+		{"empty", `{}`, []op{}},
+		{"opened", `{}`, []op{
+			{"opened", "a", 1, nil},
+			{"opened", "a", 2, []string{"a#1"}},
+			{"opened", "b", 3, []string{"a#1", "a#2"}},
+		}},
+		{"edited and closed", `{}`, []op{
+			{"opened", "a", 1, nil},
+			{"opened", "a", 2, []string{"a#1"}},
+			{"opened", "b", 3, []string{"a#1", "a#2"}},
+			{"edited", "b", 3, []string{"a#2"}},
+			{"closed", "a", 1, nil},
+			{"closed", "a", 2, nil},
+			{"reopened", "a", 2, nil},
+			{"opened", "c", 4, []string{"a#2", "b#3"}},
+		}},
+		{"repeated and unknown", `{}`, []op{
+			{"opened", "a", 1, nil},
+			{"opened", "b", 2, []string{"a#1", "a#1", "a#9"}},
+			{"synchronize", "b", 2, []string{"a#1"}},
+			{"opened", "b", 2, []string{"a#1"}},
+			{"closed", "c", 7, nil},
+			{"closed", "b", 2, []string{"a#1"}},
+			{"closed", "b", 2, nil},
+		}},
+		{"path qualified", `{}`, []op{
+			{"opened", "mono", 1, nil},
+			{"opened", "app", 2, []string{"mono/api#1", "mono/web#1", "mono#1"}},
+			{"edited", "app", 2, []string{"mono/api#1"}},
+			{"closed", "mono", 1, nil},
+		}},
+		{"evicted", `{"max_cached_pull_requests":2}`, []op{
+			{"opened", "a", 1, nil},
+			{"opened", "b", 2, []string{"a#1"}},
+			{"opened", "c", 3, []string{"b#2"}},
+			{"opened", "d", 4, []string{"c#3"}},
+			{"closed", "c", 3, nil},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, tt.cfg)
+			check := func(step string) {
+				t.Helper()
+				want := CacheStats{}
+				for _, nums := range app.cache.Branches {
+					if len(nums) > 0 {
+						want.Repositories++
+					}
+					want.PullRequests += int64(len(nums))
+				}
+				want.Dependencies = int64(len(app.cache.Dependencies.Edges()))
+
+				if got := app.cache.Stats(); got != want {
+					t.Errorf("%s: got stats %+v, want %+v", step, got, want)
+				}
+				if got := app.cache.Snapshot().Stats(); got != want {
+					t.Errorf("%s: got snapshot stats %+v, want %+v", step, got, want)
+				}
+			}
+			check("initial")
+			for _, o := range tt.ops {
+				app.updateCache(o.action, o.repo, o.num, "branch", o.deps, []string{}, false)
+				check(fmt.Sprintf("%s %s#%d", o.action, o.repo, o.num))
+			}
+		})
+	}
+}
+
+func TestCacheStatsAfterPruning(t *testing.T) {
+	tests := []struct {
+		name  string
+		prune func(app *App)
+	}{
+		{"closed dependencies", func(app *App) {
+			app.pruneClosedDependencies(map[string]bool{"lib": true})
+		}},
+		{"orphaned dependencies", func(app *App) {
+			*app.cfg.PullRequestDependsOn.Repositories = []DependsOnConditionRepository{{Name: "app"}}
+			app.processOrphanedDependencies()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"prune_orphaned_dependencies":true,"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			openTestPullRequest(app, "lib", 1)
+			openTestPullRequest(app, "lib", 2)
+			openTestPullRequest(app, "app", 3, "lib#1", "lib#2")
+			// lib#1 got closed on GitHub without the cache knowing
+			app.cache.mu.Lock()
+			app.cache.deleteBranch("lib", 1)
+			app.cache.mu.Unlock()
+
+			tt.prune(app)
+
+			want := CacheStats{Repositories: 2, PullRequests: 2, Dependencies: int64(len(app.cache.Dependencies.Edges()))}
+			if want.Dependencies == 2 {
+				t.Fatalf("nothing was pruned")
+			}
+			if got := app.cache.Stats(); got != want {
+				t.Errorf("got stats %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestGetBranches(t *testing.T) {
+	tests := []struct {
+		name   string
+		opened []PullRequestRef
+		closed []PullRequestRef
+		want   []BranchEntry
+	}{
+		{"empty", nil, nil, []BranchEntry{}},
+		{"sorted by repository and number", []PullRequestRef{{Repository: "lib", Number: 2}, {Repository: "app", Number: 10}, {Repository: "app", Number: 9}}, nil, []BranchEntry{
+			{Repository: "app", Number: 9, Branch: "branch-9"},
+			{Repository: "app", Number: 10, Branch: "branch-10"},
+			{Repository: "lib", Number: 2, Branch: "branch-2"},
+		}},
+		{"closed left out", []PullRequestRef{{Repository: "app", Number: 1}, {Repository: "lib", Number: 2}}, []PullRequestRef{{Repository: "lib", Number: 2}}, []BranchEntry{
+			{Repository: "app", Number: 1, Branch: "branch-1"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{}`)
+			for _, pr := range tt.opened {
+				openTestPullRequest(app, pr.Repository, pr.Number)
+			}
+			for _, pr := range tt.closed {
+				app.updateCache("closed", pr.Repository, pr.Number, "", []string{}, []string{}, false)
+			}
+			if got := app.cache.Snapshot().GetBranches(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectCycles(t *testing.T) {
+	tests := []struct {
+		name  string
+		edges [][2]string
+		want  [][]string
+	}{
+		{"no dependencies", [][2]string{}, [][]string{}},
+		{"chain", [][2]string{{"aaa#1", "bbb#2"}, {"bbb#2", "ccc#3"}}, [][]string{}},
+		{"self reference", [][2]string{{"aaa#1", "aaa#1"}}, [][]string{{"aaa#1"}}},
+		{"two nodes", [][2]string{{"bbb#2", "aaa#1"}, {"aaa#1", "bbb#2"}}, [][]string{{"aaa#1", "bbb#2"}}},
+		{"three nodes", [][2]string{{"ccc#3", "aaa#1"}, {"aaa#1", "bbb#2"}, {"bbb#2", "ccc#3"}}, [][]string{{"aaa#1", "bbb#2", "ccc#3"}}},
+		{"two cycles", [][2]string{{"aaa#1", "bbb#2"}, {"bbb#2", "aaa#1"}, {"ccc#3", "ccc#3"}}, [][]string{{"aaa#1", "bbb#2"}, {"ccc#3"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Cache{Dependencies: DependencyMap{}}
+			for _, edge := range tt.edges {
+				from, _ := parseDependsOn(edge[0])
+				to, _ := parseDependsOn(edge[1])
+				c.Dependencies.Add(from.Repository, from.Number, to.Key(), to.Number)
+			}
+			if got := c.DetectCycles(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLargeDependencyGraph(t *testing.T) {
+	tests := []struct {
+		name      string
+		build     func(c *Cache)
+		wantDeps  int
+		wantCycle bool
+	}{
+		{"deep chain", func(c *Cache) {
+			for i := 1; i < 5000; i++ {
+				c.Dependencies.Add("app", i, "app", i+1)
+			}
+		}, 4999, false},
+		{"deep chain with cycle", func(c *Cache) {
+			for i := 1; i < 5000; i++ {
+				c.Dependencies.Add("app", i, "app", i+1)
+			}
+			c.Dependencies.Add("app", 5000, "app", 2)
+		}, 4999, true},
+		{"layered", func(c *Cache) {
+			// every pull request in a layer depends on all in the next one
+			for layer := 0; layer < 50; layer++ {
+				for i := 0; i < 20; i++ {
+					for j := 0; j < 20; j++ {
+						c.Dependencies.Add("app", layer*20+i+1, "app", (layer+1)*20+j+1)
+					}
+				}
+			}
+		}, 1000, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Cache{Branches: map[string]map[int]string{}, Dependencies: DependencyMap{}}
+			tt.build(&c)
+
+			start := time.Now()
+			closure := c.GetClosure("app", 1)
+			cycles := c.DetectCycles()
+			c.GetDependents("app", 1000)
+			if d := time.Since(start); d > 5*time.Second {
+				t.Errorf("took %s", d)
+			}
+			if len(closure.Dependencies) != tt.wantDeps {
+				t.Errorf("got %d dependencies, want %d", len(closure.Dependencies), tt.wantDeps)
+			}
+			if closure.Cycle != tt.wantCycle || (len(cycles) > 0) != tt.wantCycle {
+				t.Errorf("got cycle %v and %d cycles, want cycle %v", closure.Cycle, len(cycles), tt.wantCycle)
+			}
+			if closure.Truncated {
+				t.Errorf("got truncated closure")
+			}
+		})
+	}
+}
+
+func TestGetClosure(t *testing.T) {
+	tests := []struct {
+		name      string
+		edges     [][2]string
+		wantDeps  []string
+		wantCycle bool
+	}{
+		{"no dependencies", [][2]string{}, []string{}, false},
+		{"direct", [][2]string{{"app#1", "lib#2"}}, []string{"lib#2"}, false},
+		{"chain", [][2]string{{"app#1", "api#2"}, {"api#2", "lib#3"}}, []string{"lib#3", "api#2"}, false},
+		{"diamond", [][2]string{{"app#1", "api#2"}, {"app#1", "web#3"}, {"api#2", "lib#4"}, {"web#3", "lib#4"}}, []string{"lib#4", "api#2", "web#3"}, false},
+		{"cycle", [][2]string{{"app#1", "api#2"}, {"api#2", "lib#3"}, {"lib#3", "api#2"}}, []string{"lib#3", "api#2"}, true},
+		{"cycle back to start", [][2]string{{"app#1", "api#2"}, {"api#2", "app#1"}}, []string{"api#2"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Cache{Dependencies: DependencyMap{}}
+			for _, edge := range tt.edges {
+				from, _ := parseDependsOn(edge[0])
+				to, _ := parseDependsOn(edge[1])
+				c.Dependencies.Add(from.Repository, from.Number, to.Key(), to.Number)
+			}
+			closure := c.GetClosure("app", 1)
+			got := []string{}
+			for _, dep := range closure.Dependencies {
+				got = append(got, fmt.Sprintf("%s#%d", dep.Repository, dep.Number))
+			}
+			if !reflect.DeepEqual(got, tt.wantDeps) {
+				t.Errorf("got %v, want %v", got, tt.wantDeps)
+			}
+			if closure.Cycle != tt.wantCycle {
+				t.Errorf("got cycle %v, want %v", closure.Cycle, tt.wantCycle)
+			}
+		})
+	}
+}
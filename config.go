@@ -2,39 +2,548 @@ package main
 
 import (
 	"encoding/json"
-	"log"
 	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	Version              string                `json:"version"`
-	Port                 string                `json:"port"`
-	Secret               string                `json:"incoming_webhook_secret";omitempty`
-	Token                string                `json:"outgoing_github_token";omitempty`
-	APITokenValue        string                `json:"incoming_api_token_value";omitempty`
-	APITokenHeader       string                `json:"incoming_api_token_header";omitempty`
-	PullRequestDependsOn *PullRequestDependsOn `json:"pull_request_depends_on";omitempty`
-	Jenkins              Jenkins               `json:"jenkins"`
+	Version                            string                `json:"version"`
+	Port                               string                `json:"port"`
+	GRPCPort                           string                `json:"grpc_port,omitempty"`
+	AdminPort                          string                `json:"admin_port,omitempty"`
+	TLSCertFile                        string                `json:"tls_cert_file,omitempty"`
+	TLSKeyFile                         string                `json:"tls_key_file,omitempty"`
+	Secret                             string                `json:"incoming_webhook_secret,omitempty"`
+	Token                              string                `json:"outgoing_github_token,omitempty"`
+	BaseURL                            string                `json:"github_base_url,omitempty"`
+	RateLimitRetries                   int                   `json:"rate_limit_retries,omitempty"`
+	RateLimitMaxWait                   int                   `json:"rate_limit_max_wait,omitempty"`
+	GitHubTimeout                      int                   `json:"github_timeout,omitempty"`
+	GitHubMaxIdleConnsPerHost          int                   `json:"github_max_idle_conns_per_host,omitempty"`
+	GitHubIdleConnTimeout              int                   `json:"github_idle_conn_timeout,omitempty"`
+	APITokenValue                      string                `json:"incoming_api_token_value,omitempty"`
+	APITokenHeader                     string                `json:"incoming_api_token_header,omitempty"`
+	PrettyJSON                         bool                  `json:"pretty_json,omitempty"`
+	ResponseEnvelope                   bool                  `json:"response_envelope,omitempty"`
+	MetricsEnabled                     bool                  `json:"metrics_enabled,omitempty"`
+	MetricsPrefix                      string                `json:"metrics_prefix,omitempty"`
+	DisableRegex                       bool                  `json:"disable_regex,omitempty"`
+	CaseInsensitiveKeywords            bool                  `json:"case_insensitive_keywords,omitempty"`
+	PruneOrphanedDependencies          bool                  `json:"prune_orphaned_dependencies,omitempty"`
+	PruneClosedDependenciesOnReconcile bool                  `json:"prune_closed_dependencies_on_reconcile,omitempty"`
+	MaxDependenciesPerRepo             int                   `json:"max_dependencies_per_repo,omitempty"`
+	StrictDependencies                 bool                  `json:"strict_dependencies,omitempty"`
+	MaxConcurrentWebhooks              int                   `json:"max_concurrent_webhooks,omitempty"`
+	MaxCachedPullRequests              int                   `json:"max_cached_pull_requests,omitempty"`
+	BranchPrefixStrip                  []string              `json:"branch_prefix_strip,omitempty"`
+	MaxDeliveryAge                     int                   `json:"max_delivery_age,omitempty"`
+	MaxActionAge                       int                   `json:"max_action_age,omitempty"`
+	RefreshDependentsOnPush            bool                  `json:"refresh_dependents_on_push,omitempty"`
+	ResyncOnInstallationChange         bool                  `json:"resync_on_installation_change,omitempty"`
+	HandlePullRequestTarget            bool                  `json:"handle_pull_request_target,omitempty"`
+	SkipDraftsAtStartup                bool                  `json:"skip_drafts_at_startup,omitempty"`
+	CacheFile                          string                `json:"cache_file,omitempty"`
+	CacheFormat                        string                `json:"cache_format,omitempty"`
+	CacheFlushInterval                 int                   `json:"cache_flush_interval,omitempty"`
+	ShutdownTimeout                    int                   `json:"shutdown_timeout,omitempty"`
+	RetryAfter                         int                   `json:"retry_after,omitempty"`
+	MaxRecentErrors                    int                   `json:"max_recent_errors,omitempty"`
+	OnGitHubError                      string                `json:"on_github_error,omitempty"`
+	LogLevel                           string                `json:"log_level,omitempty"`
+	LogFormat                          string                `json:"log_format,omitempty"`
+	PullRequestDependsOn               *PullRequestDependsOn `json:"pull_request_depends_on,omitempty"`
+	DisabledFeatureHTTPStatus          int                   `json:"disabled_feature_http_status,omitempty"`
+	WebhookPaths                       map[string]string     `json:"webhook_paths,omitempty"`
+	AllowedCIDRs                       []string              `json:"allowed_cidrs,omitempty"`
+	TrustForwardedFor                  bool                  `json:"trust_forwarded_for,omitempty"`
+	Tracing                            *TracingConfig        `json:"tracing,omitempty"`
+	CacheExport                        *CacheExportConfig    `json:"cache_export,omitempty"`
+	Jenkins                            Jenkins               `json:"jenkins"`
+	// InsecureSkipVerify disables TLS certificate verification of the GitHub
+	// API. It is meant for GitHub Enterprise test instances with self-signed
+	// certificates only and must never be enabled in production.
+	InsecureSkipVerify bool `json:"github_insecure_skip_verify,omitempty"`
+	// allowedNets are AllowedCIDRs parsed when config is loaded
+	allowedNets []*net.IPNet
 }
 
 func (c *Config) SetFromJSON(b []byte) {
+	err := c.parseJSON(b)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+}
+
+// parseJSON sets the config from JSON and compiles repository rules. Unlike
+// SetFromJSON it returns an error so that a failed reload keeps the daemon
+// running.
+func (c *Config) parseJSON(b []byte) error {
 	err := json.Unmarshal(b, c)
 	if err != nil {
-		log.Fatal("Error setting config from JSON:", err.Error())
+		return errors.New("Error setting config from JSON: " + err.Error())
+	}
+	if c.OnGitHubError != "" && c.OnGitHubError != FailOpen && c.OnGitHubError != FailClosed {
+		return errors.New("Error in config: on_github_error must be either \"open\" or \"closed\"")
 	}
+	c.allowedNets = nil
+	for _, cidr := range c.AllowedCIDRs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return errors.New("Error in config: invalid CIDR " + cidr + " in allowed_cidrs")
+		}
+		c.allowedNets = append(c.allowedNets, n)
+	}
+	if c.PullRequestDependsOn != nil {
+		if c.DisableRegex {
+			c.PullRequestDependsOn.DisableRegExpRules()
+		}
+		err = c.PullRequestDependsOn.CompileRules()
+		if err != nil {
+			return errors.New("Error in config repository rules: " + err.Error())
+		}
+	}
+	return nil
+}
+
+var metricsPrefixRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// Validate checks that options required to run the daemon are set and have
+// valid values. Each problem is logged and an error is returned when any was
+// found.
+func (c *Config) Validate() error {
+	problems := []string{}
+	if c.Port == "" {
+		problems = append(problems, "port is required")
+	}
+	for name, port := range map[string]string{"port": c.Port, "grpc_port": c.GRPCPort, "admin_port": c.AdminPort} {
+		if port != "" && !isValidPort(port) {
+			problems = append(problems, fmt.Sprintf("%s must be a number between 1 and 65535, got %q", name, port))
+		}
+	}
+	if _, ok := logLevels[c.GetLogLevel()]; !ok {
+		problems = append(problems, fmt.Sprintf("log_level must be one of debug, info, warn and error, got %q", c.LogLevel))
+	}
+	if c.GetLogFormat() != LogFormatText && c.GetLogFormat() != LogFormatJSON {
+		problems = append(problems, fmt.Sprintf("log_format must be either text or json, got %q", c.LogFormat))
+	}
+	if c.MetricsPrefix != "" && !metricsPrefixRegexp.MatchString(c.MetricsPrefix) {
+		problems = append(problems, fmt.Sprintf("metrics_prefix must be a valid Prometheus metric name, got %q", c.MetricsPrefix))
+	}
+	if c.GetCacheFormat() != CacheFormatJSON && c.GetCacheFormat() != CacheFormatGob {
+		problems = append(problems, fmt.Sprintf("cache_format must be either json or gob, got %q", c.CacheFormat))
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		problems = append(problems, "tls_cert_file and tls_key_file must be set together to serve over HTTPS")
+	}
+	if c.StrictDependencies && c.PullRequestDependsOn == nil {
+		problems = append(problems, "strict_dependencies requires pull_request_depends_on as dependencies are tracked only with it")
+	}
+	if c.PullRequestDependsOn != nil {
+		if c.Token == "" {
+			problems = append(problems, "outgoing_github_token is required to fetch pull requests from GitHub")
+		}
+		if c.PullRequestDependsOn.Owner == "" {
+			if c.PullRequestDependsOn.Organization {
+				problems = append(problems, "pull_request_depends_on.owner is required, organization only tells that the owner is an organization")
+			} else {
+				problems = append(problems, "pull_request_depends_on.owner is required")
+			}
+		}
+		if c.PullRequestDependsOn.Repositories == nil || len(*c.PullRequestDependsOn.Repositories) == 0 {
+			problems = append(problems, "pull_request_depends_on.repositories must contain at least one rule")
+		}
+		if c.PullRequestDependsOn.ExcludeRepositories == nil {
+			problems = append(problems, "pull_request_depends_on.exclude_repositories is required, use [] to exclude nothing")
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	for _, problem := range problems {
+		logger.Error("Error in config: " + problem)
+	}
+	return errors.New(fmt.Sprintf("Config has %d problem(s)", len(problems)))
+}
+
+// IsTLSEnabled returns true when API is served over HTTPS.
+func (c *Config) IsTLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+func isValidPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+const redactedValue = "[REDACTED]"
+
+func redact(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+// Redact returns a copy of the config with secrets masked. It must be used
+// whenever config is logged or printed.
+func (c Config) Redact() Config {
+	r := c
+	r.Secret = redact(c.Secret)
+	r.Token = redact(c.Token)
+	r.APITokenValue = redact(c.APITokenValue)
+	r.Jenkins.Token = redact(c.Jenkins.Token)
+	if c.CacheExport != nil {
+		cacheExport := *c.CacheExport
+		cacheExport.S3URL = redact(c.CacheExport.S3URL)
+		r.CacheExport = &cacheExport
+	}
+	return r
+}
+
+// WithDefaults returns the config with defaults filled in for options that
+// are not set, ie. the effective config.
+func (c Config) WithDefaults() Config {
+	d := c
+	d.BaseURL = c.GetGitHubBaseURL()
+	d.RateLimitRetries = c.GetRateLimitRetries()
+	d.RateLimitMaxWait = int(c.GetRateLimitMaxWait() / time.Second)
+	d.GitHubTimeout = int(c.GetGitHubTimeout() / time.Second)
+	d.GitHubMaxIdleConnsPerHost = c.GetGitHubMaxIdleConnsPerHost()
+	d.GitHubIdleConnTimeout = int(c.GetGitHubIdleConnTimeout() / time.Second)
+	d.DisabledFeatureHTTPStatus = c.GetDisabledFeatureHTTPStatus()
+	d.WebhookPaths = map[string]string{}
+	for provider, path := range c.WebhookPaths {
+		d.WebhookPaths[provider] = path
+	}
+	d.WebhookPaths["github"] = c.GetWebhookPath("github")
+	d.ShutdownTimeout = int(c.GetShutdownTimeout() / time.Second)
+	d.RetryAfter = c.GetRetryAfter()
+	d.MaxRecentErrors = c.GetMaxRecentErrors()
+	d.MetricsPrefix = c.GetMetricsPrefix()
+	d.LogLevel = c.GetLogLevel()
+	d.LogFormat = c.GetLogFormat()
+	d.OnGitHubError = c.GetOnGitHubError()
+	if c.CacheFile != "" {
+		d.CacheFlushInterval = int(c.GetCacheFlushInterval() / time.Second)
+		d.CacheFormat = c.GetCacheFormat()
+	}
+	return d
+}
+
+// GetGitHubBaseURL returns the GitHub API endpoint, which is the public one
+// unless BaseURL points to GitHub Enterprise Server, eg.
+// https://ghe.example.com/api/v3.
+func (c *Config) GetGitHubBaseURL() string {
+	if c.BaseURL == "" {
+		return "https://api.github.com"
+	}
+	return strings.TrimRight(c.BaseURL, "/")
+}
+
+// GetRateLimitRetries returns how many times a GitHub API request that hit the
+// rate limit is retried. Defaults to 3.
+func (c *Config) GetRateLimitRetries() int {
+	if c.RateLimitRetries <= 0 {
+		return 3
+	}
+	return c.RateLimitRetries
+}
+
+// GetRateLimitMaxWait returns the longest time to wait for the GitHub API
+// rate limit to reset before retrying. Defaults to 5 minutes.
+func (c *Config) GetRateLimitMaxWait() time.Duration {
+	if c.RateLimitMaxWait <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(c.RateLimitMaxWait) * time.Second
+}
+
+// IsAllowedIP returns true when the IP is within any of AllowedCIDRs or the
+// list is empty.
+func (c *Config) IsAllowedIP(ip net.IP) bool {
+	if len(c.allowedNets) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.allowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetGitHubTimeout returns the time limit of a single GitHub API request,
+// including reading the response. Defaults to 30 seconds.
+func (c *Config) GetGitHubTimeout() time.Duration {
+	if c.GitHubTimeout <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.GitHubTimeout) * time.Second
+}
+
+// GetGitHubMaxIdleConnsPerHost returns how many idle connections to the GitHub
+// API are kept open for reuse. Defaults to 10.
+func (c *Config) GetGitHubMaxIdleConnsPerHost() int {
+	if c.GitHubMaxIdleConnsPerHost <= 0 {
+		return 10
+	}
+	return c.GitHubMaxIdleConnsPerHost
+}
+
+// GetGitHubIdleConnTimeout returns how long an idle connection to the GitHub
+// API is kept open. Defaults to 90 seconds.
+func (c *Config) GetGitHubIdleConnTimeout() time.Duration {
+	if c.GitHubIdleConnTimeout <= 0 {
+		return 90 * time.Second
+	}
+	return time.Duration(c.GitHubIdleConnTimeout) * time.Second
+}
+
+// GetDisabledFeatureHTTPStatus returns the HTTP status sent in response to
+// webhooks when PullRequestDependsOn is not configured.
+func (c *Config) GetDisabledFeatureHTTPStatus() int {
+	if c.DisabledFeatureHTTPStatus == 0 {
+		return http.StatusNotImplemented
+	}
+	return c.DisabledFeatureHTTPStatus
+}
+
+// GetWebhookPath returns the path on which webhooks from the given provider
+// are received. Defaults to "/".
+func (c *Config) GetWebhookPath(provider string) string {
+	p := c.WebhookPaths[provider]
+	if p == "" {
+		return "/"
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p
+}
+
+// GetShutdownTimeout returns how long in-flight requests are given to finish on
+// shutdown. Defaults to 30 seconds.
+func (c *Config) GetShutdownTimeout() time.Duration {
+	if c.ShutdownTimeout <= 0 {
+		return 30 * time.Second
+	}
+	return time.Second * time.Duration(c.ShutdownTimeout)
+}
+
+// GetRetryAfter returns number of seconds sent in Retry-After header of 503
+// responses. Defaults to 10.
+func (c *Config) GetRetryAfter() int {
+	if c.RetryAfter <= 0 {
+		return 10
+	}
+	return c.RetryAfter
+}
+
+// GetLogLevel returns the lowest level that is logged. Defaults to info.
+func (c *Config) GetLogLevel() string {
+	if c.LogLevel == "" {
+		return LogLevelInfo
+	}
+	return c.LogLevel
+}
+
+// GetLogFormat returns whether logs are written as text or JSON. Defaults to
+// text.
+func (c *Config) GetLogFormat() string {
+	if c.LogFormat == "" {
+		return LogFormatText
+	}
+	return c.LogFormat
+}
+
+// GetMetricsPrefix returns the prefix of metric names, which lets metrics of
+// several instances scraped by one Prometheus be told apart. Defaults to prd.
+func (c *Config) GetMetricsPrefix() string {
+	if c.MetricsPrefix == "" {
+		return "prd"
+	}
+	return c.MetricsPrefix
+}
+
+// GetMaxRecentErrors returns how many errors of processing webhook deliveries
+// are kept for /errors. Defaults to 100.
+func (c *Config) GetMaxRecentErrors() int {
+	if c.MaxRecentErrors <= 0 {
+		return 100
+	}
+	return c.MaxRecentErrors
+}
+
+// GetCacheFlushInterval returns how often the cache is saved to CacheFile.
+// Defaults to 60 seconds.
+func (c *Config) GetCacheFlushInterval() time.Duration {
+	if c.CacheFlushInterval <= 0 {
+		return 60 * time.Second
+	}
+	return time.Duration(c.CacheFlushInterval) * time.Second
+}
+
+// GetCacheFormat returns the format CacheFile is saved in, "json" or "gob",
+// which is faster for large caches. Defaults to "json".
+func (c *Config) GetCacheFormat() string {
+	if c.CacheFormat == "" {
+		return CacheFormatJSON
+	}
+	return c.CacheFormat
+}
+
+const (
+	FailOpen   = "open"
+	FailClosed = "closed"
+)
+
+// GetOnGitHubError returns what to do when GitHub cannot be queried at
+// runtime: "open" ignores the failure while "closed" treats it as blocking.
+// Defaults to "closed".
+func (c *Config) GetOnGitHubError() string {
+	if c.OnGitHubError == "" {
+		return FailClosed
+	}
+	return c.OnGitHubError
+}
+
+type TracingConfig struct {
+	Enabled     bool   `json:"enabled"`
+	Endpoint    string `json:"endpoint,omitempty"`
+	Insecure    bool   `json:"insecure,omitempty"`
+	ServiceName string `json:"service_name,omitempty"`
+}
+
+type CacheExportConfig struct {
+	Destination  string `json:"destination"`
+	Interval     int    `json:"interval"`
+	GistID       string `json:"gist_id,omitempty"`
+	GistFilename string `json:"gist_filename,omitempty"`
+	S3URL        string `json:"s3_url,omitempty"`
 }
 
 type PullRequestDependsOn struct {
 	Owner               string                            `json:"owner"`
-	Organization        bool                              `json:"organization";omit_empty`
-	Repositories        *([]DependsOnConditionRepository) `json:"repositories";omitempty`
-	ExcludeRepositories *([]DependsOnConditionRepository) `json:"exclude_repositories";omitempty`
+	Organization        bool                              `json:"organization,omitempty"`
+	Repositories        *([]DependsOnConditionRepository) `json:"repositories,omitempty"`
+	ExcludeRepositories *([]DependsOnConditionRepository) `json:"exclude_repositories,omitempty"`
+	RequireDeclaration  *([]DependsOnConditionRepository) `json:"require_declaration,omitempty"`
+	IncludeArchived     bool                              `json:"include_archived,omitempty"`
+}
+
+func (p *PullRequestDependsOn) CompileRules() error {
+	for _, rules := range []*([]DependsOnConditionRepository){p.Repositories, p.ExcludeRepositories, p.RequireDeclaration} {
+		if rules == nil {
+			continue
+		}
+		for i := range *rules {
+			err := (*rules)[i].Compile()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DisableRegExpRules makes regexp repository rules match their name exactly.
+func (p *PullRequestDependsOn) DisableRegExpRules() {
+	for _, rules := range []*([]DependsOnConditionRepository){p.Repositories, p.ExcludeRepositories, p.RequireDeclaration} {
+		if rules == nil {
+			continue
+		}
+		for i := range *rules {
+			if (*rules)[i].RegExp {
+				logger.Info("Regular expressions are disabled. Repository rule is matched literally", "rule", (*rules)[i].Name)
+				(*rules)[i].RegExp = false
+			}
+		}
+	}
 }
 
+// DependsOnConditionRepository matches repositories by name and optionally by
+// topic and visibility. Empty name matches any repository.
 type DependsOnConditionRepository struct {
-	Name   string `json:"name"`
-	RegExp bool   `json:"regexp";omit_empty`
+	Name       string `json:"name"`
+	RegExp     bool   `json:"regexp,omitempty"`
+	Glob       bool   `json:"glob,omitempty"`
+	Topic      string `json:"topic,omitempty"`
+	Visibility string `json:"visibility,omitempty"`
+	matcher    func(string) bool
+}
+
+// Compile builds the matcher for the rule so that patterns are parsed only
+// once, when config is loaded.
+func (r *DependsOnConditionRepository) Compile() error {
+	if r.RegExp && r.Glob {
+		return errors.New("Repository rule " + r.Name + " cannot be both regexp and glob")
+	}
+	if r.Name == "" && r.Topic == "" && r.Visibility == "" {
+		return errors.New("Repository rule must have a name, topic or visibility")
+	}
+	if r.Visibility != "" && r.Visibility != "public" && r.Visibility != "private" && r.Visibility != "internal" {
+		return errors.New("Repository rule " + r.Name + " has invalid visibility " + r.Visibility + ", must be public, private or internal")
+	}
+	if r.RegExp {
+		re, err := regexp.Compile(r.Name)
+		if err != nil {
+			return errors.New("Invalid regexp in repository rule " + r.Name)
+		}
+		r.matcher = re.MatchString
+		return nil
+	}
+	if r.Glob {
+		_, err := path.Match(r.Name, "")
+		if err != nil {
+			return errors.New("Invalid glob in repository rule " + r.Name)
+		}
+		pattern := r.Name
+		r.matcher = func(repo string) bool {
+			m, _ := path.Match(pattern, repo)
+			return m
+		}
+		return nil
+	}
+	name := r.Name
+	r.matcher = func(repo string) bool {
+		return name == "" || name == "*" || name == repo
+	}
+	return nil
+}
+
+func (r *DependsOnConditionRepository) Match(repo Repository) bool {
+	if r.matcher == nil {
+		if r.Compile() != nil {
+			return false
+		}
+	}
+	if !r.matcher(repo.Name) {
+		return false
+	}
+	if r.Visibility != "" && !strings.EqualFold(r.Visibility, repo.Visibility) {
+		return false
+	}
+	if r.Topic == "" {
+		return true
+	}
+	for _, topic := range repo.Topics {
+		if strings.EqualFold(topic, r.Topic) {
+			return true
+		}
+	}
+	return false
 }
 
 type Jenkins struct {
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCheckIfRepoShouldBeIncludedGlob(t *testing.T) {
+	app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o",
+		"repositories":[{"name":"team-*","glob":true},{"name":"svc-?","glob":true},{"name":"^lib-.*$","regexp":true}],
+		"exclude_repositories":[{"name":"team-*-archive","glob":true}]}}`)
+
+	tests := []struct {
+		repo string
+		want bool
+	}{
+		{"team-a", true},
+		{"team-", true},
+		{"team-a-archive", false},
+		{"svc-1", true},
+		{"svc-12", false},
+		{"lib-x", true},
+		{"other", false},
+		{"myteam-a", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.repo, func(t *testing.T) {
+			if got := app.checkIfRepoShouldBeIncluded(tt.repo); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisableRegexRepositoryRules(t *testing.T) {
+	app := newTestApp(t, `{"disable_regex":true,"pull_request_depends_on":{"owner":"o",
+		"repositories":[{"name":"^lib-.*$","regexp":true},{"name":"team-*","glob":true}],
+		"exclude_repositories":[{"name":"team-.*","regexp":true}]}}`)
+
+	tests := []struct {
+		repo string
+		want bool
+	}{
+		{"lib-x", false},
+		{"^lib-.*$", true},
+		{"team-a", true},
+		{"team-.*", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.repo, func(t *testing.T) {
+			if got := app.checkIfRepoShouldBeIncluded(tt.repo); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRepositoryRulesTopicAndVisibility(t *testing.T) {
+	app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o",
+		"repositories":[{"topic":"service"},{"name":"lib-*","glob":true,"visibility":"public"}],
+		"exclude_repositories":[{"topic":"archived"}]}}`)
+	app.setRepositories([]Repository{
+		{Name: "api", Topics: []string{"Service"}, Visibility: "private"},
+		{Name: "old", Topics: []string{"service", "archived"}, Visibility: "private"},
+		{Name: "web", Topics: []string{"frontend"}, Visibility: "public"},
+		{Name: "lib-a", Visibility: "public"},
+		{Name: "lib-b", Visibility: "internal"},
+	})
+
+	tests := []struct {
+		repo string
+		want bool
+	}{
+		{"api", true},
+		{"old", false},
+		{"web", false},
+		{"lib-a", true},
+		{"lib-b", false},
+		{"unlisted", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.repo, func(t *testing.T) {
+			if got := app.checkIfRepoShouldBeIncluded(tt.repo); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSkipArchivedRepositories(t *testing.T) {
+	repos := []Repository{
+		{Name: "app"},
+		{Name: "old", Archived: true},
+		{Name: "off", Disabled: true},
+	}
+	tests := []struct {
+		name string
+		cfg  string
+		want []string
+		log  string
+	}{
+		{"default", `{"pull_request_depends_on":{"owner":"o","exclude_repositories":[]}}`, []string{"app"}, "count=2"},
+		{"include archived", `{"pull_request_depends_on":{"owner":"o","exclude_repositories":[],"include_archived":true}}`, []string{"app", "old", "off"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, tt.cfg)
+			logs := captureLogs(t, LogLevelInfo)
+			got := []string{}
+			for _, repo := range app.skipArchivedRepositories(repos) {
+				got = append(got, repo.Name)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if tt.log != "" && !strings.Contains(logs.String(), tt.log) {
+				t.Errorf("log %q does not contain %q", logs.String(), tt.log)
+			}
+			if tt.log == "" && logs.Len() > 0 {
+				t.Errorf("unexpected log %q", logs.String())
+			}
+		})
+	}
+}
+
+func TestParseAllowedCIDRs(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     string
+		wantErr bool
+	}{
+		{"none", `{}`, false},
+		{"ipv4 and ipv6", `{"allowed_cidrs":["192.30.252.0/22","2001:db8::/32"]}`, false},
+		{"address without mask", `{"allowed_cidrs":["192.30.252.1"]}`, true},
+		{"garbage", `{"allowed_cidrs":["github"]}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg Config
+			err := cfg.parseJSON([]byte(tt.cfg))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCompileRepositoryRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    DependsOnConditionRepository
+		wantErr bool
+	}{
+		{"plain", DependsOnConditionRepository{Name: "repo"}, false},
+		{"glob", DependsOnConditionRepository{Name: "team-*", Glob: true}, false},
+		{"invalid glob", DependsOnConditionRepository{Name: "team-[", Glob: true}, true},
+		{"invalid regexp", DependsOnConditionRepository{Name: "team-(", RegExp: true}, true},
+		{"glob and regexp", DependsOnConditionRepository{Name: "team-*", Glob: true, RegExp: true}, true},
+		{"topic only", DependsOnConditionRepository{Topic: "service"}, false},
+		{"visibility only", DependsOnConditionRepository{Visibility: "internal"}, false},
+		{"invalid visibility", DependsOnConditionRepository{Visibility: "secret"}, true},
+		{"empty", DependsOnConditionRepository{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.Compile()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetWebhookPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		paths    map[string]string
+		provider string
+		want     string
+	}{
+		{"default", nil, "github", "/"},
+		{"configured", map[string]string{"github": "/hooks/github"}, "github", "/hooks/github"},
+		{"without slash", map[string]string{"github": "hooks/github"}, "github", "/hooks/github"},
+		{"other provider", map[string]string{"gitlab": "/hooks/gitlab"}, "github", "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{WebhookPaths: tt.paths}
+			if got := c.GetWebhookPath(tt.provider); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigRedact(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    string
+		secret string
+	}{
+		{"webhook secret", `{"incoming_webhook_secret":"webhook-secret"}`, "webhook-secret"},
+		{"github token", `{"outgoing_github_token":"github-token"}`, "github-token"},
+		{"api token", `{"incoming_api_token_header":"X-T","incoming_api_token_value":"api-token"}`, "api-token"},
+		{"jenkins token", `{"jenkins":{"user":"u","token":"jenkins-token"}}`, "jenkins-token"},
+		{"s3 url", `{"cache_export":{"destination":"s3","s3_url":"https://bucket?X-Amz-Signature=s3-signature"}}`, "s3-signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, tt.cfg)
+
+			buf := captureLogs(t, LogLevelDebug)
+			app.triggerPRJob("a", 1)
+			if strings.Contains(buf.String(), tt.secret) {
+				t.Errorf("secret got logged: %s", buf.String())
+			}
+
+			dump, _ := json.Marshal(app.cfg.Redact())
+			if strings.Contains(string(dump), tt.secret) || !strings.Contains(string(dump), redactedValue) {
+				t.Errorf("secret was not masked: %s", dump)
+			}
+			original, _ := json.Marshal(app.cfg)
+			if !strings.Contains(string(original), tt.secret) {
+				t.Errorf("original config got modified")
+			}
+		})
+	}
+}
+
+func TestConfigWithDefaults(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     string
+		want    []string
+		notWant []string
+	}{
+		{
+			"defaults",
+			`{}`,
+			[]string{`"shutdown_timeout":30`, `"on_github_error":"closed"`, `"webhook_paths":{"github":"/"}`},
+			[]string{`"cache_flush_interval"`},
+		},
+		{
+			"explicit values kept",
+			`{"shutdown_timeout":5,"on_github_error":"open","webhook_paths":{"github":"/hook"}}`,
+			[]string{`"shutdown_timeout":5`, `"on_github_error":"open"`, `"webhook_paths":{"github":"/hook"}`},
+			[]string{},
+		},
+		{
+			"github client defaults",
+			`{}`,
+			[]string{`"github_timeout":30`, `"github_max_idle_conns_per_host":10`, `"github_idle_conn_timeout":90`},
+			[]string{},
+		},
+		{
+			"flush interval with cache file",
+			`{"cache_file":"/tmp/cache.json"}`,
+			[]string{`"cache_flush_interval":60`},
+			[]string{},
+		},
+		{
+			"secrets redacted",
+			`{"incoming_webhook_secret":"webhook-secret","outgoing_github_token":"github-token"}`,
+			[]string{`"incoming_webhook_secret":"` + redactedValue + `"`},
+			[]string{"webhook-secret", "github-token"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg Config
+			cfg.SetFromJSON([]byte(tt.cfg))
+			b, _ := json.Marshal(cfg.WithDefaults().Redact())
+			for _, want := range tt.want {
+				if !strings.Contains(string(b), want) {
+					t.Errorf("missing %s in %s", want, b)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(string(b), notWant) {
+					t.Errorf("unexpected %s in %s", notWant, b)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	depends := `"outgoing_github_token":"token","pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}`
+	tests := []struct {
+		name         string
+		config       string
+		wantProblems []string
+	}{
+		{"valid", `{"port":"8080",` + depends + `}`, []string{}},
+		{"webhooks only", `{"port":"8080"}`, []string{}},
+		{"missing port", `{` + depends + `}`, []string{"port is required"}},
+		{"port out of range", `{"port":"70000","admin_port":"0",` + depends + `}`, []string{"admin_port must be", "port must be"}},
+		{"non-numeric port", `{"port":"http",` + depends + `}`, []string{"port must be"}},
+		{"missing token", `{"port":"8080","pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`, []string{"outgoing_github_token is required"}},
+		{"missing owner", `{"port":"8080","outgoing_github_token":"token","pull_request_depends_on":{"repositories":[{"name":"*"}],"exclude_repositories":[]}}`, []string{"pull_request_depends_on.owner is required"}},
+		{"organization without owner", `{"port":"8080","outgoing_github_token":"token","pull_request_depends_on":{"organization":true,"repositories":[{"name":"*"}],"exclude_repositories":[]}}`, []string{"organization only tells"}},
+		{"no repository rules", `{"port":"8080","outgoing_github_token":"token","pull_request_depends_on":{"owner":"o","repositories":[],"exclude_repositories":[]}}`, []string{"at least one rule"}},
+		{"tls cert without key", `{"port":"8080","tls_cert_file":"cert.pem"}`, []string{"tls_cert_file and tls_key_file must be set together"}},
+		{"tls key without cert", `{"port":"8080","tls_key_file":"key.pem"}`, []string{"tls_cert_file and tls_key_file must be set together"}},
+		{"tls", `{"port":"8080","tls_cert_file":"cert.pem","tls_key_file":"key.pem"}`, []string{}},
+		{"metrics prefix", `{"port":"8080","metrics_prefix":"team_a:prd"}`, []string{}},
+		{"invalid metrics prefix", `{"port":"8080","metrics_prefix":"team-a"}`, []string{"metrics_prefix must be a valid Prometheus metric name"}},
+		{"log level and format", `{"port":"8080","log_level":"debug","log_format":"json"}`, []string{}},
+		{"invalid log level", `{"port":"8080","log_level":"verbose"}`, []string{"log_level must be one of"}},
+		{"invalid log format", `{"port":"8080","log_format":"xml"}`, []string{"log_format must be either text or json"}},
+		{"gob cache format", `{"port":"8080","cache_format":"gob"}`, []string{}},
+		{"invalid cache format", `{"port":"8080","cache_format":"xml"}`, []string{"cache_format must be either json or gob"}},
+		{"strict dependencies", `{"port":"8080","strict_dependencies":true,` + depends + `}`, []string{}},
+		{"strict dependencies without tracking", `{"port":"8080","strict_dependencies":true}`, []string{"strict_dependencies requires pull_request_depends_on"}},
+		{"missing exclude rules", `{"port":"8080","outgoing_github_token":"token","pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}]}}`, []string{"exclude_repositories is required"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg Config
+			cfg.SetFromJSON([]byte(tt.config))
+
+			logs := captureLogs(t, LogLevelInfo)
+			err := cfg.Validate()
+
+			if (err != nil) != (len(tt.wantProblems) > 0) {
+				t.Fatalf("got error %v, want %d problem(s)", err, len(tt.wantProblems))
+			}
+			if got := strings.Count(logs.String(), "Error in config: "); got != len(tt.wantProblems) {
+				t.Errorf("got %d logged problem(s), want %d:\n%s", got, len(tt.wantProblems), logs.String())
+			}
+			for _, want := range tt.wantProblems {
+				if !strings.Contains(logs.String(), want) {
+					t.Errorf("missing %q in:\n%s", want, logs.String())
+				}
+			}
+		})
+	}
+}
+
+func TestWriteConfigDump(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		wantErr     bool
+		wantOutput  string
+		wantProblem string
+	}{
+		{"valid", `{"port":"8080","outgoing_github_token":"secret"}`, false, `"outgoing_github_token": "` + redactedValue + `"`, ""},
+		{"missing port", `{}`, true, "", "port is required"},
+		{"invalid log level", `{"port":"8080","log_level":"verbose"}`, true, "", "log_level must be one of"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, tt.config)
+			logs := captureLogs(t, LogLevelInfo)
+			var b strings.Builder
+			err := app.writeConfigDump(&b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr && b.Len() > 0 {
+				t.Errorf("got output for invalid config:\n%s", b.String())
+			}
+			if !strings.Contains(b.String(), tt.wantOutput) {
+				t.Errorf("missing %q in:\n%s", tt.wantOutput, b.String())
+			}
+			if !strings.Contains(logs.String(), tt.wantProblem) {
+				t.Errorf("missing %q in logs:\n%s", tt.wantProblem, logs.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+)
+
+// DriftReport lists differences between the cache and pull requests open on
+// GitHub.
+type DriftReport struct {
+	// Missing are open on GitHub but not in the cache
+	Missing []BranchEntry `json:"missing"`
+	// Stale are in the cache but not open on GitHub
+	Stale []BranchEntry `json:"stale"`
+	// Branches are cached with another branch than the one on GitHub
+	Branches []BranchDrift  `json:"branches"`
+	Warnings []CacheWarning `json:"warnings,omitempty"`
+}
+
+type BranchDrift struct {
+	Repository   string `json:"repository"`
+	Number       int    `json:"number"`
+	CachedBranch string `json:"cached_branch"`
+	GitHubBranch string `json:"github_branch"`
+}
+
+// getDrift fetches open pull requests of matching repositories and compares
+// them with the cache, which is not modified. Repositories which pull requests
+// could not be fetched are skipped and reported in warnings.
+func (app *App) getDrift(ctx context.Context) (DriftReport, error) {
+	repos, err := app.getMatchingRepositories(ctx)
+	if err != nil {
+		return DriftReport{}, err
+	}
+
+	scanner := app.newScanner()
+	scanner.addRepositories(ctx, repos)
+	fetched := scanner.cache.Snapshot()
+	cached := app.cache.Snapshot()
+
+	report := DriftReport{
+		Missing:  []BranchEntry{},
+		Stale:    []BranchEntry{},
+		Branches: []BranchDrift{},
+		Warnings: fetched.Warnings,
+	}
+	failed := map[string]bool{}
+	for _, warning := range fetched.Warnings {
+		failed[warning.Repository] = true
+	}
+	included := map[string]bool{}
+	for _, repo := range repos {
+		included[repo] = true
+	}
+
+	for repo, prs := range fetched.Branches {
+		for num, branch := range prs {
+			cachedBranch, ok := cached.Branches[repo][num]
+			if !ok {
+				report.Missing = append(report.Missing, BranchEntry{Repository: repo, Number: num, Branch: branch})
+				continue
+			}
+			if cachedBranch != branch {
+				report.Branches = append(report.Branches, BranchDrift{Repository: repo, Number: num, CachedBranch: cachedBranch, GitHubBranch: branch})
+			}
+		}
+	}
+	for repo, prs := range cached.Branches {
+		if failed[repo] {
+			continue
+		}
+		for num, branch := range prs {
+			if _, ok := fetched.Branches[repo][num]; !ok || !included[repo] {
+				report.Stale = append(report.Stale, BranchEntry{Repository: repo, Number: num, Branch: branch})
+			}
+		}
+	}
+
+	sortBranchEntries(report.Missing)
+	sortBranchEntries(report.Stale)
+	sort.Slice(report.Branches, func(i, j int) bool {
+		if report.Branches[i].Repository != report.Branches[j].Repository {
+			return report.Branches[i].Repository < report.Branches[j].Repository
+		}
+		return report.Branches[i].Number < report.Branches[j].Number
+	})
+	return report, nil
+}
+
+// apiHandlerGetDrift compares the cache with GitHub without changing it, eg.
+// to check whether webhooks are delivered.
+func (app *App) apiHandlerGetDrift(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	if app.cfg.PullRequestDependsOn == nil {
+		app.writeFeatureDisabled(w, "PullRequestDependsOn is not configured")
+		return
+	}
+
+	report, err := app.getDrift(r.Context())
+	if err != nil {
+		logger.Error("Error checking drift", "error", err)
+		http.Error(w, "Error fetching repository list from GitHub", http.StatusBadGateway)
+		return
+	}
+	app.writeJSON(w, r, report)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAPIHandlerGetDrift(t *testing.T) {
+	tests := []struct {
+		name    string
+		failing []string
+		want    DriftReport
+	}{
+		{"drift", []string{}, DriftReport{
+			Missing:  []BranchEntry{{Repository: "bbb", Number: 3, Branch: "new"}},
+			Stale:    []BranchEntry{{Repository: "aaa", Number: 2, Branch: "branch-2"}, {Repository: "zzz", Number: 9, Branch: "branch-9"}},
+			Branches: []BranchDrift{{Repository: "aaa", Number: 1, CachedBranch: "branch-1", GitHubBranch: "renamed"}},
+		}},
+		{"failed repository skipped", []string{"aaa"}, DriftReport{
+			Missing:  []BranchEntry{{Repository: "bbb", Number: 3, Branch: "new"}},
+			Stale:    []BranchEntry{{Repository: "zzz", Number: 9, Branch: "branch-9"}},
+			Branches: []BranchDrift{},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responses := map[string]string{
+				"/orgs/o/repos":      `[{"name":"aaa"},{"name":"bbb"}]`,
+				"/repos/o/aaa/pulls": `[{"number":1,"head":{"ref":"renamed"},"body":""}]`,
+				"/repos/o/bbb/pulls": `[{"number":3,"head":{"ref":"new"},"body":""},{"number":4,"head":{"ref":"branch-4"},"body":""}]`,
+			}
+			for _, repo := range tt.failing {
+				delete(responses, "/repos/o/"+repo+"/pulls")
+			}
+			newTestGitHub(t, responses)
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","organization":true,"repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			openTestPullRequest(app, "aaa", 1)
+			openTestPullRequest(app, "aaa", 2)
+			openTestPullRequest(app, "bbb", 4)
+			openTestPullRequest(app, "zzz", 9)
+			before := app.cache.Snapshot().Branches
+
+			w := httptest.NewRecorder()
+			app.apiHandlerGetDrift(w, httptest.NewRequest("GET", "/drift", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d", w.Code)
+			}
+			var got DriftReport
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Warnings) != len(tt.failing) {
+				t.Errorf("got warnings %v, want %d", got.Warnings, len(tt.failing))
+			}
+			got.Warnings = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if after := app.cache.Snapshot().Branches; !reflect.DeepEqual(after, before) {
+				t.Errorf("cache changed from %v to %v", before, after)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type CacheEvent struct {
+	Action       string           `json:"action"`
+	Repository   string           `json:"repository"`
+	Number       int              `json:"number"`
+	Branch       string           `json:"branch,omitempty"`
+	Dependencies []PullRequestRef `json:"dependencies"`
+	Time         time.Time        `json:"time"`
+}
+
+// EventBroker fans cache change events out to subscribers, eg. clients of the
+// /events stream. Slow subscribers miss events instead of blocking updates.
+type EventBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan CacheEvent]struct{}
+	// done is closed when the daemon shuts down so that streams end instead of
+	// holding the server open until the shutdown timeout
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewEventBroker() *EventBroker {
+	broker := &EventBroker{
+		subscribers: map[chan CacheEvent]struct{}{},
+		done:        make(chan struct{}),
+	}
+	return broker
+}
+
+// Done returns a channel that is closed when the broker is closed.
+func (broker *EventBroker) Done() <-chan struct{} {
+	return broker.done
+}
+
+// Close tells subscribers to stop. It is safe to call more than once, eg. on
+// shutdown of both the main and the admin server.
+func (broker *EventBroker) Close() {
+	broker.closeOnce.Do(func() {
+		close(broker.done)
+	})
+}
+
+func (broker *EventBroker) Subscribe() chan CacheEvent {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	ch := make(chan CacheEvent, 16)
+	broker.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (broker *EventBroker) Unsubscribe(ch chan CacheEvent) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	delete(broker.subscribers, ch)
+}
+
+func (broker *EventBroker) Publish(event CacheEvent) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	for ch := range broker.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	CacheExportDestinationGist = "gist"
+	CacheExportDestinationS3   = "s3"
+)
+
+type CacheExporter struct {
+	cfg     CacheExportConfig
+	token   string
+	baseURL string
+	// gistID is the gist the cache is exported to. It is set when the gist
+	// gets created so that it is updated next time.
+	gistID string
+	// client is used for the GitHub API and s3Client for pre-signed URLs,
+	// which must not get the insecure TLS option meant for GitHub
+	client   *http.Client
+	s3Client *http.Client
+}
+
+func NewCacheExporter(cfg *Config) *CacheExporter {
+	exporter := &CacheExporter{
+		cfg:      *cfg.CacheExport,
+		token:    cfg.Token,
+		baseURL:  cfg.GetGitHubBaseURL(),
+		gistID:   cfg.CacheExport.GistID,
+		client:   newHTTPClient(cfg, cfg.InsecureSkipVerify),
+		s3Client: newHTTPClient(cfg, false),
+	}
+	return exporter
+}
+
+func (exporter *CacheExporter) Export(b []byte) error {
+	if exporter.cfg.Destination == CacheExportDestinationGist {
+		return exporter.exportToGist(b)
+	}
+	if exporter.cfg.Destination == CacheExportDestinationS3 {
+		return exporter.exportToS3(b)
+	}
+	return errors.New("Unknown cache export destination " + exporter.cfg.Destination)
+}
+
+func (exporter *CacheExporter) exportToGist(b []byte) error {
+	filename := exporter.cfg.GistFilename
+	if filename == "" {
+		filename = "github-pullrequestd-cache.json"
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"description": "github-pullrequestd cache",
+		"files": map[string]interface{}{
+			filename: map[string]string{
+				"content": string(b),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	method := "PATCH"
+	url := fmt.Sprintf("%s/gists/%s", exporter.baseURL, exporter.gistID)
+	if exporter.gistID == "" {
+		method = "POST"
+		url = exporter.baseURL + "/gists"
+	}
+
+	req, err := http.NewRequest(method, url, strings.NewReader(string(body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", exporter.token))
+	req.Header.Add("Accept", "application/vnd.github.v3+json")
+
+	resp, err := exporter.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	rb, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return errors.New(fmt.Sprintf("Got HTTP status %d from GitHub when exporting cache to gist", resp.StatusCode))
+	}
+
+	// remember the newly created gist so that it gets updated next time
+	if exporter.gistID == "" {
+		var j map[string]interface{}
+		err = json.Unmarshal(rb, &j)
+		if id, ok := j["id"].(string); err == nil && ok {
+			exporter.gistID = id
+			logger.Info("Created gist for cache export", "gist_id", id)
+		}
+	}
+	return nil
+}
+
+// exportToS3 uploads cache to a pre-signed S3 URL so that no AWS credentials
+// are needed in the daemon.
+func (exporter *CacheExporter) exportToS3(b []byte) error {
+	if exporter.cfg.S3URL == "" {
+		return errors.New("S3 URL for cache export is empty")
+	}
+
+	req, err := http.NewRequest("PUT", exporter.cfg.S3URL, strings.NewReader(string(b)))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := exporter.s3Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("Got HTTP status %d when exporting cache to S3", resp.StatusCode))
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheExporterExport(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        CacheExportConfig
+		status     int
+		response   string
+		wantMethod string
+		wantPath   string
+		wantGistID string
+		wantErr    bool
+	}{
+		{"create gist", CacheExportConfig{Destination: "gist"}, http.StatusCreated, `{"id":"abc"}`, "POST", "/gists", "abc", false},
+		{"update gist", CacheExportConfig{Destination: "gist", GistID: "abc"}, http.StatusOK, `{"id":"abc"}`, "PATCH", "/gists/abc", "abc", false},
+		{"gist error", CacheExportConfig{Destination: "gist"}, http.StatusForbidden, `{}`, "POST", "/gists", "", true},
+		{"s3", CacheExportConfig{Destination: "s3", S3URL: "/bucket/cache.json"}, http.StatusOK, ``, "PUT", "/bucket/cache.json", "", false},
+		{"s3 error", CacheExportConfig{Destination: "s3", S3URL: "/bucket/cache.json"}, http.StatusForbidden, ``, "PUT", "/bucket/cache.json", "", true},
+		{"unknown destination", CacheExportConfig{Destination: "ftp"}, http.StatusOK, ``, "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var method, path, body, authorization string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := ioutil.ReadAll(r.Body)
+				method, path, body, authorization = r.Method, r.URL.Path, string(b), r.Header.Get("Authorization")
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.response))
+			}))
+			defer server.Close()
+
+			cfg := tt.cfg
+			if cfg.S3URL != "" {
+				cfg.S3URL = server.URL + cfg.S3URL
+			}
+			exporter := NewCacheExporter(&Config{Token: "secret", BaseURL: server.URL, CacheExport: &cfg})
+
+			err := exporter.Export([]byte(`{"Version":"1"}`))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if method != tt.wantMethod || path != tt.wantPath {
+				t.Errorf("got request %s %s, want %s %s", method, path, tt.wantMethod, tt.wantPath)
+			}
+			if exporter.gistID != tt.wantGistID {
+				t.Errorf("got gist ID %q, want %q", exporter.gistID, tt.wantGistID)
+			}
+			if cfg.GistID != tt.cfg.GistID {
+				t.Errorf("got gist ID %q in config, want it unchanged", cfg.GistID)
+			}
+			if tt.wantMethod == "PUT" && body != `{"Version":"1"}` {
+				t.Errorf("got uploaded body %s", body)
+			}
+			if cfg.Destination == "gist" && authorization != "token secret" {
+				t.Errorf("got authorization header %q", authorization)
+			}
+		})
+	}
+}
+
+func TestCacheExporterGistCreatedOnce(t *testing.T) {
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":"abc"}`))
+	}))
+	defer server.Close()
+
+	exporter := NewCacheExporter(&Config{BaseURL: server.URL, CacheExport: &CacheExportConfig{Destination: "gist"}})
+	for i := 0; i < 3; i++ {
+		if err := exporter.Export([]byte(`{}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"POST /gists", "PATCH /gists/abc", "PATCH /gists/abc"}
+	if fmt.Sprint(requests) != fmt.Sprint(want) {
+		t.Errorf("got requests %v, want %v", requests, want)
+	}
+}
+
+func TestCacheExporterTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		destination string
+	}{
+		{"gist", "gist"},
+		{"s3", "s3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// the body is read so that a closed connection cancels the context
+				ioutil.ReadAll(r.Body)
+				select {
+				case <-time.After(5 * time.Second):
+				case <-r.Context().Done():
+				}
+			}))
+			defer server.Close()
+
+			exporter := NewCacheExporter(&Config{
+				BaseURL:       server.URL,
+				GitHubTimeout: 1,
+				CacheExport:   &CacheExportConfig{Destination: tt.destination, S3URL: server.URL + "/cache.json"},
+			})
+			start := time.Now()
+			if err := exporter.Export([]byte(`{}`)); err == nil {
+				t.Errorf("got no error from a hung server")
+			}
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("export took %v, want the timeout to fire after 1s", elapsed)
+			}
+		})
+	}
+}
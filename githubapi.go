@@ -1,130 +1,553 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type PullRequest struct {
-	Owner      string
-	Repository string
-	Number     int
-	Branch     string
-	DependsOn  []string
+	Owner         string
+	Repository    string
+	Number        int
+	Branch        string
+	State         string
+	Merged        bool
+	Draft         bool
+	DependsOn     []string
+	SoftDependsOn []string
+	Labels        []string
+	// Declared is true when the body has at least one DependsOn line or
+	// an explicit DependsOn:none
+	Declared bool
+}
+
+// Repository holds details of a repository that repository rules can match.
+type Repository struct {
+	Name       string
+	Topics     []string
+	Visibility string
+	Archived   bool
+	Disabled   bool
 }
 
 type GitHubAPI struct {
+	baseURL string
+	// disableRegex makes body parsing avoid regular expressions
+	disableRegex bool
+	// caseInsensitiveKeywords makes directives such as DependsOn match
+	// regardless of their case
+	caseInsensitiveKeywords bool
+	directives              *directiveRegexps
+	rateLimitRetries        int
+	rateLimitMaxWait        time.Duration
+	client                  *http.Client
 }
 
-func NewGitHubAPI() *GitHubAPI {
-	githubapi := &GitHubAPI{}
+func NewGitHubAPI(cfg *Config) *GitHubAPI {
+	githubapi := &GitHubAPI{
+		baseURL:                 cfg.GetGitHubBaseURL(),
+		disableRegex:            cfg.DisableRegex,
+		caseInsensitiveKeywords: cfg.CaseInsensitiveKeywords,
+		directives:              newDirectiveRegexps(cfg.CaseInsensitiveKeywords),
+		rateLimitRetries:        cfg.GetRateLimitRetries(),
+		rateLimitMaxWait:        cfg.GetRateLimitMaxWait(),
+	}
+	if cfg.InsecureSkipVerify {
+		logger.Warn("TLS certificate verification of the GitHub API is disabled")
+	}
+	githubapi.client = newHTTPClient(cfg, cfg.InsecureSkipVerify)
 	return githubapi
 }
 
-func (githubapi *GitHubAPI) GetRepositoriesList(owner string, organization bool, token string) ([]string, error) {
+// newHTTPClient returns a client with timeout and pooling settings of the
+// GitHub API client from the config. It has its own transport so that the
+// settings do not affect other clients.
+func newHTTPClient(cfg *Config, insecureSkipVerify bool) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = cfg.GetGitHubMaxIdleConnsPerHost()
+	transport.IdleConnTimeout = cfg.GetGitHubIdleConnTimeout()
+	if insecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	// a hung connection must not block the caller forever
+	return &http.Client{
+		Timeout:   cfg.GetGitHubTimeout(),
+		Transport: transport,
+	}
+}
+
+// url returns an API URL for the given path, which must start with a slash.
+func (githubapi *GitHubAPI) url(path string) string {
+	return githubapi.baseURL + path
+}
+
+func (githubapi *GitHubAPI) GetRepositoriesList(ctx context.Context, owner string, organization bool, token string) ([]Repository, error) {
+	ctx, span := tracer().Start(ctx, "GitHubAPI.GetRepositoriesList", trace.WithAttributes(attribute.String("github.owner", owner)))
+	defer span.End()
+
 	ownerType := "users"
 	if organization {
 		ownerType = "orgs"
 	}
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://api.github.com/%s/%s/repos?per_page=100", ownerType, owner), strings.NewReader(""))
+	items, err := githubapi.getList(ctx, githubapi.url(fmt.Sprintf("/%s/%s/repos?per_page=100", ownerType, owner)), token)
 	if err != nil {
-		return []string{}, err
+		return []Repository{}, err
 	}
 
-	req.Header.Add("Authorization", fmt.Sprintf("token %s", token))
-	req.Header.Add("Accept", "application/vnd.github.v3+json")
+	repos := []Repository{}
+	for _, v := range items {
+		repo := parseRepository(v.(map[string]interface{}))
+		if repo.Name != "" {
+			repos = append(repos, repo)
+			logger.Debug("Found repository", "owner", owner, "repo", repo.Name, "topics", strings.Join(repo.Topics, ","), "visibility", repo.Visibility)
+		}
+	}
 
-	c := &http.Client{}
-	resp, err := c.Do(req)
-	if err != nil {
-		return []string{}, err
+	return repos, nil
+}
+
+// parseRepository reads repository details from a repository object as
+// returned by the API and sent in webhook payloads.
+func parseRepository(v map[string]interface{}) Repository {
+	repo := Repository{}
+	repo.Name, _ = v["name"].(string)
+	if topics, ok := v["topics"].([]interface{}); ok {
+		for _, topic := range topics {
+			if s, ok := topic.(string); ok {
+				repo.Topics = append(repo.Topics, s)
+			}
+		}
 	}
+	repo.Archived, _ = v["archived"].(bool)
+	repo.Disabled, _ = v["disabled"].(bool)
+	repo.Visibility, _ = v["visibility"].(string)
+	// older API versions only tell whether the repository is private
+	if repo.Visibility == "" {
+		if private, ok := v["private"].(bool); ok {
+			repo.Visibility = "public"
+			if private {
+				repo.Visibility = "private"
+			}
+		}
+	}
+	return repo
+}
 
-	defer resp.Body.Close()
-	b, _ := ioutil.ReadAll(resp.Body)
+func (githubapi *GitHubAPI) GetPullRequestList(ctx context.Context, owner string, repo string, token string) ([]PullRequest, error) {
+	ctx, span := tracer().Start(ctx, "GitHubAPI.GetPullRequestList", trace.WithAttributes(
+		attribute.String("github.owner", owner),
+		attribute.String("github.repository", repo),
+	))
+	defer span.End()
 
-	var j interface{}
-	err = json.Unmarshal(b, &j)
+	items, err := githubapi.getList(ctx, githubapi.url(fmt.Sprintf("/repos/%s/%s/pulls?state=open&per_page=100", owner, repo)), token)
 	if err != nil {
-		return []string{}, errors.New("Got non-JSON pulls")
+		return []PullRequest{}, err
 	}
 
-	repos := []string{}
-	for _, v := range j.([]interface{}) {
-		if v.(map[string]interface{})["name"] != "" {
-			repos = append(repos, v.(map[string]interface{})["name"].(string))
-			log.Print(fmt.Sprintf("Found repository %s in owner %s", v.(map[string]interface{})["name"].(string), owner))
+	pulls := []PullRequest{}
+	for _, v := range items {
+		if v.(map[string]interface{})["number"] != "" {
+			pr := githubapi.parsePullRequest(owner, repo, v.(map[string]interface{}))
+			logger.Debug("Found open pull request", "owner", owner, "repo", repo, "num", pr.Number)
+			pulls = append(pulls, pr)
 		}
 	}
 
-	return repos, nil
+	return pulls, nil
 }
 
-func (githubapi *GitHubAPI) GetPullRequestList(owner string, repo string, token string) ([]PullRequest, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("https://api.github.com/repos/%s/%s/pulls?state=open&per_page=100", owner, repo), strings.NewReader(""))
-	if err != nil {
-		return []PullRequest{}, err
+// get sends a GET request to the GitHub API and returns the response along
+// with its body, which is already read. Responses saying that the rate limit
+// has been hit are retried up to rateLimitRetries times, waiting for as long
+// as GitHub asks but no longer than rateLimitMaxWait. Waiting stops when ctx
+// is cancelled.
+func (githubapi *GitHubAPI) get(ctx context.Context, url string, token string) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, strings.NewReader(""))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		req.Header.Add("Authorization", fmt.Sprintf("token %s", token))
+		req.Header.Add("Accept", "application/vnd.github.v3+json")
+
+		resp, err := githubapi.client.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if !isRateLimited(resp, b) {
+			return resp, b, nil
+		}
+		if attempt >= githubapi.rateLimitRetries {
+			return nil, nil, errors.New(fmt.Sprintf("GitHub API rate limit exceeded, gave up after %d retries", attempt))
+		}
+
+		wait := getRateLimitWait(resp, time.Now())
+		if wait > githubapi.rateLimitMaxWait {
+			wait = githubapi.rateLimitMaxWait
+		}
+		logger.Warn("Hit GitHub API rate limit. Retrying", "wait", wait, "attempt", attempt+1, "attempts", githubapi.rateLimitRetries)
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// isRateLimited returns true when GitHub refused the request due to its
+// primary or secondary rate limit.
+func isRateLimited(resp *http.Response, body []byte) bool {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		return false
+	}
+	return resp.Header.Get("X-RateLimit-Remaining") == "0" ||
+		resp.Header.Get("Retry-After") != "" ||
+		strings.Contains(strings.ToLower(string(body)), "rate limit")
+}
+
+// getRateLimitWait returns how long to wait before retrying a rate limited
+// request. Retry-After is preferred over X-RateLimit-Reset and when there is
+// neither, as with some secondary rate limits, a minute is used.
+func getRateLimitWait(resp *http.Response, now time.Time) time.Duration {
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err == nil && retryAfter >= 0 {
+		return time.Duration(retryAfter) * time.Second
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err == nil {
+		wait := time.Unix(reset, 0).Sub(now) + time.Second
+		if wait < time.Second {
+			wait = time.Second
+		}
+		return wait
+	}
+	return time.Minute
+}
+
+// getList fetches a list from the GitHub API, following the Link header
+// until the last page and accumulating items from all pages.
+func (githubapi *GitHubAPI) getList(ctx context.Context, url string, token string) ([]interface{}, error) {
+	items := []interface{}{}
+	for url != "" {
+		resp, b, err := githubapi.get(ctx, url, token)
+		if err != nil {
+			return []interface{}{}, err
+		}
+
+		var j []interface{}
+		err = json.Unmarshal(b, &j)
+		if err != nil {
+			return []interface{}{}, errors.New("Got non-JSON list")
+		}
+		items = append(items, j...)
+
+		url = getNextPageURL(resp.Header.Get("Link"))
 	}
+	return items, nil
+}
 
-	req.Header.Add("Authorization", fmt.Sprintf("token %s", token))
-	req.Header.Add("Accept", "application/vnd.github.v3+json")
+// getNextPageURL returns the URL with rel="next" from the Link header, eg.
+// <https://api.github.com/orgs/o/repos?page=2>; rel="next", <...>; rel="last"
+func getNextPageURL(link string) string {
+	for _, part := range strings.Split(link, ",") {
+		segments := strings.Split(strings.TrimSpace(part), ";")
+		if len(segments) < 2 {
+			continue
+		}
+		url := strings.TrimSpace(segments[0])
+		if !strings.HasPrefix(url, "<") || !strings.HasSuffix(url, ">") {
+			continue
+		}
+		for _, param := range segments[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return url[1 : len(url)-1]
+			}
+		}
+	}
+	return ""
+}
 
-	c := &http.Client{}
-	resp, err := c.Do(req)
+func (githubapi *GitHubAPI) GetPullRequest(ctx context.Context, owner string, repo string, number int, token string) (PullRequest, error) {
+	ctx, span := tracer().Start(ctx, "GitHubAPI.GetPullRequest", trace.WithAttributes(
+		attribute.String("github.owner", owner),
+		attribute.String("github.repository", repo),
+		attribute.Int("github.pull_request.number", number),
+	))
+	defer span.End()
+
+	resp, b, err := githubapi.get(ctx, githubapi.url(fmt.Sprintf("/repos/%s/%s/pulls/%d", owner, repo, number)), token)
 	if err != nil {
-		return []PullRequest{}, err
+		return PullRequest{}, err
 	}
 
-	defer resp.Body.Close()
-	b, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return PullRequest{}, errors.New(fmt.Sprintf("Got HTTP status %d when fetching pull request %s/%s#%d", resp.StatusCode, owner, repo, number))
+	}
 
-	var j interface{}
+	var j map[string]interface{}
 	err = json.Unmarshal(b, &j)
 	if err != nil {
-		return []PullRequest{}, errors.New("Got non-JSON pulls")
+		return PullRequest{}, errors.New("Got non-JSON pull")
 	}
 
-	pulls := []PullRequest{}
-	for _, v := range j.([]interface{}) {
-		if v.(map[string]interface{})["number"] != "" {
-			number := int(v.(map[string]interface{})["number"].(float64))
-			log.Print(fmt.Sprintf("Found open pull request %d in repo %s/%s", number, owner, repo))
-			branch := v.(map[string]interface{})["head"].(map[string]interface{})["ref"].(string)
-			body := ""
-			if v.(map[string]interface{})["body"] != nil {
-				body = v.(map[string]interface{})["body"].(string)
-			}
+	return githubapi.parsePullRequest(owner, repo, j), nil
+}
+
+func (githubapi *GitHubAPI) parsePullRequest(owner string, repo string, v map[string]interface{}) PullRequest {
+	number := int(v["number"].(float64))
+	branch := v["head"].(map[string]interface{})["ref"].(string)
+	body := ""
+	if v["body"] != nil {
+		body = v["body"].(string)
+	}
+	state := ""
+	if v["state"] != nil {
+		state = v["state"].(string)
+	}
+	merged := false
+	if v["merged"] != nil {
+		merged = v["merged"].(bool)
+	}
+	draft := false
+	if v["draft"] != nil {
+		draft = v["draft"].(bool)
+	}
+
+	dependsOn := githubapi.getDependsOnLinesFromBody(body)
+	softDependsOn := githubapi.getSoftDependsOnLinesFromBody(body)
 
-			dependsOn := githubapi.getDependsOnLinesFromBody(body)
+	return PullRequest{
+		Owner:         owner,
+		Repository:    repo,
+		Number:        number,
+		Branch:        branch,
+		State:         state,
+		Merged:        merged,
+		Draft:         draft,
+		DependsOn:     dependsOn,
+		SoftDependsOn: softDependsOn,
+		Labels:        getLabelNames(v),
+		Declared:      len(dependsOn) > 0 || githubapi.declaresNoDependencies(body),
+	}
+}
 
-			pulls = append(pulls, PullRequest{
-				Owner:      owner,
-				Repository: repo,
-				Number:     number,
-				Branch:     branch,
-				DependsOn:  dependsOn,
-			})
+// stripHTMLComments removes HTML comments from the body as PR templates often
+// contain instructions with example DependsOn lines inside them. A comment
+// that is not closed runs until the end of the body.
+func stripHTMLComments(body string) string {
+	var b strings.Builder
+	for {
+		start := strings.Index(body, "<!--")
+		if start == -1 {
+			b.WriteString(body)
+			return b.String()
+		}
+		b.WriteString(body[:start])
+		end := strings.Index(body[start+4:], "-->")
+		if end == -1 {
+			return b.String()
 		}
+		body = body[start+4+end+3:]
 	}
+}
 
-	return pulls, nil
+// directiveRegexp returns a regexp matching a dependency directive line, eg.
+// DependsOn:repo#42, in a relaxed way: the keyword may be written with a
+// hyphen (Depends-On) and whitespace is allowed around the colon and the hash.
+// With caseInsensitive the keyword matches regardless of its case. Submatches
+// are the repository, the optional path, the number and the optional
+// annotation.
+func directiveRegexp(keyword string, caseInsensitive bool) *regexp.Regexp {
+	if caseInsensitive {
+		keyword = "(?i:" + keyword + ")"
+	}
+	return regexp.MustCompile("^\\s*" + keyword + "\\s*:\\s*([A-Za-z0-9\\-_]{3,40})(/[A-Za-z0-9\\-_./]{1,200})?\\s*#\\s*([0-9]{1,10})(?:\\s*\\[([^\\[\\]]{1,100})\\])?\\s*$")
 }
 
-func (githubapi *GitHubAPI) getDependsOnLinesFromBody(body string) []string {
+// directiveRegexps holds regexps for all the directives built with the same
+// case sensitivity.
+type directiveRegexps struct {
+	dependsOn      *regexp.Regexp
+	softDependsOn  *regexp.Regexp
+	noDependencies *regexp.Regexp
+}
+
+func newDirectiveRegexps(caseInsensitive bool) *directiveRegexps {
+	none := "Depends-?On\\s*:\\s*none"
+	if caseInsensitive {
+		none = "(?i:" + none + ")"
+	}
+	return &directiveRegexps{
+		dependsOn:      directiveRegexp("Depends-?On", caseInsensitive),
+		softDependsOn:  directiveRegexp("SoftDepends-?On", caseInsensitive),
+		noDependencies: regexp.MustCompile("^\\s*" + none + "\\s*$"),
+	}
+}
+
+// parseDirectives returns dependencies declared in the body with one of the
+// keywords, normalized to repo#42, repo/path#42 or repo#42 [annotation]. Lines
+// are matched with re unless regular expressions are disabled.
+func (githubapi *GitHubAPI) parseDirectives(body string, keywords []string, re *regexp.Regexp) []string {
+	if githubapi.disableRegex {
+		return parseDirectivesLiteral(body, keywords, githubapi.caseInsensitiveKeywords)
+	}
+	return parseDirectivesRegexp(body, re)
+}
+
+func parseDirectivesRegexp(body string, re *regexp.Regexp) []string {
 	dependsOnLines := []string{}
-	lines := strings.Split(body, "\r\n")
-	for _, line := range lines {
-		m, _ := regexp.MatchString("^DependsOn:[a-z0-9\\-_]{3,40}#[0-9]{1,10}$", line)
-		if m {
-			dependsOnLine := strings.Split(line, ":")
-			dependsOnLines = append(dependsOnLines, dependsOnLine[1])
+	for _, line := range strings.Split(stripHTMLComments(body), "\n") {
+		m := re.FindStringSubmatch(line)
+		if m == nil {
+			continue
 		}
+		dependsOnLine := fmt.Sprintf("%s%s#%s", m[1], m[2], m[3])
+		if m[4] != "" {
+			dependsOnLine += " [" + m[4] + "]"
+		}
+		dependsOnLines = append(dependsOnLines, dependsOnLine)
 	}
 	return dependsOnLines
 }
+
+var dependsOnKeywords = []string{"DependsOn", "Depends-On"}
+var softDependsOnKeywords = []string{"SoftDependsOn", "SoftDepends-On"}
+
+// parseDirectivesLiteral does what parseDirectivesRegexp does, accepting the
+// same lines, but without regular expressions.
+func parseDirectivesLiteral(body string, keywords []string, caseInsensitive bool) []string {
+	dependsOnLines := []string{}
+	for _, line := range strings.Split(stripHTMLComments(body), "\n") {
+		value, ok := getDirectiveValue(line, keywords, caseInsensitive)
+		if !ok {
+			continue
+		}
+
+		annotation := ""
+		if strings.HasSuffix(value, "]") {
+			i := strings.LastIndex(value, "[")
+			if i == -1 {
+				continue
+			}
+			annotation = value[i+1 : len(value)-1]
+			if len(annotation) < 1 || len(annotation) > 100 || strings.ContainsAny(annotation, "[]") {
+				continue
+			}
+			value = strings.TrimSpace(value[:i])
+		}
+
+		vals := strings.Split(value, "#")
+		if len(vals) != 2 {
+			continue
+		}
+		repoPath := strings.TrimSpace(vals[0])
+		num := strings.TrimSpace(vals[1])
+		repo, path := splitDependencyKey(repoPath)
+		if !hasOnlyChars(repo, 3, 40, "-_") || !isNumber(num, 10) {
+			continue
+		}
+		if strings.Contains(repoPath, "/") && !hasOnlyChars(path, 1, 200, "-_./") {
+			continue
+		}
+
+		dependsOnLine := repoPath + "#" + num
+		if annotation != "" {
+			dependsOnLine += " [" + annotation + "]"
+		}
+		dependsOnLines = append(dependsOnLines, dependsOnLine)
+	}
+	return dependsOnLines
+}
+
+// getDirectiveValue returns what follows the colon when the line starts with
+// one of the keywords, compared case-insensitively with caseInsensitive.
+func getDirectiveValue(line string, keywords []string, caseInsensitive bool) (string, bool) {
+	i := strings.Index(line, ":")
+	if i == -1 {
+		return "", false
+	}
+	keyword := strings.TrimSpace(line[:i])
+	for _, k := range keywords {
+		if keyword == k || (caseInsensitive && strings.EqualFold(keyword, k)) {
+			return strings.TrimSpace(line[i+1:]), true
+		}
+	}
+	return "", false
+}
+
+// hasOnlyChars returns true when s is between min and max characters long and
+// consists of ASCII letters, digits and the extra characters only.
+func hasOnlyChars(s string, min int, max int, extra string) bool {
+	if len(s) < min || len(s) > max {
+		return false
+	}
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && !strings.ContainsRune(extra, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// isNumber returns true when s consists of 1 to max digits.
+func isNumber(s string, max int) bool {
+	if len(s) < 1 || len(s) > max {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// getDependsOnLinesFromBody returns hard dependencies, which block the pull
+// request until they are closed.
+func (githubapi *GitHubAPI) getDependsOnLinesFromBody(body string) []string {
+	return githubapi.parseDirectives(body, dependsOnKeywords, githubapi.directives.dependsOn)
+}
+
+// getSoftDependsOnLinesFromBody returns advisory dependencies, which are
+// tracked but never block the pull request.
+func (githubapi *GitHubAPI) getSoftDependsOnLinesFromBody(body string) []string {
+	return githubapi.parseDirectives(body, softDependsOnKeywords, githubapi.directives.softDependsOn)
+}
+
+// declaresNoDependencies returns true when the body explicitly states that
+// the pull request has no dependencies with a DependsOn:none line.
+func (githubapi *GitHubAPI) declaresNoDependencies(body string) bool {
+	for _, line := range strings.Split(stripHTMLComments(body), "\n") {
+		if githubapi.disableRegex {
+			value, ok := getDirectiveValue(line, dependsOnKeywords, githubapi.caseInsensitiveKeywords)
+			if ok && (value == "none" || (githubapi.caseInsensitiveKeywords && strings.EqualFold(value, "none"))) {
+				return true
+			}
+			continue
+		}
+		if githubapi.directives.noDependencies.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
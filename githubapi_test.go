@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGetDependsOnLinesFromBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"plain", "Fix\r\nDependsOn:bbb#2", []string{"bbb#2"}},
+		{"path qualified", "DependsOn:mono/services/api#2", []string{"mono/services/api#2"}},
+		{"annotated", "DependsOn:bbb#2 [JIRA-123]", []string{"bbb#2 [JIRA-123]"}},
+		{"annotation with colon", "DependsOn:bbb#2 [see: JIRA-123]", []string{"bbb#2 [see: JIRA-123]"}},
+		{"unterminated annotation", "DependsOn:bbb#2 [JIRA-123", []string{}},
+		{"nested annotation", "DependsOn:bbb#2 [[JIRA-123]]", []string{}},
+		{"inside comment", "<!--\r\nDependsOn:bbb#2\r\n-->\r\nFix", []string{}},
+		{"after comment", "<!-- e.g. DependsOn:bbb#2 -->\r\nDependsOn:ccc#3", []string{"ccc#3"}},
+		{"unterminated comment", "DependsOn:ccc#3\r\n<!--\r\nDependsOn:bbb#2", []string{"ccc#3"}},
+		{"two comments", "<!--\r\nDependsOn:bbb#2\r\n-->\r\nDependsOn:ccc#3\r\n<!--\r\nDependsOn:ddd#4\r\n-->", []string{"ccc#3"}},
+	}
+	githubAPI := NewGitHubAPI(&Config{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := githubAPI.getDependsOnLinesFromBody(tt.body)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetSoftDependsOnLinesFromBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantHard []string
+		wantSoft []string
+	}{
+		{"hard", "DependsOn:bbb#2", []string{"bbb#2"}, []string{}},
+		{"soft", "SoftDependsOn:bbb#2", []string{}, []string{"bbb#2"}},
+		{"mixed", "DependsOn:bbb#2\r\nSoftDependsOn:ccc#3\r\nSoftDependsOn:ddd#4", []string{"bbb#2"}, []string{"ccc#3", "ddd#4"}},
+	}
+	githubAPI := NewGitHubAPI(&Config{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := githubAPI.getDependsOnLinesFromBody(tt.body); !reflect.DeepEqual(got, tt.wantHard) {
+				t.Errorf("got hard %v, want %v", got, tt.wantHard)
+			}
+			if got := githubAPI.getSoftDependsOnLinesFromBody(tt.body); !reflect.DeepEqual(got, tt.wantSoft) {
+				t.Errorf("got soft %v, want %v", got, tt.wantSoft)
+			}
+		})
+	}
+}
+
+func TestGitHubAPIBaseURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		wantPath string
+	}{
+		{"public", "", "/orgs/o/repos"},
+		{"enterprise", "/api/v3", "/api/v3/orgs/o/repos"},
+		{"trailing slash", "/api/v3/", "/api/v3/orgs/o/repos"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var path string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+				w.Write([]byte(`[{"name":"app"}]`))
+			}))
+			defer server.Close()
+
+			var cfg Config
+			cfg.SetFromJSON([]byte(`{"github_base_url":"` + server.URL + tt.path + `"}`))
+			repos, err := NewGitHubAPI(&cfg).GetRepositoriesList(context.Background(), "o", true, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if path != tt.wantPath {
+				t.Errorf("got path %s, want %s", path, tt.wantPath)
+			}
+			if !reflect.DeepEqual(repos, []Repository{{Name: "app"}}) {
+				t.Errorf("got repositories %v", repos)
+			}
+		})
+	}
+}
+
+func TestParseRepository(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		want Repository
+	}{
+		{"name only", `{"name":"app"}`, Repository{Name: "app"}},
+		{"topics and visibility", `{"name":"app","topics":["a","b"],"visibility":"internal"}`, Repository{Name: "app", Topics: []string{"a", "b"}, Visibility: "internal"}},
+		{"private flag", `{"name":"app","private":true}`, Repository{Name: "app", Visibility: "private"}},
+		{"public flag", `{"name":"app","private":false}`, Repository{Name: "app", Visibility: "public"}},
+		{"archived and disabled", `{"name":"app","archived":true,"disabled":true}`, Repository{Name: "app", Archived: true, Disabled: true}},
+		{"visibility wins over flag", `{"name":"app","private":true,"visibility":"internal"}`, Repository{Name: "app", Visibility: "internal"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var j map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.json), &j); err != nil {
+				t.Fatal(err)
+			}
+			if got := parseRepository(j); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetNextPageURL(t *testing.T) {
+	tests := []struct {
+		name string
+		link string
+		want string
+	}{
+		{"no header", "", ""},
+		{"next and last", `<https://api.github.com/orgs/o/repos?page=2>; rel="next", <https://api.github.com/orgs/o/repos?page=3>; rel="last"`, "https://api.github.com/orgs/o/repos?page=2"},
+		{"next not first", `<https://api.github.com/orgs/o/repos?page=1>; rel="prev", <https://api.github.com/orgs/o/repos?page=3>; rel="next"`, "https://api.github.com/orgs/o/repos?page=3"},
+		{"last page", `<https://api.github.com/orgs/o/repos?page=1>; rel="first", <https://api.github.com/orgs/o/repos?page=2>; rel="prev"`, ""},
+		{"malformed", `https://api.github.com/orgs/o/repos?page=2; rel="next"`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getNextPageURL(tt.link); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGitHubAPIPagination(t *testing.T) {
+	tests := []struct {
+		name      string
+		pages     []string
+		wantRepos []string
+		wantPulls []int
+	}{
+		{"single page", []string{`[{"name":"aaa","number":1,"head":{"ref":"aaa"}}]`}, []string{"aaa"}, []int{1}},
+		{"two pages", []string{`[{"name":"aaa","number":1,"head":{"ref":"aaa"}},{"name":"bbb","number":2,"head":{"ref":"bbb"}}]`, `[{"name":"ccc","number":3,"head":{"ref":"ccc"}}]`}, []string{"aaa", "bbb", "ccc"}, []int{1, 2, 3}},
+		{"empty last page", []string{`[{"name":"aaa","number":1,"head":{"ref":"aaa"}}]`, `[]`}, []string{"aaa"}, []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			var server *httptest.Server
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				page := 1
+				if r.URL.Query().Get("page") != "" {
+					page, _ = strconv.Atoi(r.URL.Query().Get("page"))
+				}
+				if r.URL.Query().Get("per_page") != "100" {
+					t.Errorf("got per_page %q", r.URL.Query().Get("per_page"))
+				}
+				if page < len(tt.pages) {
+					w.Header().Set("Link", fmt.Sprintf(`<%s%s?per_page=100&page=%d>; rel="next", <%s%s?per_page=100&page=%d>; rel="last"`, server.URL, r.URL.Path, page+1, server.URL, r.URL.Path, len(tt.pages)))
+				}
+				w.Write([]byte(tt.pages[page-1]))
+			}))
+			defer server.Close()
+			githubAPI := NewGitHubAPI(&Config{BaseURL: server.URL})
+
+			repos, err := githubAPI.GetRepositoriesList(context.Background(), "o", true, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for _, repo := range repos {
+				names = append(names, repo.Name)
+			}
+			if !reflect.DeepEqual(names, tt.wantRepos) {
+				t.Errorf("got repositories %v, want %v", names, tt.wantRepos)
+			}
+			pulls, err := githubAPI.GetPullRequestList(context.Background(), "o", "aaa", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			nums := []int{}
+			for _, pr := range pulls {
+				nums = append(nums, pr.Number)
+			}
+			if !reflect.DeepEqual(nums, tt.wantPulls) {
+				t.Errorf("got pull requests %v, want %v", nums, tt.wantPulls)
+			}
+			if requests != 2*len(tt.pages) {
+				t.Errorf("got %d requests, want %d", requests, 2*len(tt.pages))
+			}
+		})
+	}
+}
+
+func TestGitHubAPIRateLimitRetry(t *testing.T) {
+	type response struct {
+		status  int
+		headers map[string]string
+		body    string
+	}
+	limited := response{http.StatusForbidden, map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": "0"}, `{"message":"API rate limit exceeded"}`}
+	ok := response{http.StatusOK, nil, `{"number":1,"head":{"ref":"aaa"}}`}
+	tests := []struct {
+		name         string
+		responses    []response
+		wantErr      bool
+		wantRequests int
+	}{
+		{"success", []response{ok}, false, 1},
+		{"primary rate limit", []response{limited, ok}, false, 2},
+		{"secondary rate limit", []response{{http.StatusForbidden, map[string]string{"Retry-After": "0"}, `{}`}, ok}, false, 2},
+		{"rate limit in body", []response{{http.StatusForbidden, nil, `{"message":"You have exceeded a secondary rate limit"}`}, ok}, false, 2},
+		{"too many requests", []response{{http.StatusTooManyRequests, map[string]string{"Retry-After": "0"}, `{}`}, ok}, false, 2},
+		{"gives up", []response{limited, limited, limited}, true, 3},
+		{"forbidden", []response{{http.StatusForbidden, nil, `{"message":"Resource not accessible"}`}, ok}, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				resp := tt.responses[requests]
+				requests++
+				for k, v := range resp.headers {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(resp.status)
+				w.Write([]byte(resp.body))
+			}))
+			defer server.Close()
+			githubAPI := NewGitHubAPI(&Config{BaseURL: server.URL, RateLimitRetries: 2})
+			githubAPI.rateLimitMaxWait = time.Millisecond
+
+			_, err := githubAPI.GetPullRequest(context.Background(), "o", "aaa", 1, "")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("got %d requests, want %d", requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestGitHubAPIInsecureSkipVerify(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"number":1,"head":{"ref":"aaa"}}`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name               string
+		insecureSkipVerify bool
+		wantErr            bool
+	}{
+		{"verified", false, true},
+		{"skipped", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			githubAPI := NewGitHubAPI(&Config{BaseURL: server.URL, InsecureSkipVerify: tt.insecureSkipVerify})
+			_, err := githubAPI.GetPullRequest(context.Background(), "o", "aaa", 1, "")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGitHubAPITimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		delay   time.Duration
+		wantErr bool
+	}{
+		{"fast server", 0, false},
+		{"slow server", 5 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(tt.delay):
+				case <-r.Context().Done():
+					return
+				}
+				w.Write([]byte(`{"number":1,"head":{"ref":"aaa"}}`))
+			}))
+			defer server.Close()
+
+			githubAPI := NewGitHubAPI(&Config{BaseURL: server.URL, GitHubTimeout: 1})
+			start := time.Now()
+			_, err := githubAPI.GetPullRequest(context.Background(), "o", "aaa", 1, "")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("request took %v, want the timeout to fire after 1s", elapsed)
+			}
+		})
+	}
+}
+
+func TestGetRateLimitWait(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    time.Duration
+	}{
+		{"retry after", map[string]string{"Retry-After": "30", "X-RateLimit-Reset": "2000"}, 30 * time.Second},
+		{"reset", map[string]string{"X-RateLimit-Reset": "1010"}, 11 * time.Second},
+		{"reset in the past", map[string]string{"X-RateLimit-Reset": "900"}, time.Second},
+		{"no headers", map[string]string{}, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			for k, v := range tt.headers {
+				resp.Header.Set(k, v)
+			}
+			if got := getRateLimitWait(resp, now); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelaxedDirectives(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantHard []string
+		wantSoft []string
+		wantNone bool
+	}{
+		{"strict", "DependsOn:bbb#2\r\nSoftDependsOn:ccc#3", []string{"bbb#2"}, []string{"ccc#3"}, false},
+		{"lower case keyword", "dependson: myrepo#42", []string{"myrepo#42"}, []string{}, false},
+		{"upper case keywords", "DEPENDSON:bbb#2\r\nSOFTDEPENDSON:ccc#3", []string{"bbb#2"}, []string{"ccc#3"}, false},
+		{"whitespace around colon and hash", "DependsOn : myrepo #42", []string{"myrepo#42"}, []string{}, false},
+		{"hyphenated alias", "Depends-On: myrepo#42\r\nSoft-Depends-On: ccc#3\r\nSoftDepends-On: ddd#4", []string{"myrepo#42"}, []string{"ddd#4"}, false},
+		{"mixed case repository", "DependsOn:MyRepo#42", []string{"MyRepo#42"}, []string{}, false},
+		{"path and annotation", "DependsOn: mono/services/api # 2 [JIRA-1]", []string{"mono/services/api#2 [JIRA-1]"}, []string{}, false},
+		{"unix line endings", "Fix\nDependsOn:bbb#2\nDependsOn:ccc#3", []string{"bbb#2", "ccc#3"}, []string{}, false},
+		{"indented", "  DependsOn:bbb#2  ", []string{"bbb#2"}, []string{}, false},
+		{"inline mention", "This DependsOn:bbb#2", []string{}, []string{}, false},
+		{"whitespace inside keyword", "Depends On:bbb#2", []string{}, []string{}, false},
+		{"short repository", "DependsOn:bb#2", []string{}, []string{}, false},
+		{"none", "depends-on : NONE", []string{}, []string{}, true},
+	}
+	for _, tt := range tests {
+		for _, disableRegex := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s disable_regex %v", tt.name, disableRegex), func(t *testing.T) {
+				githubAPI := NewGitHubAPI(&Config{CaseInsensitiveKeywords: true, DisableRegex: disableRegex})
+				if got := githubAPI.getDependsOnLinesFromBody(tt.body); !reflect.DeepEqual(got, tt.wantHard) {
+					t.Errorf("got hard %v, want %v", got, tt.wantHard)
+				}
+				if got := githubAPI.getSoftDependsOnLinesFromBody(tt.body); !reflect.DeepEqual(got, tt.wantSoft) {
+					t.Errorf("got soft %v, want %v", got, tt.wantSoft)
+				}
+				if got := githubAPI.declaresNoDependencies(tt.body); got != tt.wantNone {
+					t.Errorf("got declares none %v, want %v", got, tt.wantNone)
+				}
+			})
+		}
+	}
+}
+
+func TestCaseInsensitiveKeywords(t *testing.T) {
+	tests := []struct {
+		name            string
+		caseInsensitive bool
+		body            string
+		wantHard        []string
+		wantSoft        []string
+		wantNone        bool
+	}{
+		{"exact case", false, "DependsOn:bbb#2\r\nSoftDependsOn:ccc#3", []string{"bbb#2"}, []string{"ccc#3"}, false},
+		{"lower case ignored", false, "dependson:bbb#2\r\nsoftdependson:ccc#3\r\ndependson:none", []string{}, []string{}, false},
+		{"upper case none ignored", false, "DependsOn:NONE", []string{}, []string{}, false},
+		{"relaxed exact case", false, "Depends-On : bbb #2\r\nDependsOn:none", []string{"bbb#2"}, []string{}, true},
+		{"lower case", true, "dependson:bbb#2\r\nsoftdependson:ccc#3", []string{"bbb#2"}, []string{"ccc#3"}, false},
+		{"upper case", true, "DEPENDSON:bbb#2\r\nSOFTDEPENDSON:ccc#3", []string{"bbb#2"}, []string{"ccc#3"}, false},
+		{"mixed case", true, "dependsOn:bbb#2\r\nDepends-ON:ddd#4", []string{"bbb#2", "ddd#4"}, []string{}, false},
+		{"mixed case none", true, "DEPENDSON:None", []string{}, []string{}, true},
+	}
+	for _, tt := range tests {
+		for _, disableRegex := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s disable_regex %v", tt.name, disableRegex), func(t *testing.T) {
+				githubAPI := NewGitHubAPI(&Config{CaseInsensitiveKeywords: tt.caseInsensitive, DisableRegex: disableRegex})
+				if got := githubAPI.getDependsOnLinesFromBody(tt.body); !reflect.DeepEqual(got, tt.wantHard) {
+					t.Errorf("got hard %v, want %v", got, tt.wantHard)
+				}
+				if got := githubAPI.getSoftDependsOnLinesFromBody(tt.body); !reflect.DeepEqual(got, tt.wantSoft) {
+					t.Errorf("got soft %v, want %v", got, tt.wantSoft)
+				}
+				if got := githubAPI.declaresNoDependencies(tt.body); got != tt.wantNone {
+					t.Errorf("got declares none %v, want %v", got, tt.wantNone)
+				}
+			})
+		}
+	}
+}
+
+func TestDisableRegexBodyParsing(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantHard []string
+		wantSoft []string
+		wantNone bool
+	}{
+		{"plain", "Fix\r\nDependsOn:bbb#2", []string{"bbb#2"}, []string{}, false},
+		{"hyphenated", "Depends-On: bbb#2", []string{"bbb#2"}, []string{}, false},
+		{"path qualified", "DependsOn:mono/services/api#2", []string{"mono/services/api#2"}, []string{}, false},
+		{"annotated", "DependsOn:bbb#2 [JIRA-123]", []string{"bbb#2 [JIRA-123]"}, []string{}, false},
+		{"nested annotation", "DependsOn:bbb#2 [[JIRA-123]]", []string{}, []string{}, false},
+		{"soft", "SoftDependsOn:ccc#3", []string{}, []string{"ccc#3"}, false},
+		{"short repository", "DependsOn:bb#2", []string{}, []string{}, false},
+		{"not a number", "DependsOn:bbb#x", []string{}, []string{}, false},
+		{"inside comment", "<!--\r\nDependsOn:bbb#2\r\n-->\r\nDependsOn:ccc#3", []string{"ccc#3"}, []string{}, false},
+		{"unterminated comment", "DependsOn:ccc#3\r\n<!--\r\nDependsOn:bbb#2", []string{"ccc#3"}, []string{}, false},
+		{"none", "DependsOn: none", []string{}, []string{}, true},
+	}
+	literal := NewGitHubAPI(&Config{DisableRegex: true})
+	regex := NewGitHubAPI(&Config{})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := literal.getDependsOnLinesFromBody(tt.body); !reflect.DeepEqual(got, tt.wantHard) {
+				t.Errorf("got hard %v, want %v", got, tt.wantHard)
+			}
+			if got := literal.getSoftDependsOnLinesFromBody(tt.body); !reflect.DeepEqual(got, tt.wantSoft) {
+				t.Errorf("got soft %v, want %v", got, tt.wantSoft)
+			}
+			if got := literal.declaresNoDependencies(tt.body); got != tt.wantNone {
+				t.Errorf("got none %v, want %v", got, tt.wantNone)
+			}
+			if got := regex.getDependsOnLinesFromBody(tt.body); !reflect.DeepEqual(got, tt.wantHard) {
+				t.Errorf("regexp parsing got %v, want %v", got, tt.wantHard)
+			}
+		})
+	}
+}
@@ -1,13 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 )
 
+// maxPayloadSize caps the webhook request body and the body decompressed from
+// it. GitHub does not deliver payloads above 25 MB.
+var maxPayloadSize int64 = 25 << 20
+
+var errPayloadTooLarge = errors.New("payload too large")
+
 type GitHubPayload struct {
 }
 
@@ -20,20 +36,80 @@ func (githubPayload *GitHubPayload) GetEvent(r *http.Request) string {
 	return r.Header.Get("X-GitHub-Event")
 }
 
+func (githubPayload *GitHubPayload) GetDeliveryID(r *http.Request) string {
+	return r.Header.Get("X-GitHub-Delivery")
+}
+
+// DecodeBody returns the JSON payload from the raw request body. A gzip
+// Content-Encoding is decompressed and a form-encoded body, which GitHub sends
+// when the webhook content type is application/x-www-form-urlencoded, has the
+// JSON in its payload field. A body decompressed to more than maxPayloadSize
+// returns errPayloadTooLarge.
+func (githubPayload *GitHubPayload) DecodeBody(r *http.Request, raw []byte) ([]byte, error) {
+	b := raw
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, errors.New("invalid gzip payload")
+		}
+		defer gz.Close()
+		// a small body can decompress to a lot, so reading stops past the cap
+		b, err = ioutil.ReadAll(io.LimitReader(gz, maxPayloadSize+1))
+		if err != nil {
+			return nil, errors.New("invalid gzip payload")
+		}
+		if int64(len(b)) > maxPayloadSize {
+			return nil, errPayloadTooLarge
+		}
+	}
+	// senders like curl default to the form content type for JSON bodies so
+	// the body is used as it is when there is no payload field
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		values, err := url.ParseQuery(string(b))
+		if err == nil && values.Get("payload") != "" {
+			b = []byte(values.Get("payload"))
+		}
+	}
+	return b, nil
+}
+
 func (githubPayload *GitHubPayload) GetSignature(r *http.Request) string {
 	return r.Header.Get("X-Hub-Signature")
 }
 
-func (githubPayload *GitHubPayload) signBody(secret []byte, body []byte) []byte {
-	computed := hmac.New(sha1.New, secret)
+func (githubPayload *GitHubPayload) GetSignature256(r *http.Request) string {
+	return r.Header.Get("X-Hub-Signature-256")
+}
+
+func (githubPayload *GitHubPayload) signBody(h func() hash.Hash, secret []byte, body []byte) []byte {
+	computed := hmac.New(h, secret)
 	computed.Write(body)
 	return []byte(computed.Sum(nil))
 }
 
-func (githubPayload *GitHubPayload) VerifySignature(secret []byte, signature string, body *([]byte)) bool {
-	actual := make([]byte, 20)
-	hex.Decode(actual, []byte(signature[5:]))
-	return hmac.Equal(githubPayload.signBody(secret, *body), actual)
+// VerifySignature checks the sha256 signature and falls back to the legacy
+// sha1 one when the former is missing. It returns false when there is no
+// signature at all.
+func (githubPayload *GitHubPayload) VerifySignature(secret []byte, signature256 string, signature string, body *([]byte)) bool {
+	if signature256 != "" {
+		return githubPayload.verifyHexSignature(sha256.New, "sha256=", secret, signature256, *body)
+	}
+	if signature != "" {
+		return githubPayload.verifyHexSignature(sha1.New, "sha1=", secret, signature, *body)
+	}
+	return false
+}
+
+func (githubPayload *GitHubPayload) verifyHexSignature(h func() hash.Hash, prefix string, secret []byte, signature string, body []byte) bool {
+	if !strings.HasPrefix(signature, prefix) {
+		return false
+	}
+	actual, err := hex.DecodeString(signature[len(prefix):])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(githubPayload.signBody(h, secret, body), actual)
 }
 
 func (githubPayload *GitHubPayload) GetRef(j map[string]interface{}, event string) string {
@@ -52,16 +128,16 @@ func (githubPayload *GitHubPayload) GetRefType(j map[string]interface{}, event s
 }
 func (githubPayload *GitHubPayload) GetBranch(j map[string]interface{}, event string) string {
 	if event == "push" {
-		ref := strings.Split(j["ref"].(string), "/")
-		if ref[1] == "tag" {
+		// tags are pushed as refs/tags/ and branch names may contain slashes
+		ref, _ := j["ref"].(string)
+		if !strings.HasPrefix(ref, "refs/heads/") {
 			return ""
 		}
-		branch := ref[2]
-		return branch
+		return strings.TrimPrefix(ref, "refs/heads/")
 	}
 	if event == "create" || event == "delete" {
-		ref := j["ref"].(string)
-		refType := j["ref_type"].(string)
+		ref, _ := j["ref"].(string)
+		refType, _ := j["ref_type"].(string)
 		if refType != "branch" {
 			return ""
 		} else {
@@ -79,7 +155,7 @@ func (githubPayload *GitHubPayload) GetBranch(j map[string]interface{}, event st
 	return ""
 }
 func (githubPayload *GitHubPayload) GetAction(j map[string]interface{}, event string) string {
-	if event == "pull_request" {
+	if event == "pull_request" || event == "meta" || event == "installation" || event == "installation_repositories" {
 		if j["action"] != nil {
 			return j["action"].(string)
 		}
@@ -107,6 +183,40 @@ func (githubPayload *GitHubPayload) GetRepository(j map[string]interface{}, even
 	return ""
 }
 
+// GetRepositoryOwner returns login of the repository owner, ie. user or
+// organization.
+func (githubPayload *GitHubPayload) GetRepositoryOwner(j map[string]interface{}) string {
+	repo, ok := j["repository"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	owner, ok := repo["owner"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	login, _ := owner["login"].(string)
+	return login
+}
+
+// GetRepositoryDetails returns name, topics and visibility of the repository
+// the payload was sent for.
+func (githubPayload *GitHubPayload) GetRepositoryDetails(j map[string]interface{}) Repository {
+	repo, ok := j["repository"].(map[string]interface{})
+	if !ok {
+		return Repository{}
+	}
+	return parseRepository(repo)
+}
+
+func (githubPayload *GitHubPayload) GetDefaultBranch(j map[string]interface{}) string {
+	if j["repository"] != nil {
+		if j["repository"].(map[string]interface{})["default_branch"] != nil {
+			return j["repository"].(map[string]interface{})["default_branch"].(string)
+		}
+	}
+	return ""
+}
+
 func (githubPayload *GitHubPayload) GetPullRequestBody(j map[string]interface{}) string {
 	if j["pull_request"] != nil {
 		if j["pull_request"].(map[string]interface{})["body"] != nil {
@@ -115,6 +225,96 @@ func (githubPayload *GitHubPayload) GetPullRequestBody(j map[string]interface{})
 	}
 	return ""
 }
+
+// GetInstallationRepositories returns names of repositories listed under key
+// of an installation_repositories payload, ie. repositories_added or
+// repositories_removed.
+func (githubPayload *GitHubPayload) GetInstallationRepositories(j map[string]interface{}, key string) []string {
+	names := []string{}
+	repos, ok := j[key].([]interface{})
+	if !ok {
+		return names
+	}
+	for _, r := range repos {
+		repo, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, ok := repo["name"].(string)
+		if ok && name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// GetPullRequestMerged returns true when the pull request got merged, which is
+// set in payloads with the closed action.
+func (githubPayload *GitHubPayload) GetPullRequestMerged(j map[string]interface{}) bool {
+	if j["pull_request"] != nil {
+		if merged, ok := j["pull_request"].(map[string]interface{})["merged"].(bool); ok {
+			return merged
+		}
+	}
+	return false
+}
+
+// GetPullRequestLabels returns names of labels set on the pull request.
+func (githubPayload *GitHubPayload) GetPullRequestLabels(j map[string]interface{}) []string {
+	if j["pull_request"] != nil {
+		return getLabelNames(j["pull_request"].(map[string]interface{}))
+	}
+	return []string{}
+}
+
+func getLabelNames(pr map[string]interface{}) []string {
+	names := []string{}
+	labels, ok := pr["labels"].([]interface{})
+	if !ok {
+		return names
+	}
+	for _, l := range labels {
+		label, ok := l.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, ok := label["name"].(string)
+		if ok && name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// GetPullRequestUpdatedAt returns pull request's updated_at timestamp and
+// false when payload does not carry one.
+func (githubPayload *GitHubPayload) GetPullRequestUpdatedAt(j map[string]interface{}) (time.Time, bool) {
+	return githubPayload.getPullRequestTime(j, "updated_at")
+}
+
+// GetPullRequestActionTime returns when the action happened: closed_at for
+// closed, created_at for opened and updated_at for the other actions.
+func (githubPayload *GitHubPayload) GetPullRequestActionTime(j map[string]interface{}, action string) (time.Time, bool) {
+	switch action {
+	case "closed":
+		return githubPayload.getPullRequestTime(j, "closed_at")
+	case "opened":
+		return githubPayload.getPullRequestTime(j, "created_at")
+	}
+	return githubPayload.getPullRequestTime(j, "updated_at")
+}
+
+func (githubPayload *GitHubPayload) getPullRequestTime(j map[string]interface{}, field string) (time.Time, bool) {
+	if j["pull_request"] != nil {
+		if s, ok := j["pull_request"].(map[string]interface{})[field].(string); ok {
+			t, err := time.Parse(time.RFC3339, s)
+			if err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
 func (githubPayload *GitHubPayload) GetPullRequestNumber(j map[string]interface{}) float64 {
 	if j["number"] != nil {
 		return j["number"].(float64)
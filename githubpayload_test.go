@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func testSignature(h func() hash.Hash, prefix string, secret string, body string) string {
+	mac := hmac.New(h, []byte(secret))
+	mac.Write([]byte(body))
+	return prefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	body := `{"action":"opened"}`
+	tests := []struct {
+		name         string
+		body         string
+		signature256 string
+		signature    string
+		want         bool
+	}{
+		{"valid sha256", body, testSignature(sha256.New, "sha256=", "secret", body), "", true},
+		{"valid sha1", body, "", testSignature(sha1.New, "sha1=", "secret", body), true},
+		{"sha256 preferred over valid sha1", body, testSignature(sha256.New, "sha256=", "wrong", body), testSignature(sha1.New, "sha1=", "secret", body), false},
+		{"sha256 preferred over invalid sha1", body, testSignature(sha256.New, "sha256=", "secret", body), "sha1=00", true},
+		{"invalid sha256", body, testSignature(sha256.New, "sha256=", "wrong", body), "", false},
+		{"invalid sha1", body, "", testSignature(sha1.New, "sha1=", "wrong", body), false},
+		{"wrong prefix", body, testSignature(sha256.New, "sha1=", "secret", body), "", false},
+		{"not hex", body, "sha256=zz", "", false},
+		{"short header", body, "", "sha", false},
+		{"missing headers", body, "", "", false},
+		{"empty body signed", "", testSignature(sha256.New, "sha256=", "secret", ""), "", true},
+		{"empty body signed as other body", "", testSignature(sha256.New, "sha256=", "secret", body), "", false},
+		{"empty body unsigned", "", "", "", false},
+	}
+	githubPayload := NewGitHubPayload()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := []byte(tt.body)
+			if got := githubPayload.VerifySignature([]byte("secret"), tt.signature256, tt.signature, &b); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	body := `{"action":"opened"}`
+	tests := []struct {
+		name    string
+		headers map[string]string
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{"json", map[string]string{"Content-Type": "application/json"}, body, body, false},
+		{"no content type", map[string]string{}, body, body, false},
+		{"gzip", map[string]string{"Content-Encoding": "gzip"}, gzipString(body), body, false},
+		{"invalid gzip", map[string]string{"Content-Encoding": "gzip"}, body, "", true},
+		{"form", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, "payload=" + url.QueryEscape(body), body, false},
+		{"gzip form", map[string]string{"Content-Encoding": "gzip", "Content-Type": "application/x-www-form-urlencoded; charset=utf-8"}, gzipString("payload=" + url.QueryEscape(body)), body, false},
+		{"form without payload field", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, body, body, false},
+		{"form with other fields", map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, "a=1&b=2", "a=1&b=2", false},
+	}
+	githubPayload := NewGitHubPayload()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			got, err := githubPayload.DecodeBody(r, []byte(tt.raw))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetBranch(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		j     map[string]interface{}
+		want  string
+	}{
+		{"push to branch", "push", map[string]interface{}{"ref": "refs/heads/main"}, "main"},
+		{"push to branch with slash", "push", map[string]interface{}{"ref": "refs/heads/release/2.x"}, "release/2.x"},
+		{"push of tag", "push", map[string]interface{}{"ref": "refs/tags/main"}, ""},
+		{"push without ref", "push", map[string]interface{}{}, ""},
+		{"push with short ref", "push", map[string]interface{}{"ref": "main"}, ""},
+		{"push with invalid ref", "push", map[string]interface{}{"ref": 1}, ""},
+		{"create branch", "create", map[string]interface{}{"ref": "feature/x", "ref_type": "branch"}, "feature/x"},
+		{"create tag", "create", map[string]interface{}{"ref": "v1", "ref_type": "tag"}, ""},
+		{"delete without ref type", "delete", map[string]interface{}{"ref": "feature"}, ""},
+	}
+	githubPayload := NewGitHubPayload()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := githubPayload.GetBranch(tt.j, tt.event); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
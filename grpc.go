@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"github.com/gen64/github-pullrequestd/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// grpcService serves the same cache as the HTTP API to gRPC clients.
+type grpcService struct {
+	pb.UnimplementedPullRequestDServer
+	app *App
+}
+
+func (s *grpcService) GetCache(ctx context.Context, req *pb.GetCacheRequest) (*pb.GetCacheResponse, error) {
+	c := s.app.cache.Snapshot()
+	resp := &pb.GetCacheResponse{
+		Branches:         []*pb.Branch{},
+		Dependencies:     toPBDependencyEdges(c.Dependencies.Edges()),
+		SoftDependencies: toPBDependencyEdges(c.SoftDependencies.Edges()),
+		Version:          c.Version,
+	}
+	for _, b := range c.GetBranches() {
+		resp.Branches = append(resp.Branches, &pb.Branch{
+			Repository: b.Repository,
+			Number:     int64(b.Number),
+			Branch:     b.Branch,
+		})
+	}
+	return resp, nil
+}
+
+func (s *grpcService) GetDependencies(ctx context.Context, req *pb.PullRequestRef) (*pb.GetDependenciesResponse, error) {
+	c := s.app.cache.Snapshot()
+	return &pb.GetDependenciesResponse{
+		Dependencies:     toPBPullRequestRefs(c.Dependencies.Get(req.Repository, int(req.Number))),
+		SoftDependencies: toPBPullRequestRefs(c.SoftDependencies.Get(req.Repository, int(req.Number))),
+	}, nil
+}
+
+func (s *grpcService) GetDependents(ctx context.Context, req *pb.PullRequestRef) (*pb.GetDependentsResponse, error) {
+	c := s.app.cache.Snapshot()
+	return &pb.GetDependentsResponse{
+		Dependents: toPBPullRequestRefs(c.Dependents.Get(req.Repository, int(req.Number))),
+	}, nil
+}
+
+func toPBPullRequestRefs(prs []PullRequestRef) []*pb.PullRequestRef {
+	refs := []*pb.PullRequestRef{}
+	for _, pr := range prs {
+		refs = append(refs, &pb.PullRequestRef{Repository: pr.Repository, Number: int64(pr.Number), Path: pr.Path})
+	}
+	return refs
+}
+
+func toPBDependencyEdges(edges []DependencyEdge) []*pb.DependencyEdge {
+	pbEdges := []*pb.DependencyEdge{}
+	for _, e := range edges {
+		pbEdges = append(pbEdges, &pb.DependencyEdge{
+			Repository:          e.Repository,
+			Number:              int64(e.Number),
+			DependsOnRepository: e.DependsOnRepository,
+			DependsOnNumber:     int64(e.DependsOnNumber),
+			DependsOnPath:       e.DependsOnPath,
+		})
+	}
+	return pbEdges
+}
+
+// checkGRPCAPIToken applies the same API token as the HTTP API, read from
+// the request metadata under the configured header name.
+func (app *App) checkGRPCAPIToken(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	header, value := app.getAPIToken()
+	if header != "" && value != "" {
+		md, _ := metadata.FromIncomingContext(ctx)
+		values := md.Get(strings.ToLower(header))
+		if len(values) == 0 || values[0] != value {
+			return nil, status.Error(codes.Unauthenticated, "Invalid API token")
+		}
+	}
+	return handler(ctx, req)
+}
+
+// newGRPCServer returns a server using the same certificate as the HTTP API
+// when it is served over HTTPS, so that the API token is never sent in the
+// clear.
+func (app *App) newGRPCServer() (*grpc.Server, error) {
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(app.checkGRPCAPIToken)}
+	if app.cfg.IsTLSEnabled() {
+		creds, err := credentials.NewServerTLSFromFile(app.cfg.TLSCertFile, app.cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	server := grpc.NewServer(opts...)
+	pb.RegisterPullRequestDServer(server, &grpcService{app: app})
+	return server, nil
+}
+
+func (app *App) startGRPC() {
+	l, err := app.listen(":" + app.cfg.GRPCPort)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	app.grpcServer, err = app.newGRPCServer()
+	if err != nil {
+		logger.Fatal("Error loading TLS certificate for gRPC", "error", err)
+	}
+
+	logger.Info("Starting gRPC server...", "port", app.cfg.GRPCPort, "tls", app.cfg.IsTLSEnabled())
+	go func() {
+		err := app.grpcServer.Serve(l)
+		if err != nil {
+			logger.Fatal("Error serving gRPC", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/gen64/github-pullrequestd/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestGRPCClient serves the app over an in-memory gRPC connection.
+func newTestGRPCClient(t *testing.T, app *App) pb.PullRequestDClient {
+	return newTestGRPCClientWithCreds(t, app, insecure.NewCredentials())
+}
+
+func newTestGRPCClientWithCreds(t *testing.T, app *App, creds credentials.TransportCredentials) pb.PullRequestDClient {
+	l := bufconn.Listen(1024 * 1024)
+	server, err := app.newGRPCServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(creds),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewPullRequestDClient(conn)
+}
+
+func TestGRPCService(t *testing.T) {
+	app := newTestApp(t, `{"incoming_api_token_header":"X-T","incoming_api_token_value":"one"}`)
+	openTestPullRequest(app, "b", 2)
+	openTestPullRequest(app, "b", 3)
+	openTestPullRequest(app, "a", 1, "b#2", "b#3")
+	client := newTestGRPCClient(t, app)
+	authorized := metadata.AppendToOutgoingContext(context.Background(), "x-t", "one")
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		call     func(ctx context.Context) (int, error)
+		wantLen  int
+		wantCode codes.Code
+	}{
+		{
+			"cache",
+			authorized,
+			func(ctx context.Context) (int, error) {
+				resp, err := client.GetCache(ctx, &pb.GetCacheRequest{})
+				return len(resp.GetBranches()) + len(resp.GetDependencies()), err
+			},
+			5,
+			codes.OK,
+		},
+		{
+			"dependencies",
+			authorized,
+			func(ctx context.Context) (int, error) {
+				resp, err := client.GetDependencies(ctx, &pb.PullRequestRef{Repository: "a", Number: 1})
+				return len(resp.GetDependencies()), err
+			},
+			2,
+			codes.OK,
+		},
+		{
+			"dependents",
+			authorized,
+			func(ctx context.Context) (int, error) {
+				resp, err := client.GetDependents(ctx, &pb.PullRequestRef{Repository: "b", Number: 2})
+				return len(resp.GetDependents()), err
+			},
+			1,
+			codes.OK,
+		},
+		{
+			"missing token",
+			context.Background(),
+			func(ctx context.Context) (int, error) {
+				_, err := client.GetCache(ctx, &pb.GetCacheRequest{})
+				return 0, err
+			},
+			0,
+			codes.Unauthenticated,
+		},
+		{
+			"invalid token",
+			metadata.AppendToOutgoingContext(context.Background(), "x-t", "two"),
+			func(ctx context.Context) (int, error) {
+				_, err := client.GetDependents(ctx, &pb.PullRequestRef{Repository: "b", Number: 2})
+				return 0, err
+			},
+			0,
+			codes.Unauthenticated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := tt.call(tt.ctx)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("got code %s, want %s", status.Code(err), tt.wantCode)
+			}
+			if n != tt.wantLen {
+				t.Errorf("got %d entries, want %d", n, tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestGRPCServerTLS(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	tests := []struct {
+		name     string
+		tls      bool
+		creds    credentials.TransportCredentials
+		wantCode codes.Code
+	}{
+		{"plaintext", false, insecure.NewCredentials(), codes.OK},
+		{"tls", true, credentials.NewTLS(&tls.Config{InsecureSkipVerify: true}), codes.OK},
+		{"plaintext client of tls server", true, insecure.NewCredentials(), codes.Unavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := `{}`
+			if tt.tls {
+				cfg = fmt.Sprintf(`{"tls_cert_file":%q,"tls_key_file":%q}`, certFile, keyFile)
+			}
+			app := newTestApp(t, cfg)
+			client := newTestGRPCClientWithCreds(t, app, tt.creds)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err := client.GetCache(ctx, &pb.GetCacheRequest{})
+			if status.Code(err) != tt.wantCode {
+				t.Errorf("got code %s, want %s", status.Code(err), tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestGRPCServerInvalidCertificate(t *testing.T) {
+	app := newTestApp(t, `{"tls_cert_file":"missing.pem","tls_key_file":"missing.pem"}`)
+	if _, err := app.newGRPCServer(); err == nil {
+		t.Errorf("got no error")
+	}
+}
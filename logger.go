@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+var logLevels = map[string]int{
+	LogLevelDebug: 0,
+	LogLevelInfo:  1,
+	LogLevelWarn:  2,
+	LogLevelError: 3,
+}
+
+// Logger writes leveled log lines with key-value fields, eg. repo and num,
+// either as text or as one JSON object per line.
+type Logger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level int
+	json  bool
+}
+
+// logger is used for all logging. It logs text from info level up until it is
+// configured with the config.
+var logger = NewLogger(os.Stderr)
+
+func NewLogger(out io.Writer) *Logger {
+	l := &Logger{
+		out:   out,
+		level: logLevels[LogLevelInfo],
+	}
+	return l
+}
+
+// Configure sets the lowest level that is logged and the format. Unknown
+// level is ignored as it is reported by config validation.
+func (l *Logger) Configure(level string, format string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n, ok := logLevels[level]
+	if ok {
+		l.level = n
+	}
+	l.json = format == LogFormatJSON
+}
+
+// IsEnabled returns true when lines of the level get logged, so that costly
+// fields can be skipped otherwise.
+func (l *Logger) IsEnabled(level string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return logLevels[level] >= l.level
+}
+
+// Debug logs msg with fields given as key-value pairs.
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.write(LogLevelDebug, msg, kv)
+}
+
+// Info logs msg with fields given as key-value pairs.
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.write(LogLevelInfo, msg, kv)
+}
+
+// Warn logs msg with fields given as key-value pairs.
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.write(LogLevelWarn, msg, kv)
+}
+
+// Error logs msg with fields given as key-value pairs.
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.write(LogLevelError, msg, kv)
+}
+
+// Fatal logs msg at error level and exits.
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.write(LogLevelError, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) write(level string, msg string, kv []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if logLevels[level] < l.level {
+		return
+	}
+
+	now := time.Now()
+	if l.json {
+		entry := map[string]interface{}{
+			"time":  now.UTC().Format(time.RFC3339Nano),
+			"level": level,
+			"msg":   msg,
+		}
+		for i := 0; i+1 < len(kv); i += 2 {
+			entry[fmt.Sprint(kv[i])] = logValue(kv[i+1])
+		}
+		b, err := json.Marshal(entry)
+		if err != nil {
+			b, _ = json.Marshal(map[string]interface{}{"time": entry["time"], "level": level, "msg": msg})
+		}
+		fmt.Fprintf(l.out, "%s\n", b)
+		return
+	}
+
+	line := now.Format("2006/01/02 15:04:05") + " " + strings.ToUpper(level) + " " + msg
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := fmt.Sprint(logValue(kv[i+1]))
+		if v == "" || strings.ContainsAny(v, " \"=") {
+			v = strconv.Quote(v)
+		}
+		line += fmt.Sprintf(" %v=%s", kv[i], v)
+	}
+	fmt.Fprintf(l.out, "%s\n", line)
+}
+
+// logValue converts values that would not be readable in JSON, such as errors
+// and durations, to strings.
+func logValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case error:
+		return t.Error()
+	case fmt.Stringer:
+		return t.String()
+	}
+	return v
+}
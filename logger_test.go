@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoggerLevels(t *testing.T) {
+	tests := []struct {
+		level string
+		want  []string
+	}{
+		{LogLevelDebug, []string{"DEBUG d", "INFO i", "WARN w", "ERROR e"}},
+		{LogLevelInfo, []string{"INFO i", "WARN w", "ERROR e"}},
+		{LogLevelWarn, []string{"WARN w", "ERROR e"}},
+		{LogLevelError, []string{"ERROR e"}},
+		{"unknown", []string{"INFO i", "WARN w", "ERROR e"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			var b bytes.Buffer
+			l := NewLogger(&b)
+			l.Configure(tt.level, LogFormatText)
+			l.Debug("d")
+			l.Info("i")
+			l.Warn("w")
+			l.Error("e")
+
+			lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+			if len(lines) != len(tt.want) {
+				t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(tt.want), b.String())
+			}
+			for i, want := range tt.want {
+				if !strings.HasSuffix(lines[i], " "+want) {
+					t.Errorf("got %q, want it to end with %q", lines[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoggerFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		kv     []interface{}
+		want   string
+	}{
+		{"text", LogFormatText, []interface{}{"repo", "app", "num", 1}, "INFO msg repo=app num=1"},
+		{"text quoted", LogFormatText, []interface{}{"error", errors.New("not found"), "body", ""}, `INFO msg error="not found" body=""`},
+		{"text odd fields", LogFormatText, []interface{}{"repo", "app", "num"}, "INFO msg repo=app"},
+		{"json", LogFormatJSON, []interface{}{"repo", "app", "num", 1, "took", time.Second, "error", errors.New("failed")}, `{"error":"failed","level":"info","msg":"msg","num":1,"repo":"app","took":"1s"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			l := NewLogger(&b)
+			l.Configure(LogLevelInfo, tt.format)
+			l.Info("msg", tt.kv...)
+
+			got := strings.TrimSpace(b.String())
+			if tt.format == LogFormatJSON {
+				entry := map[string]interface{}{}
+				if err := json.Unmarshal([]byte(got), &entry); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := time.Parse(time.RFC3339Nano, entry["time"].(string)); err != nil {
+					t.Errorf("got invalid time %v", entry["time"])
+				}
+				delete(entry, "time")
+				normalized, _ := json.Marshal(entry)
+				got = string(normalized)
+				if got != tt.want {
+					t.Errorf("got %s, want %s", got, tt.want)
+				}
+				return
+			}
+			if !strings.HasSuffix(got, " "+tt.want) {
+				t.Errorf("got %q, want it to end with %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoggerIsEnabled(t *testing.T) {
+	tests := []struct {
+		level string
+		want  map[string]bool
+	}{
+		{LogLevelDebug, map[string]bool{LogLevelDebug: true, LogLevelInfo: true, LogLevelError: true}},
+		{LogLevelInfo, map[string]bool{LogLevelDebug: false, LogLevelInfo: true, LogLevelError: true}},
+		{LogLevelError, map[string]bool{LogLevelDebug: false, LogLevelInfo: false, LogLevelError: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			l := NewLogger(&bytes.Buffer{})
+			l.Configure(tt.level, LogFormatText)
+			for level, want := range tt.want {
+				if got := l.IsEnabled(level); got != want {
+					t.Errorf("got %s enabled %v, want %v", level, got, want)
+				}
+			}
+		})
+	}
+}
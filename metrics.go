@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	h := &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type Metrics struct {
+	mu                       sync.Mutex
+	webhookProcessingSeconds map[string]*Histogram
+	httpRequests             map[httpRequestLabels]uint64
+	httpRequestSeconds       map[httpRequestLabels]*Histogram
+	webhookEvents            map[webhookEventLabels]uint64
+	cacheUpdates             map[string]uint64
+	signatureFailures        uint64
+	cachePersistErrors       uint64
+	// lastWebhook is when the last webhook was received, or when metrics
+	// were created if none was received yet
+	lastWebhook time.Time
+}
+
+type httpRequestLabels struct {
+	method string
+	route  string
+	status int
+}
+
+type webhookEventLabels struct {
+	event  string
+	action string
+}
+
+// metricEvents and metricActions bound the label values taken from webhook
+// payloads, anything else is counted as other.
+var metricEvents = map[string]bool{
+	"check_run": true, "check_suite": true, "create": true, "delete": true,
+	"installation": true, "installation_repositories": true, "issue_comment": true,
+	"label": true, "meta": true, "ping": true, "pull_request": true,
+	"pull_request_review": true, "pull_request_review_comment": true,
+	"pull_request_target": true, "push": true, "repository": true, "status": true,
+}
+
+var metricActions = map[string]bool{
+	"": true, "added": true, "archived": true, "assigned": true,
+	"auto_merge_disabled": true, "auto_merge_enabled": true, "closed": true,
+	"converted_to_draft": true, "created": true, "deleted": true,
+	"demilestoned": true, "dequeued": true, "edited": true, "enqueued": true,
+	"labeled": true, "locked": true, "milestoned": true, "opened": true,
+	"ready_for_review": true, "removed": true, "renamed": true, "reopened": true,
+	"review_request_removed": true, "review_requested": true, "suspend": true,
+	"synchronize": true, "unarchived": true, "unassigned": true,
+	"unlabeled": true, "unlocked": true, "unsuspend": true,
+}
+
+func getMetricLabel(v string, known map[string]bool) string {
+	if known[v] {
+		return v
+	}
+	return "other"
+}
+
+var labelValueReplacer = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// escapeLabelValue escapes a label value as required by the Prometheus text
+// exposition format.
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+func NewMetrics() *Metrics {
+	metrics := &Metrics{
+		webhookProcessingSeconds: map[string]*Histogram{},
+		httpRequests:             map[httpRequestLabels]uint64{},
+		httpRequestSeconds:       map[httpRequestLabels]*Histogram{},
+		webhookEvents:            map[webhookEventLabels]uint64{},
+		cacheUpdates:             map[string]uint64{},
+		lastWebhook:              time.Now(),
+	}
+	return metrics
+}
+
+// ObserveHTTPRequest counts an API request and its duration. Duration is
+// labeled only by method and route to keep the number of series low.
+func (metrics *Metrics) ObserveHTTPRequest(method string, route string, status int, d time.Duration) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	metrics.httpRequests[httpRequestLabels{method: method, route: route, status: status}]++
+
+	labels := httpRequestLabels{method: method, route: route}
+	_, hasKey := metrics.httpRequestSeconds[labels]
+	if !hasKey {
+		metrics.httpRequestSeconds[labels] = NewHistogram(defaultLatencyBuckets)
+	}
+	metrics.httpRequestSeconds[labels].Observe(d.Seconds())
+}
+
+// ObserveWebhookEvent counts a parsed webhook payload. Unknown events and
+// actions are counted as other.
+func (metrics *Metrics) ObserveWebhookEvent(event string, action string) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	labels := webhookEventLabels{
+		event:  getMetricLabel(event, metricEvents),
+		action: getMetricLabel(action, metricActions),
+	}
+	metrics.webhookEvents[labels]++
+}
+
+// ObserveSignatureFailure counts a webhook rejected due to its signature.
+func (metrics *Metrics) ObserveSignatureFailure() {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	metrics.signatureFailures++
+}
+
+// ObserveCachePersistError counts a failed attempt to save the cache file.
+func (metrics *Metrics) ObserveCachePersistError() {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	metrics.cachePersistErrors++
+}
+
+// ObserveCacheUpdate counts a change applied to the cache.
+func (metrics *Metrics) ObserveCacheUpdate(action string) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	metrics.cacheUpdates[getMetricLabel(action, metricActions)]++
+}
+
+// ObserveWebhookReceived resets the time since the last webhook.
+func (metrics *Metrics) ObserveWebhookReceived() {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	metrics.lastWebhook = time.Now()
+}
+
+func (metrics *Metrics) ObserveWebhookProcessing(event string, d time.Duration) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	event = getMetricLabel(event, metricEvents)
+	_, hasKey := metrics.webhookProcessingSeconds[event]
+	if !hasKey {
+		metrics.webhookProcessingSeconds[event] = NewHistogram(defaultLatencyBuckets)
+	}
+	metrics.webhookProcessingSeconds[event].Observe(d.Seconds())
+}
+
+// Write outputs all metrics in the Prometheus text exposition format, with
+// names starting with prefix.
+func (metrics *Metrics) Write(w io.Writer, prefix string) {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	name := prefix + "_webhook_processing_seconds"
+	fmt.Fprintf(w, "# HELP %s Time spent processing webhook payloads.\n", name)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	events := []string{}
+	for event := range metrics.webhookProcessingSeconds {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	for _, event := range events {
+		h := metrics.webhookProcessingSeconds[event]
+		e := escapeLabelValue(event)
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{event=\"%s\",le=\"%g\"} %d\n", name, e, b, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{event=\"%s\",le=\"+Inf\"} %d\n", name, e, h.count)
+		fmt.Fprintf(w, "%s_sum{event=\"%s\"} %g\n", name, e, h.sum)
+		fmt.Fprintf(w, "%s_count{event=\"%s\"} %d\n", name, e, h.count)
+	}
+
+	name = prefix + "_webhook_events_total"
+	fmt.Fprintf(w, "# HELP %s Webhook payloads by event and action.\n", name)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	webhookEvents := []webhookEventLabels{}
+	for l := range metrics.webhookEvents {
+		webhookEvents = append(webhookEvents, l)
+	}
+	sort.Slice(webhookEvents, func(i, j int) bool {
+		if webhookEvents[i].event != webhookEvents[j].event {
+			return webhookEvents[i].event < webhookEvents[j].event
+		}
+		return webhookEvents[i].action < webhookEvents[j].action
+	})
+	for _, l := range webhookEvents {
+		fmt.Fprintf(w, "%s{event=\"%s\",action=\"%s\"} %d\n", name, escapeLabelValue(l.event), escapeLabelValue(l.action), metrics.webhookEvents[l])
+	}
+
+	name = prefix + "_webhook_signature_failures_total"
+	fmt.Fprintf(w, "# HELP %s Webhook payloads rejected due to an invalid signature.\n", name)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	fmt.Fprintf(w, "%s %d\n", name, metrics.signatureFailures)
+
+	name = prefix + "_cache_persist_errors_total"
+	fmt.Fprintf(w, "# HELP %s Failed attempts to save the cache file.\n", name)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	fmt.Fprintf(w, "%s %d\n", name, metrics.cachePersistErrors)
+
+	name = prefix + "_cache_updates_total"
+	fmt.Fprintf(w, "# HELP %s Pull request changes applied to the cache by action.\n", name)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	actions := []string{}
+	for action := range metrics.cacheUpdates {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	for _, action := range actions {
+		fmt.Fprintf(w, "%s{action=\"%s\"} %d\n", name, escapeLabelValue(action), metrics.cacheUpdates[action])
+	}
+
+	name = prefix + "_seconds_since_last_webhook"
+	fmt.Fprintf(w, "# HELP %s Time since the last webhook was received.\n", name)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	fmt.Fprintf(w, "%s %g\n", name, time.Since(metrics.lastWebhook).Seconds())
+
+	name = prefix + "_http_requests_total"
+	fmt.Fprintf(w, "# HELP %s API requests by method, route and status.\n", name)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	for _, l := range sortHTTPRequestLabels(metrics.httpRequests) {
+		fmt.Fprintf(w, "%s{method=\"%s\",route=\"%s\",status=\"%d\"} %d\n", name, escapeLabelValue(l.method), escapeLabelValue(l.route), l.status, metrics.httpRequests[l])
+	}
+
+	name = prefix + "_http_request_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time spent serving API requests.\n", name)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	durations := map[httpRequestLabels]uint64{}
+	for l := range metrics.httpRequestSeconds {
+		durations[l] = 0
+	}
+	for _, l := range sortHTTPRequestLabels(durations) {
+		h := metrics.httpRequestSeconds[l]
+		method, route := escapeLabelValue(l.method), escapeLabelValue(l.route)
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{method=\"%s\",route=\"%s\",le=\"%g\"} %d\n", name, method, route, b, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{method=\"%s\",route=\"%s\",le=\"+Inf\"} %d\n", name, method, route, h.count)
+		fmt.Fprintf(w, "%s_sum{method=\"%s\",route=\"%s\"} %g\n", name, method, route, h.sum)
+		fmt.Fprintf(w, "%s_count{method=\"%s\",route=\"%s\"} %d\n", name, method, route, h.count)
+	}
+}
+
+func sortHTTPRequestLabels(m map[httpRequestLabels]uint64) []httpRequestLabels {
+	labels := []httpRequestLabels{}
+	for l := range m {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].route != labels[j].route {
+			return labels[i].route < labels[j].route
+		}
+		if labels[i].method != labels[j].method {
+			return labels[i].method < labels[j].method
+		}
+		return labels[i].status < labels[j].status
+	})
+	return labels
+}
+
+// Write outputs cache sizes as Prometheus gauges with names starting with
+// prefix.
+func (stats CacheStats) Write(w io.Writer, prefix string) {
+	writeGauge(w, prefix+"_cached_repositories", "Repositories with open pull requests in the cache.", stats.Repositories)
+	writeGauge(w, prefix+"_cached_pull_requests", "Open pull requests in the cache.", stats.PullRequests)
+	writeGauge(w, prefix+"_cached_branches", "Branches of open pull requests in the cache.", stats.PullRequests)
+	writeGauge(w, prefix+"_cached_dependencies", "Dependencies between pull requests in the cache.", stats.Dependencies)
+}
+
+func writeGauge(w io.Writer, name string, help string, v int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	fmt.Fprintf(w, "%s %d\n", name, v)
+}
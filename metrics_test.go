@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookProcessingMetric(t *testing.T) {
+	app := newTestApp(t, `{"metrics_enabled":true,"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+	postTestWebhook(app, "push", `{}`)
+	postTestWebhook(app, "push", `{}`)
+	postTestWebhook(app, "create", `{}`)
+
+	w := httptest.NewRecorder()
+	app.apiHandlerGetMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, want := range []string{
+		"# TYPE prd_webhook_processing_seconds histogram",
+		`prd_webhook_processing_seconds_count{event="push"} 2`,
+		`prd_webhook_processing_seconds_count{event="create"} 1`,
+		`prd_webhook_processing_seconds_bucket{event="push",le="+Inf"} 2`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, w.Body.String())
+		}
+	}
+}
+
+func TestWebhookEventMetrics(t *testing.T) {
+	tests := []struct {
+		name       string
+		enabled    bool
+		wantStatus int
+		want       []string
+	}{
+		{"disabled", false, http.StatusNotImplemented, []string{}},
+		{"enabled", true, http.StatusOK, []string{
+			`prd_webhook_events_total{event="pull_request",action="opened"} 1`,
+			`prd_webhook_events_total{event="push",action=""} 1`,
+			"prd_webhook_signature_failures_total 1",
+			`prd_cache_updates_total{action="opened"} 1`,
+			"prd_cached_branches 1",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"metrics_enabled":`+strconv.FormatBool(tt.enabled)+`,"incoming_webhook_secret":"secret",
+				"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			postTestWebhook(app, "ping", `{}`)
+			app.cfg.Secret = ""
+			postTestWebhook(app, "push", `{}`)
+			postTestWebhook(app, "pull_request", pullRequestPayload("opened", "aaa", 1, "feature", ""))
+
+			w := httptest.NewRecorder()
+			app.apiHandlerGetMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("missing %q in:\n%s", want, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestHistogramObserve(t *testing.T) {
+	h := NewHistogram([]float64{0.1, 1})
+	for _, v := range []float64{0.05, 0.5, 5} {
+		h.Observe(v)
+	}
+	if h.counts[0] != 1 || h.counts[1] != 2 || h.count != 3 {
+		t.Errorf("got counts %v and count %d", h.counts, h.count)
+	}
+}
+
+func TestSecondsSinceLastWebhook(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    string
+		deliver   bool
+		wantReset bool
+	}{
+		{"no delivery", "", false, false},
+		{"delivery", "", true, true},
+		{"unsigned delivery rejected", "secret", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"incoming_webhook_secret":"`+tt.secret+`"}`)
+			app.metrics.lastWebhook = time.Now().Add(-time.Hour)
+			if tt.deliver {
+				postTestWebhook(app, "ping", `{}`)
+			}
+
+			var b bytes.Buffer
+			app.metrics.Write(&b, "prd")
+			var seconds float64
+			for _, line := range strings.Split(b.String(), "\n") {
+				if strings.HasPrefix(line, "prd_seconds_since_last_webhook ") {
+					seconds, _ = strconv.ParseFloat(strings.TrimPrefix(line, "prd_seconds_since_last_webhook "), 64)
+				}
+			}
+			if reset := seconds < 60; reset != tt.wantReset {
+				t.Errorf("got %g seconds since the last webhook, want reset %v", seconds, tt.wantReset)
+			}
+		})
+	}
+}
+
+func TestMetricsPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		prefix string
+	}{
+		{"default", `{"metrics_enabled":true}`, "prd_"},
+		{"custom", `{"metrics_enabled":true,"metrics_prefix":"team_a_prd"}`, "team_a_prd_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, tt.config)
+			w := httptest.NewRecorder()
+			app.apiHandlerGetMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+
+			names := 0
+			for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+				name := line
+				if strings.HasPrefix(line, "# ") {
+					name = strings.Fields(line)[2]
+				}
+				if !strings.HasPrefix(name, tt.prefix) {
+					t.Errorf("got metric without prefix %s: %s", tt.prefix, line)
+				}
+				names++
+			}
+			if names == 0 {
+				t.Errorf("got no metrics")
+			}
+		})
+	}
+}
+
+func TestWebhookEventMetricLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		event  string
+		action string
+		want   string
+	}{
+		{"known", "pull_request", "opened", `prd_webhook_events_total{event="pull_request",action="opened"} 1`},
+		{"no action", "push", "", `prd_webhook_events_total{event="push",action=""} 1`},
+		{"unknown event", "made_up", "opened", `prd_webhook_events_total{event="other",action="opened"} 1`},
+		{"unknown action", "pull_request", "made_up", `prd_webhook_events_total{event="pull_request",action="other"} 1`},
+		{"quote and newline", "a\"b\nc", "x\\y", `prd_webhook_events_total{event="other",action="other"} 1`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := NewMetrics()
+			metrics.ObserveWebhookEvent(tt.event, tt.action)
+			metrics.ObserveWebhookProcessing(tt.event, time.Millisecond)
+
+			var b bytes.Buffer
+			metrics.Write(&b, "prd")
+			if !strings.Contains(b.String(), tt.want+"\n") {
+				t.Errorf("missing %q in:\n%s", tt.want, b.String())
+			}
+			if len(metrics.webhookEvents) != 1 || len(metrics.webhookProcessingSeconds) != 1 {
+				t.Errorf("got %d event series and %d processing series, want 1", len(metrics.webhookEvents), len(metrics.webhookProcessingSeconds))
+			}
+		})
+	}
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"plain", "/api/v1/repos/{repo}", "/api/v1/repos/{repo}"},
+		{"quote", `a"b`, `a\"b`},
+		{"backslash", `a\b`, `a\\b`},
+		{"newline", "a\nb", `a\nb`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := escapeLabelValue(tt.value); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPRequestMetricLabelEscaping(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.ObserveHTTPRequest("GET", "/a\"b\nc", http.StatusNotFound, time.Millisecond)
+
+	var b bytes.Buffer
+	metrics.Write(&b, "prd")
+	for _, want := range []string{
+		`prd_http_requests_total{method="GET",route="/a\"b\nc",status="404"} 1`,
+		`prd_http_request_duration_seconds_count{method="GET",route="/a\"b\nc"} 1`,
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, b.String())
+		}
+	}
+}
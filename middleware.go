@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"time"
+)
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush keeps server-sent events working through the recorder.
+func (r *statusRecorder) Flush() {
+	flusher, ok := r.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+// metricsMiddleware records every API request labeled by method, route
+// template and status code.
+func (app *App) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		route := r.URL.Path
+		current := mux.CurrentRoute(r)
+		if current != nil {
+			tpl, err := current.GetPathTemplate()
+			if err == nil {
+				route = tpl
+			}
+		}
+		app.metrics.ObserveHTTPRequest(r.Method, route, rec.status, time.Since(start))
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	app := newTestApp(t, `{}`)
+	app.cache.Branches["app"] = map[int]string{1: "foo"}
+
+	router := mux.NewRouter()
+	router.Use(app.metricsMiddleware)
+	router.HandleFunc("/", app.apiHandlerGet).Methods("GET")
+	router.HandleFunc("/status/{repo}/{num:[0-9]+}", app.apiHandlerGetStatus).Methods("GET")
+	router.HandleFunc("/fail", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Failed", http.StatusInternalServerError)
+	}).Methods("GET")
+
+	for _, path := range []string{"/", "/", "/status/app/1", "/status/app/2", "/fail"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	var b bytes.Buffer
+	app.metrics.Write(&b, "prd")
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"counter type", "# TYPE prd_http_requests_total counter"},
+		{"root", `prd_http_requests_total{method="GET",route="/",status="200"} 2`},
+		{"route template", `prd_http_requests_total{method="GET",route="/status/{repo}/{num:[0-9]+}",status="200"} 1`},
+		{"not found status", `prd_http_requests_total{method="GET",route="/status/{repo}/{num:[0-9]+}",status="404"} 1`},
+		{"server error", `prd_http_requests_total{method="GET",route="/fail",status="500"} 1`},
+		{"histogram type", "# TYPE prd_http_request_duration_seconds histogram"},
+		{"durations by route", `prd_http_request_duration_seconds_count{method="GET",route="/status/{repo}/{num:[0-9]+}"} 2`},
+		{"duration buckets", `prd_http_request_duration_seconds_bucket{method="GET",route="/",le="+Inf"} 2`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !strings.Contains(b.String(), tt.want) {
+				t.Errorf("missing %q in:\n%s", tt.want, b.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: pullrequestd.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	PullRequestD_GetCache_FullMethodName        = "/pullrequestd.PullRequestD/GetCache"
+	PullRequestD_GetDependencies_FullMethodName = "/pullrequestd.PullRequestD/GetDependencies"
+	PullRequestD_GetDependents_FullMethodName   = "/pullrequestd.PullRequestD/GetDependents"
+)
+
+// PullRequestDClient is the client API for PullRequestD service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PullRequestDClient interface {
+	GetCache(ctx context.Context, in *GetCacheRequest, opts ...grpc.CallOption) (*GetCacheResponse, error)
+	GetDependencies(ctx context.Context, in *PullRequestRef, opts ...grpc.CallOption) (*GetDependenciesResponse, error)
+	GetDependents(ctx context.Context, in *PullRequestRef, opts ...grpc.CallOption) (*GetDependentsResponse, error)
+}
+
+type pullRequestDClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPullRequestDClient(cc grpc.ClientConnInterface) PullRequestDClient {
+	return &pullRequestDClient{cc}
+}
+
+func (c *pullRequestDClient) GetCache(ctx context.Context, in *GetCacheRequest, opts ...grpc.CallOption) (*GetCacheResponse, error) {
+	out := new(GetCacheResponse)
+	err := c.cc.Invoke(ctx, PullRequestD_GetCache_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pullRequestDClient) GetDependencies(ctx context.Context, in *PullRequestRef, opts ...grpc.CallOption) (*GetDependenciesResponse, error) {
+	out := new(GetDependenciesResponse)
+	err := c.cc.Invoke(ctx, PullRequestD_GetDependencies_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pullRequestDClient) GetDependents(ctx context.Context, in *PullRequestRef, opts ...grpc.CallOption) (*GetDependentsResponse, error) {
+	out := new(GetDependentsResponse)
+	err := c.cc.Invoke(ctx, PullRequestD_GetDependents_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PullRequestDServer is the server API for PullRequestD service.
+// All implementations must embed UnimplementedPullRequestDServer
+// for forward compatibility
+type PullRequestDServer interface {
+	GetCache(context.Context, *GetCacheRequest) (*GetCacheResponse, error)
+	GetDependencies(context.Context, *PullRequestRef) (*GetDependenciesResponse, error)
+	GetDependents(context.Context, *PullRequestRef) (*GetDependentsResponse, error)
+	mustEmbedUnimplementedPullRequestDServer()
+}
+
+// UnimplementedPullRequestDServer must be embedded to have forward compatible implementations.
+type UnimplementedPullRequestDServer struct {
+}
+
+func (UnimplementedPullRequestDServer) GetCache(context.Context, *GetCacheRequest) (*GetCacheResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCache not implemented")
+}
+func (UnimplementedPullRequestDServer) GetDependencies(context.Context, *PullRequestRef) (*GetDependenciesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDependencies not implemented")
+}
+func (UnimplementedPullRequestDServer) GetDependents(context.Context, *PullRequestRef) (*GetDependentsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDependents not implemented")
+}
+func (UnimplementedPullRequestDServer) mustEmbedUnimplementedPullRequestDServer() {}
+
+// UnsafePullRequestDServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PullRequestDServer will
+// result in compilation errors.
+type UnsafePullRequestDServer interface {
+	mustEmbedUnimplementedPullRequestDServer()
+}
+
+func RegisterPullRequestDServer(s grpc.ServiceRegistrar, srv PullRequestDServer) {
+	s.RegisterService(&PullRequestD_ServiceDesc, srv)
+}
+
+func _PullRequestD_GetCache_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCacheRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PullRequestDServer).GetCache(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PullRequestD_GetCache_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PullRequestDServer).GetCache(ctx, req.(*GetCacheRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PullRequestD_GetDependencies_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PullRequestRef)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PullRequestDServer).GetDependencies(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PullRequestD_GetDependencies_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PullRequestDServer).GetDependencies(ctx, req.(*PullRequestRef))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PullRequestD_GetDependents_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PullRequestRef)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PullRequestDServer).GetDependents(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PullRequestD_GetDependents_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PullRequestDServer).GetDependents(ctx, req.(*PullRequestRef))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// PullRequestD_ServiceDesc is the grpc.ServiceDesc for PullRequestD service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var PullRequestD_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pullrequestd.PullRequestD",
+	HandlerType: (*PullRequestDServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetCache",
+			Handler:    _PullRequestD_GetCache_Handler,
+		},
+		{
+			MethodName: "GetDependencies",
+			Handler:    _PullRequestD_GetDependencies_Handler,
+		},
+		{
+			MethodName: "GetDependents",
+			Handler:    _PullRequestD_GetDependents_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "pullrequestd.proto",
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	CacheFormatJSON = "json"
+	CacheFormatGob  = "gob"
+)
+
+// Save writes the cache to a file in the given format, JSON or gob. The file
+// is replaced atomically so that a crash while saving never leaves a
+// truncated file behind.
+func (cache *Cache) Save(path string, format string) error {
+	var b []byte
+	var err error
+	switch format {
+	case CacheFormatJSON:
+		b, err = json.Marshal(cache.Snapshot())
+	case CacheFormatGob:
+		var buf bytes.Buffer
+		err = gob.NewEncoder(&buf).Encode(cache.Snapshot())
+		b = buf.Bytes()
+	default:
+		err = errors.New("Unknown cache format " + format)
+	}
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load replaces the cache contents with ones saved in a file. The format is
+// told from the contents so that a file saved before cache_format was changed
+// is still loaded. The cache is left untouched when the file cannot be read or
+// parsed.
+func (cache *Cache) Load(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var loaded Cache
+	if isJSONCacheFile(b) {
+		err = json.Unmarshal(b, &loaded)
+		if err != nil {
+			return errors.New("Error parsing cache file: " + err.Error())
+		}
+		if loaded.Branches == nil || loaded.Dependencies == nil || loaded.Dependents == nil {
+			return errors.New("Cache file is missing branches or dependencies")
+		}
+	} else {
+		err = gob.NewDecoder(bytes.NewReader(b)).Decode(&loaded)
+		if err != nil {
+			return errors.New("Error parsing cache file: " + err.Error())
+		}
+		// gob leaves out empty maps
+		loaded.initMissing()
+	}
+	if loaded.Version != cache.Version {
+		return errors.New(fmt.Sprintf("Cache file has version %q while %q is expected", loaded.Version, cache.Version))
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.Branches = loaded.Branches
+	cache.Dependencies = loaded.Dependencies
+	cache.Dependents = loaded.Dependents
+	cache.SoftDependencies = loaded.SoftDependencies
+	if cache.SoftDependencies == nil {
+		cache.SoftDependencies = DependencyMap{}
+	}
+	cache.Labels = loaded.Labels
+	cache.RawDependsOn = loaded.RawDependsOn
+	cache.Annotations = loaded.Annotations
+	cache.States = loaded.States
+	// warnings describe the run that saved the file
+	cache.Warnings = nil
+	for repo, prs := range cache.Branches {
+		for num := range prs {
+			cache.touch(repo, num)
+			// files saved before states were tracked have none
+			if cache.States[repo][num] == "" {
+				cache.SetState(repo, num, PullRequestStateOpen)
+			}
+		}
+	}
+	cache.refreshCounters()
+	cache.refreshAllBlocked()
+	return nil
+}
+
+// isJSONCacheFile tells a JSON cache file from a gob one, which never starts
+// with a brace.
+func isJSONCacheFile(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	return len(b) > 0 && b[0] == '{'
+}
+
+// initMissing creates maps which are nil, eg. after decoding a cache in which
+// they were empty.
+func (cache *Cache) initMissing() {
+	if cache.Branches == nil {
+		cache.Branches = map[string]map[int]string{}
+	}
+	if cache.Dependencies == nil {
+		cache.Dependencies = DependencyMap{}
+	}
+	if cache.Dependents == nil {
+		cache.Dependents = DependencyMap{}
+	}
+	if cache.Labels == nil {
+		cache.Labels = map[string]map[int][]string{}
+	}
+	if cache.RawDependsOn == nil {
+		cache.RawDependsOn = map[string]map[int][]string{}
+	}
+	if cache.Annotations == nil {
+		cache.Annotations = map[string]map[int]map[string]string{}
+	}
+	if cache.States == nil {
+		cache.States = map[string]map[int]string{}
+	}
+}
+
+// loadCacheFile loads the cache from CacheFile and returns true on success.
+// A missing or corrupt file means that the cache has to be fully populated.
+func (app *App) loadCacheFile() bool {
+	if app.cfg.CacheFile == "" {
+		return false
+	}
+	err := app.cache.Load(app.cfg.CacheFile)
+	if os.IsNotExist(err) {
+		logger.Info("Cache file does not exist yet", "path", app.cfg.CacheFile)
+		return false
+	}
+	if err != nil {
+		logger.Warn("Error loading cache file. Falling back to a full scan", "path", app.cfg.CacheFile, "error", err)
+		return false
+	}
+	logger.Info("Loaded cache", "path", app.cfg.CacheFile)
+	return true
+}
+
+// cacheFlushAttempts is how many times saving the cache is tried before
+// giving up until the next flush. cacheFlushBackoff is the wait after the
+// first failure and doubles after each next one.
+var (
+	cacheFlushAttempts = 3
+	cacheFlushBackoff  = time.Second
+)
+
+// flushCacheFile saves the cache to CacheFile. Failures, eg. a full disk, are
+// retried with backoff and each of them is counted in metrics.
+func (app *App) flushCacheFile() {
+	backoff := cacheFlushBackoff
+	for attempt := 1; ; attempt++ {
+		err := app.cache.Save(app.cfg.CacheFile, app.cfg.GetCacheFormat())
+		if err == nil {
+			return
+		}
+		if app.metrics != nil {
+			app.metrics.ObserveCachePersistError()
+		}
+		if attempt >= cacheFlushAttempts {
+			logger.Error("Error saving cache. Giving up until next flush", "path", app.cfg.CacheFile, "attempts", attempt, "error", err)
+			return
+		}
+		logger.Warn("Error saving cache. Retrying", "path", app.cfg.CacheFile, "attempt", attempt, "wait", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (app *App) startCacheFlush() {
+	interval := app.cfg.GetCacheFlushInterval()
+	logger.Info("Saving cache periodically", "path", app.cfg.CacheFile, "interval", interval)
+	for {
+		time.Sleep(interval)
+		app.flushCacheFile()
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheSaveLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"saved cache", "", false},
+		{"missing file", "-", true},
+		{"corrupt file", `{"branches":`, true},
+		{"other version", `{"branches":{},"dependencies":{},"dependents":{},"Version":"0"}`, true},
+		{"no dependencies", `{"branches":{},"Version":"1"}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.json")
+			saved := newTestApp(t, `{}`)
+			openTestPullRequest(saved, "lib", 1)
+			openTestPullRequest(saved, "app", 2, "lib#1 [JIRA-1]")
+			switch tt.content {
+			case "":
+				if err := saved.cache.Save(path, CacheFormatJSON); err != nil {
+					t.Fatal(err)
+				}
+			case "-":
+			default:
+				ioutil.WriteFile(path, []byte(tt.content), 0600)
+			}
+
+			app := newTestApp(t, `{}`)
+			openTestPullRequest(app, "other", 3)
+			err := app.cache.Load(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				want := map[string]map[int]string{"other": {3: "branch-3"}}
+				if got := app.cache.Branches; !reflect.DeepEqual(got, want) {
+					t.Errorf("got branches %v, want untouched cache", got)
+				}
+				return
+			}
+			want := saved.cache.Snapshot()
+			got := app.cache.Snapshot()
+			if !reflect.DeepEqual(got.Branches, want.Branches) || !reflect.DeepEqual(got.Dependencies, want.Dependencies) ||
+				!reflect.DeepEqual(got.Dependents, want.Dependents) || !reflect.DeepEqual(got.Annotations, want.Annotations) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+			if got := app.cache.Stats(); got.PullRequests != 2 || got.Dependencies != 1 {
+				t.Errorf("got stats %+v after load", got)
+			}
+			// no temporary files are left behind
+			files, _ := ioutil.ReadDir(filepath.Dir(path))
+			if len(files) != 1 {
+				t.Errorf("got %d files in the cache directory, want 1", len(files))
+			}
+		})
+	}
+}
+
+func TestReconcileRepositories(t *testing.T) {
+	newTestGitHub(t, map[string]string{
+		"/orgs/o/repos": `[{"name":"app"},{"name":"lib"}]`,
+		"/repos/o/app/pulls": `[{"number":1,"head":{"ref":"same"},"body":"DependsOn:lib#5"},` +
+			`{"number":2,"head":{"ref":"renamed"},"body":""},` +
+			`{"number":4,"head":{"ref":"new"},"body":"DependsOn:app#1"}]`,
+		"/repos/o/lib/pulls": `[{"number":5,"head":{"ref":"lib"},"body":""}]`,
+	})
+	cfg := `{"pull_request_depends_on":{"owner":"o","organization":true,"repositories":[{"name":"*"}],"exclude_repositories":[]}}`
+	path := filepath.Join(t.TempDir(), "cache.json")
+
+	saved := newTestApp(t, cfg)
+	openTestPullRequest(saved, "lib", 5)
+	saved.cache.Branches["app"] = map[int]string{}
+	for _, pr := range []struct {
+		num    int
+		branch string
+	}{{1, "same"}, {2, "old"}, {3, "closed"}} {
+		saved.updateCache("opened", "app", pr.num, pr.branch, []string{"lib#5"}, []string{}, false)
+	}
+	// pull request 1 keeps its dependency while 2 loses it
+	saved.cache.Save(path, CacheFormatJSON)
+
+	app := newTestApp(t, cfg)
+	if err := app.cache.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	app.populateCache(context.Background(), true)
+
+	wantBranches := map[string]map[int]string{
+		"app": {1: "same", 2: "renamed", 4: "new"},
+		"lib": {5: "lib"},
+	}
+	if got := app.cache.Branches; !reflect.DeepEqual(got, wantBranches) {
+		t.Errorf("got branches %v, want %v", got, wantBranches)
+	}
+	tests := []struct {
+		repo string
+		num  int
+		want []PullRequestRef
+	}{
+		{"app", 1, []PullRequestRef{{Repository: "lib", Number: 5}}},
+		{"app", 2, []PullRequestRef{}},
+		{"app", 3, []PullRequestRef{}},
+		{"app", 4, []PullRequestRef{{Repository: "app", Number: 1}}},
+	}
+	for _, tt := range tests {
+		if got := app.cache.Dependencies.Get(tt.repo, tt.num); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("got dependencies of %s#%d %v, want %v", tt.repo, tt.num, got, tt.want)
+		}
+	}
+}
+
+func TestLoadCacheFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured bool
+		content    string
+		want       bool
+	}{
+		{"not configured", false, "saved", false},
+		{"missing file", true, "", false},
+		{"corrupt file", true, "{", false},
+		{"saved file", true, "saved", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.json")
+			switch tt.content {
+			case "saved":
+				saved := newTestApp(t, `{}`)
+				saved.cache.Save(path, CacheFormatJSON)
+			case "":
+			default:
+				ioutil.WriteFile(path, []byte(tt.content), 0600)
+			}
+			cfg := `{}`
+			if tt.configured {
+				cfg = `{"cache_file":"` + path + `"}`
+			}
+			app := newTestApp(t, cfg)
+			if got := app.loadCacheFile(); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShutdownFlushesCacheFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		updateTime time.Duration
+		wantSaved  bool
+	}{
+		{"webhook finishes", 100 * time.Millisecond, true},
+		{"webhook outlasts timeout", 1500 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.json")
+			app := newTestApp(t, `{"shutdown_timeout":1,"cache_file":"`+path+`","pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+
+			// a webhook still being processed when the shutdown starts
+			started := make(chan bool)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				started <- true
+				time.Sleep(tt.updateTime)
+				app.apiHandlerPost(w, r)
+			}))
+			defer server.Close()
+			app.server = server.Config
+
+			done := make(chan bool)
+			go func() {
+				r, _ := http.NewRequest("POST", server.URL, strings.NewReader(pullRequestPayload("opened", "app", 1, "foo", "Fix")))
+				r.Header.Set("X-GitHub-Event", "pull_request")
+				http.DefaultClient.Do(r)
+				done <- true
+			}()
+			<-started
+			app.shutdown()
+
+			saved := newTestApp(t, `{}`)
+			if err := saved.cache.Load(path); err != nil {
+				t.Fatal(err)
+			}
+			if _, got := saved.cache.Branches["app"][1]; got != tt.wantSaved {
+				t.Errorf("got saved %v, want %v", got, tt.wantSaved)
+			}
+			<-done
+		})
+	}
+}
+
+func TestPruneClosedDependenciesOnReconcile(t *testing.T) {
+	tests := []struct {
+		name     string
+		prune    bool
+		wantDeps []PullRequestRef
+		wantSoft []PullRequestRef
+	}{
+		{"disabled", false, []PullRequestRef{{Repository: "broken", Number: 7}, {Repository: "lib", Number: 5}, {Repository: "lib", Number: 6}}, []PullRequestRef{{Repository: "lib", Number: 5}}},
+		{"enabled", true, []PullRequestRef{{Repository: "broken", Number: 7}, {Repository: "lib", Number: 6}}, []PullRequestRef{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// lib#5 got closed while the daemon was down and pull requests
+			// of broken cannot be fetched
+			newTestGitHub(t, map[string]string{
+				"/orgs/o/repos":      `[{"name":"app"},{"name":"lib"},{"name":"broken"}]`,
+				"/repos/o/app/pulls": `[{"number":1,"head":{"ref":"app"},"body":"DependsOn:lib#5\r\nDependsOn:lib#6\r\nDependsOn:broken#7\r\nSoftDependsOn:lib#5"}]`,
+				"/repos/o/lib/pulls": `[{"number":6,"head":{"ref":"lib6"},"body":""}]`,
+			})
+			cfg := fmt.Sprintf(`{"prune_closed_dependencies_on_reconcile":%v,"pull_request_depends_on":{"owner":"o","organization":true,"repositories":[{"name":"*"}],"exclude_repositories":[]}}`, tt.prune)
+			path := filepath.Join(t.TempDir(), "cache.json")
+
+			saved := newTestApp(t, cfg)
+			openTestPullRequest(saved, "lib", 5)
+			openTestPullRequest(saved, "lib", 6)
+			openTestPullRequest(saved, "broken", 7)
+			saved.updateCache("opened", "app", 1, "app", []string{"lib#5", "lib#6", "broken#7"}, []string{"lib#5"}, false)
+			saved.cache.Save(path, CacheFormatJSON)
+
+			app := newTestApp(t, cfg)
+			if err := app.cache.Load(path); err != nil {
+				t.Fatal(err)
+			}
+			app.populateCache(context.Background(), true)
+
+			if got := app.cache.Dependencies.Get("app", 1); !reflect.DeepEqual(got, tt.wantDeps) {
+				t.Errorf("got dependencies %v, want %v", got, tt.wantDeps)
+			}
+			if got := app.cache.SoftDependencies.Get("app", 1); !reflect.DeepEqual(got, tt.wantSoft) {
+				t.Errorf("got soft dependencies %v, want %v", got, tt.wantSoft)
+			}
+			if got := app.cache.Dependents.Get("lib", 5); len(got) != 0 {
+				t.Errorf("got dependents of closed pull request %v", got)
+			}
+		})
+	}
+}
+
+func TestCacheSaveLoadFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		empty   bool
+		corrupt bool
+		version string
+		wantErr bool
+	}{
+		{"json", CacheFormatJSON, false, false, "", false},
+		{"gob", CacheFormatGob, false, false, "", false},
+		{"empty json", CacheFormatJSON, true, false, "", false},
+		{"empty gob", CacheFormatGob, true, false, "", false},
+		{"truncated gob", CacheFormatGob, false, true, "", true},
+		{"gob of other version", CacheFormatGob, false, false, "0", true},
+		{"unknown format", "xml", false, false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache")
+			saved := newTestApp(t, `{}`)
+			if !tt.empty {
+				openTestPullRequest(saved, "lib", 1)
+				openTestPullRequest(saved, "lib", 2)
+				openTestPullRequest(saved, "app", 3, "lib#1 [JIRA-1]")
+				saved.updateCache("opened", "app", 4, "branch-4", []string{"lib#1"}, []string{"lib#2"}, false)
+				saved.updateCache("closed", "lib", 2, "", []string{}, []string{}, true)
+			}
+			if tt.version != "" {
+				saved.cache.Version = tt.version
+			}
+			err := saved.cache.Save(path, tt.format)
+			if tt.format == "xml" {
+				if err == nil {
+					t.Fatal("got no error saving in an unknown format")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.corrupt {
+				b, _ := ioutil.ReadFile(path)
+				ioutil.WriteFile(path, b[:len(b)/2], 0600)
+			}
+
+			app := newTestApp(t, `{}`)
+			err = app.cache.Load(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			want := saved.cache.Snapshot()
+			got := app.cache.Snapshot()
+			for _, m := range []struct {
+				name      string
+				got, want interface{}
+			}{
+				{"branches", got.Branches, want.Branches},
+				{"dependencies", got.Dependencies, want.Dependencies},
+				{"dependents", got.Dependents, want.Dependents},
+				{"soft dependencies", got.SoftDependencies, want.SoftDependencies},
+				{"annotations", got.Annotations, want.Annotations},
+				{"states", got.States, want.States},
+				{"stats", got.Stats(), want.Stats()},
+				{"blocked", got.GetBlocked(""), want.GetBlocked("")},
+			} {
+				if fmt.Sprint(m.got) != fmt.Sprint(m.want) {
+					t.Errorf("got %s %v, want %v", m.name, m.got, m.want)
+				}
+			}
+			if got.Branches == nil || got.Dependencies == nil || got.States == nil {
+				t.Errorf("got nil maps after loading")
+			}
+		})
+	}
+}
+
+func TestLoadCacheFileAfterFormatChange(t *testing.T) {
+	tests := []struct {
+		name   string
+		saved  string
+		config string
+	}{
+		{"json to gob", CacheFormatJSON, CacheFormatGob},
+		{"gob to json", CacheFormatGob, CacheFormatJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache")
+			saved := newTestApp(t, `{}`)
+			openTestPullRequest(saved, "app", 1)
+			if err := saved.cache.Save(path, tt.saved); err != nil {
+				t.Fatal(err)
+			}
+
+			app := newTestApp(t, `{"cache_file":"`+path+`","cache_format":"`+tt.config+`"}`)
+			if !app.loadCacheFile() {
+				t.Fatal("cache file saved in the previous format was not loaded")
+			}
+			if _, ok := app.cache.Branches["app"][1]; !ok {
+				t.Errorf("got branches %v", app.cache.Branches)
+			}
+			app.flushCacheFile()
+			b, _ := ioutil.ReadFile(path)
+			if isJSONCacheFile(b) != (tt.config == CacheFormatJSON) {
+				t.Errorf("cache file was not saved as %s", tt.config)
+			}
+		})
+	}
+}
+
+func TestFlushCacheFileRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		createDir  time.Duration
+		wantSaved  bool
+		wantErrors string
+	}{
+		{"saved", 0, true, "prd_cache_persist_errors_total 0"},
+		{"saved after retry", 200 * time.Millisecond, true, "prd_cache_persist_errors_total 1"},
+		{"all attempts fail", -1, false, "prd_cache_persist_errors_total 3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts, backoff := cacheFlushAttempts, cacheFlushBackoff
+			cacheFlushAttempts, cacheFlushBackoff = 3, 500*time.Millisecond
+			if tt.createDir < 0 {
+				cacheFlushBackoff = time.Millisecond
+			}
+			defer func() {
+				cacheFlushAttempts, cacheFlushBackoff = attempts, backoff
+			}()
+
+			dir := filepath.Join(t.TempDir(), "cache")
+			path := filepath.Join(dir, "cache.json")
+			app := newTestApp(t, `{"cache_file":"`+path+`"}`)
+			openTestPullRequest(app, "app", 1)
+			if tt.createDir == 0 {
+				os.Mkdir(dir, 0755)
+			}
+			if tt.createDir > 0 {
+				// the directory shows up before the second attempt
+				timer := time.AfterFunc(tt.createDir, func() {
+					os.Mkdir(dir, 0755)
+				})
+				defer timer.Stop()
+			}
+
+			app.flushCacheFile()
+
+			_, err := os.Stat(path)
+			if (err == nil) != tt.wantSaved {
+				t.Errorf("got saved %v, want %v", err == nil, tt.wantSaved)
+			}
+			var b strings.Builder
+			app.metrics.Write(&b, "prd")
+			if !strings.Contains(b.String(), tt.wantErrors+"\n") {
+				t.Errorf("metrics do not contain %q:\n%s", tt.wantErrors, b.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type ProcessingError struct {
+	DeliveryID string    `json:"delivery_id,omitempty"`
+	Event      string    `json:"event,omitempty"`
+	Message    string    `json:"message"`
+	Time       time.Time `json:"time"`
+}
+
+// ErrorLog keeps the most recent errors of processing webhook deliveries so
+// that they can be inspected without reading logs. The oldest ones are
+// dropped once it is full.
+type ErrorLog struct {
+	mu     sync.Mutex
+	size   int
+	errors []ProcessingError
+}
+
+func NewErrorLog(size int) *ErrorLog {
+	errorLog := &ErrorLog{
+		size:   size,
+		errors: []ProcessingError{},
+	}
+	return errorLog
+}
+
+func (errorLog *ErrorLog) Add(e ProcessingError) {
+	errorLog.mu.Lock()
+	defer errorLog.mu.Unlock()
+
+	errorLog.errors = append(errorLog.errors, e)
+	if len(errorLog.errors) > errorLog.size {
+		errorLog.errors = append([]ProcessingError{}, errorLog.errors[len(errorLog.errors)-errorLog.size:]...)
+	}
+}
+
+// List returns kept errors, the most recent first.
+func (errorLog *ErrorLog) List() []ProcessingError {
+	errorLog.mu.Lock()
+	defer errorLog.mu.Unlock()
+
+	list := make([]ProcessingError, 0, len(errorLog.errors))
+	for i := len(errorLog.errors) - 1; i >= 0; i-- {
+		list = append(list, errorLog.errors[i])
+	}
+	return list
+}
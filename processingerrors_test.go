@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestErrorLog(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		added []string
+		want  []string
+	}{
+		{"empty", 3, []string{}, []string{}},
+		{"below size", 3, []string{"a", "b"}, []string{"b", "a"}},
+		{"at size", 3, []string{"a", "b", "c"}, []string{"c", "b", "a"}},
+		{"above size", 3, []string{"a", "b", "c", "d", "e"}, []string{"e", "d", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errorLog := NewErrorLog(tt.size)
+			for _, msg := range tt.added {
+				errorLog.Add(ProcessingError{Message: msg})
+			}
+			got := []string{}
+			for _, e := range errorLog.List() {
+				got = append(got, e.Message)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
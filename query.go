@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	gocli "github.com/gen64/go-cli"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errPullRequestNotFound = errors.New("Pull request not found in the cache")
+
+func (app *App) queryHandler(cli *gocli.CLI) int {
+	app.loadConfig(cli.Flag("config"))
+
+	repo := cli.Flag("repo")
+	num, err := strconv.Atoi(cli.Flag("num"))
+	if err != nil || num <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid pull request number %s\n", cli.Flag("num"))
+		return 1
+	}
+
+	err = app.queryPullRequest(app.getDaemonURL(cli.Flag("address")), repo, num, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+// queryPullRequest fetches the pull request from the cache of a running daemon
+// and prints its branch and connections to w.
+func (app *App) queryPullRequest(address string, repo string, num int, w io.Writer) error {
+	u := fmt.Sprintf("%s/?repo=%s&num=%d", address, url.QueryEscape(repo), num)
+	req, err := http.NewRequest("GET", u, strings.NewReader(""))
+	if err != nil {
+		return err
+	}
+	if app.cfg.APITokenHeader != "" && app.cfg.APITokenValue != "" {
+		req.Header.Add(app.cfg.APITokenHeader, app.cfg.APITokenValue)
+	}
+
+	c := app.getDaemonClient()
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("Got HTTP status %d from %s", resp.StatusCode, address))
+	}
+
+	var cache Cache
+	if app.cfg.ResponseEnvelope {
+		envelope := struct {
+			Data *Cache `json:"data"`
+		}{Data: &cache}
+		err = json.Unmarshal(b, &envelope)
+	} else {
+		err = json.Unmarshal(b, &cache)
+	}
+	if err != nil {
+		return errors.New("Got invalid cache from " + address)
+	}
+
+	branch, hasKey := cache.Branches[repo][num]
+	if !hasKey {
+		return errPullRequestNotFound
+	}
+
+	fmt.Fprintf(w, "%s#%d\n", repo, num)
+	fmt.Fprintf(w, "  branch: %s\n", branch)
+	writeQueryRefs(w, "depends on", cache.Dependencies.Get(repo, num))
+	writeQueryRefs(w, "soft depends on", cache.SoftDependencies.Get(repo, num))
+	writeQueryRefs(w, "dependents", cache.Dependents.Get(repo, num))
+	return nil
+}
+
+func writeQueryRefs(w io.Writer, title string, refs []PullRequestRef) {
+	names := []string{}
+	for _, ref := range refs {
+		names = append(names, fmt.Sprintf("%s#%d", ref.Key(), ref.Number))
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		fmt.Fprintf(w, "  %s: -\n", title)
+		return
+	}
+	fmt.Fprintf(w, "  %s:\n", title)
+	for _, name := range names {
+		fmt.Fprintf(w, "    %s\n", name)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestQueryPullRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		repo    string
+		num     int
+		want    string
+		wantErr bool
+	}{
+		{"found", `{}`, "app", 2, "app#2\n  branch: branch-2\n  depends on:\n    lib#1\n  soft depends on: -\n  dependents: -\n", false},
+		{"dependents", `{}`, "lib", 1, "lib#1\n  branch: branch-1\n  depends on: -\n  soft depends on: -\n  dependents:\n    app#2\n", false},
+		{"envelope", `{"response_envelope":true}`, "app", 2, "app#2\n  branch: branch-2\n  depends on:\n    lib#1\n  soft depends on: -\n  dependents: -\n", false},
+		{"not found", `{}`, "app", 9, "", true},
+		{"token", `{"incoming_api_token_header":"X-Token","incoming_api_token_value":"secret"}`, "app", 2, "app#2\n  branch: branch-2\n  depends on:\n    lib#1\n  soft depends on: -\n  dependents: -\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, tt.config)
+			openTestPullRequest(app, "lib", 1)
+			openTestPullRequest(app, "app", 2, "lib#1")
+			server := httptest.NewServer(http.HandlerFunc(app.apiHandlerGet))
+			defer server.Close()
+
+			var b bytes.Buffer
+			err := app.queryPullRequest(server.URL, tt.repo, tt.num, &b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if b.String() != tt.want {
+				t.Errorf("got %q, want %q", b.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+)
+
+// startConfigReload reloads the config file whenever SIGHUP is received.
+func (app *App) startConfigReload(path string) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		logger.Info("Got hangup signal. Reloading config...")
+		err := app.reloadConfig(path)
+		if err != nil {
+			logger.Error("Error reloading config, keeping the current one", "error", err)
+		}
+	}
+}
+
+// getAPIToken returns header name and value of the API token.
+func (app *App) getAPIToken() (string, string) {
+	app.cfgMu.RLock()
+	defer app.cfgMu.RUnlock()
+	return app.cfg.APITokenHeader, app.cfg.APITokenValue
+}
+
+// getSecret returns the secret GitHub signs webhook payloads with.
+func (app *App) getSecret() string {
+	app.cfgMu.RLock()
+	defer app.cfgMu.RUnlock()
+	return app.cfg.Secret
+}
+
+// reloadConfig re-reads and validates the config file and applies options
+// that can be changed without a restart: incoming_webhook_secret,
+// incoming_api_token_header, incoming_api_token_value and the repositories,
+// exclude_repositories and require_declaration rules. Changes of other options
+// are logged and need a restart. Pull requests of repositories that do not
+// match the rules anymore are removed and repositories that started to match
+// are scanned.
+func (app *App) reloadConfig(path string) error {
+	c, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.New("Error reading config file: " + err.Error())
+	}
+
+	var cfg Config
+	err = cfg.parseJSON(c)
+	if err != nil {
+		return err
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return err
+	}
+	if (cfg.PullRequestDependsOn == nil) != (app.cfg.PullRequestDependsOn == nil) {
+		return errors.New("pull_request_depends_on cannot be added or removed without a restart")
+	}
+
+	app.cfgMu.RLock()
+	current := app.cfg
+	app.cfgMu.RUnlock()
+	if !reflect.DeepEqual(withReloadableOptions(current, cfg), cfg) {
+		logger.Warn("Config has changes of options that cannot be reloaded. They take effect after a restart")
+	}
+
+	// repositories are listed before swapping the rules so that the ones
+	// which started to match can be told apart
+	repos := []string{}
+	if cfg.PullRequestDependsOn != nil {
+		list, err := app.githubAPI.GetRepositoriesList(context.Background(), cfg.PullRequestDependsOn.Owner, cfg.PullRequestDependsOn.Organization, cfg.Token)
+		if err != nil {
+			logger.Error("Error fetching repository list from GitHub. Repositories that started to match rules are not scanned", "error", err)
+		}
+		app.setRepositories(list)
+		for _, repo := range app.skipArchivedRepositories(list) {
+			repos = append(repos, repo.Name)
+		}
+	}
+	wasIncluded := map[string]bool{}
+	for _, repo := range repos {
+		wasIncluded[repo] = app.checkIfRepoShouldBeIncluded(repo)
+	}
+
+	// only the reloadable fields are written as other options are read
+	// without the lock
+	app.cfgMu.Lock()
+	app.cfg.Secret = cfg.Secret
+	app.cfg.APITokenHeader = cfg.APITokenHeader
+	app.cfg.APITokenValue = cfg.APITokenValue
+	if cfg.PullRequestDependsOn != nil {
+		app.cfg.PullRequestDependsOn.Repositories = cfg.PullRequestDependsOn.Repositories
+		app.cfg.PullRequestDependsOn.ExcludeRepositories = cfg.PullRequestDependsOn.ExcludeRepositories
+		app.cfg.PullRequestDependsOn.RequireDeclaration = cfg.PullRequestDependsOn.RequireDeclaration
+	}
+	app.cfgMu.Unlock()
+	logger.Info("Config reloaded")
+
+	if cfg.PullRequestDependsOn == nil {
+		return nil
+	}
+
+	for repo := range app.cache.Snapshot().Branches {
+		if !app.checkIfRepoShouldBeIncluded(repo) {
+			logger.Info("Repository does not match rules anymore. Removing its pull requests", "repo", repo)
+			app.removeRepository(repo)
+		}
+	}
+
+	added := []string{}
+	for _, repo := range repos {
+		if !wasIncluded[repo] && app.checkIfRepoShouldBeIncluded(repo) {
+			added = append(added, repo)
+		}
+	}
+	if len(added) > 0 {
+		logger.Info("Repositories match rules now. Fetching their pull requests", "repos", strings.Join(added, ","))
+		app.addRepositories(context.Background(), added)
+	}
+
+	app.processOrphanedDependencies()
+	return nil
+}
+
+// withReloadableOptions returns cfg with options that can be reloaded taken
+// from reloaded, so that comparing it with reloaded tells whether any other
+// option changed.
+func withReloadableOptions(cfg Config, reloaded Config) Config {
+	cfg.Secret = reloaded.Secret
+	cfg.APITokenHeader = reloaded.APITokenHeader
+	cfg.APITokenValue = reloaded.APITokenValue
+	if cfg.PullRequestDependsOn != nil && reloaded.PullRequestDependsOn != nil {
+		p := *cfg.PullRequestDependsOn
+		p.Repositories = reloaded.PullRequestDependsOn.Repositories
+		p.ExcludeRepositories = reloaded.PullRequestDependsOn.ExcludeRepositories
+		p.RequireDeclaration = reloaded.PullRequestDependsOn.RequireDeclaration
+		cfg.PullRequestDependsOn = &p
+	}
+	return cfg
+}
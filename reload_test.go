@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	initial := `{"port":"8080","outgoing_github_token":"token","incoming_webhook_secret":"secret",
+		"pull_request_depends_on":{"owner":"o","organization":true,"repositories":[{"name":"aaa"},{"name":"bbb"}],"exclude_repositories":[]}}`
+	tests := []struct {
+		name       string
+		config     string
+		wantErr    bool
+		wantSecret string
+		wantRepos  []string
+	}{
+		{"unchanged", initial, false, "secret", []string{"aaa", "bbb"}},
+		{"secret", `{"port":"8080","outgoing_github_token":"token","incoming_webhook_secret":"changed",
+			"pull_request_depends_on":{"owner":"o","organization":true,"repositories":[{"name":"aaa"},{"name":"bbb"}],"exclude_repositories":[]}}`, false, "changed", []string{"aaa", "bbb"}},
+		{"repository removed", `{"port":"8080","outgoing_github_token":"token","incoming_webhook_secret":"secret",
+			"pull_request_depends_on":{"owner":"o","organization":true,"repositories":[{"name":"aaa"}],"exclude_repositories":[]}}`, false, "secret", []string{"aaa"}},
+		{"repository added", `{"port":"8080","outgoing_github_token":"token","incoming_webhook_secret":"secret",
+			"pull_request_depends_on":{"owner":"o","organization":true,"repositories":[{"name":"*"}],"exclude_repositories":[{"name":"bbb"}]}}`, false, "secret", []string{"aaa", "ccc"}},
+		{"invalid json", `{"port":`, true, "secret", []string{"aaa", "bbb"}},
+		{"invalid config", `{"port":"8080","incoming_webhook_secret":"changed",
+			"pull_request_depends_on":{"owner":"o","organization":true,"repositories":[{"name":"aaa"}],"exclude_repositories":[]}}`, true, "secret", []string{"aaa", "bbb"}},
+		{"pull_request_depends_on removed", `{"port":"8080","incoming_webhook_secret":"changed"}`, true, "secret", []string{"aaa", "bbb"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestGitHub(t, map[string]string{
+				"/orgs/o/repos":      `[{"name":"aaa"},{"name":"bbb"},{"name":"ccc"}]`,
+				"/repos/o/aaa/pulls": `[{"number":1,"head":{"ref":"aaa"},"body":""}]`,
+				"/repos/o/bbb/pulls": `[{"number":2,"head":{"ref":"bbb"},"body":""}]`,
+				"/repos/o/ccc/pulls": `[{"number":3,"head":{"ref":"ccc"},"body":""}]`,
+			})
+			app := newTestApp(t, initial)
+			app.populateCache(context.Background(), false)
+
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := ioutil.WriteFile(path, []byte(tt.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			err := app.reloadConfig(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got := app.getSecret(); got != tt.wantSecret {
+				t.Errorf("got secret %q, want %q", got, tt.wantSecret)
+			}
+			repos := []string{}
+			for repo, prs := range app.cache.Snapshot().Branches {
+				if len(prs) > 0 {
+					repos = append(repos, repo)
+				}
+			}
+			sort.Strings(repos)
+			if !reflect.DeepEqual(repos, tt.wantRepos) {
+				t.Errorf("got repositories %v, want %v", repos, tt.wantRepos)
+			}
+		})
+	}
+}
+
+func TestReloadConfigWhileTriggeringJobs(t *testing.T) {
+	initial := `{"port":"8080","outgoing_github_token":"token","incoming_webhook_secret":"secret",
+		"pull_request_depends_on":{"owner":"o","repositories":[{"name":"aaa"}],"exclude_repositories":[]}}`
+	for _, level := range []string{LogLevelDebug, LogLevelInfo} {
+		t.Run(level, func(t *testing.T) {
+			newTestGitHub(t, map[string]string{
+				"/users/o/repos":     `[{"name":"aaa"}]`,
+				"/repos/o/aaa/pulls": `[]`,
+			})
+			app := newTestApp(t, initial)
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := ioutil.WriteFile(path, []byte(strings.Replace(initial, `"secret"`, `"changed"`, 1)), 0600); err != nil {
+				t.Fatal(err)
+			}
+			logs := captureLogs(t, level)
+
+			// run with -race to catch the config being read during the swap
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						app.triggerPRJob("aaa", 1)
+					}
+				}
+			}()
+			err := app.reloadConfig(path)
+			close(stop)
+			<-done
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(logs.String(), "changed") {
+				t.Errorf("secret got logged:\n%s", logs.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	gocli "github.com/gen64/go-cli"
+	"io/ioutil"
+	"os"
+)
+
+// replayHandler runs a saved webhook payload through the same processing as
+// the daemon does, against an empty cache, and prints what has changed.
+func (app *App) replayHandler(cli *gocli.CLI) int {
+	app.loadConfig(cli.Flag("config"))
+
+	// saved payloads are old and replaying them must not trigger any jobs
+	app.cfg.MaxDeliveryAge = 0
+	app.cfg.MaxActionAge = 0
+	app.cfg.Jenkins = Jenkins{}
+
+	b, err := ioutil.ReadFile(cli.Flag("payload"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading payload file: %s\n", err.Error())
+		return 1
+	}
+
+	diff, err := app.replayPayload(b, cli.Flag("event"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error processing payload: %s\n", err.Error())
+		return 1
+	}
+
+	out, _ := json.MarshalIndent(diff, "", "  ")
+	fmt.Fprintf(os.Stdout, "%s\n", out)
+	return 0
+}
+
+// replayPayload processes the payload and returns changes it made to the
+// cache.
+func (app *App) replayPayload(b []byte, event string) (*CacheDiff, error) {
+	before := app.cache.Snapshot()
+	err := app.processGitHubPayload(context.Background(), &b, event)
+	if err != nil {
+		return nil, err
+	}
+	return app.cache.Snapshot().Diff(before), nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestReplayPayload(t *testing.T) {
+	sample, err := ioutil.ReadFile("testdata/pull_request_opened.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		payload []byte
+		event   string
+		want    *CacheDiff
+		wantErr bool
+	}{
+		{
+			"sample payload",
+			sample,
+			"pull_request",
+			&CacheDiff{
+				AddedBranches:       []BranchEntry{{"aaa", 1, "feature"}},
+				RemovedBranches:     []BranchEntry{},
+				AddedDependencies:   []DependencyEdge{{Repository: "aaa", Number: 1, DependsOnRepository: "bbb", DependsOnNumber: 2}},
+				RemovedDependencies: []DependencyEdge{},
+			},
+			false,
+		},
+		{
+			"other event",
+			sample,
+			"issues",
+			&CacheDiff{[]BranchEntry{}, []BranchEntry{}, []DependencyEdge{}, []DependencyEdge{}},
+			false,
+		},
+		{"invalid payload", []byte("not json"), "pull_request", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			openTestPullRequest(app, "bbb", 2)
+
+			got, err := app.replayPayload(tt.payload, tt.event)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+)
+
+type RescanResult struct {
+	Repositories int   `json:"repositories"`
+	PullRequests int64 `json:"pull_requests"`
+	Dependencies int64 `json:"dependencies"`
+}
+
+// rescan fetches open pull requests of matching repositories into a new cache,
+// the same way it is done on startup, and then replaces the cache with it.
+// Changes made by webhooks while the scan runs are replaced as well but the
+// scan reads the current state from GitHub anyway. The cache is left as it is
+// when ctx is cancelled before the scan completes.
+func (app *App) rescan(ctx context.Context) (RescanResult, error) {
+	repos, err := app.getMatchingRepositories(ctx)
+	if err != nil {
+		return RescanResult{}, err
+	}
+
+	scanner := app.newScanner()
+	scanner.addRepositories(ctx, repos)
+	if ctx.Err() != nil {
+		return RescanResult{}, ctx.Err()
+	}
+	// only open pull requests are listed on GitHub so states of closed ones
+	// are carried over
+	for repo, prs := range app.cache.Snapshot().States {
+		for num, state := range prs {
+			if state != PullRequestStateOpen && scanner.cache.States[repo][num] == "" {
+				scanner.cache.SetState(repo, num, state)
+			}
+		}
+	}
+	app.cache.replace(&scanner.cache)
+
+	stats := app.cache.Stats()
+	return RescanResult{
+		Repositories: len(repos),
+		PullRequests: stats.PullRequests,
+		Dependencies: stats.Dependencies,
+	}, nil
+}
+
+// newScanner returns an app with the same config and an empty cache, which is
+// used to fetch pull requests from GitHub without touching the cache of app.
+func (app *App) newScanner() *App {
+	app.cfgMu.RLock()
+	cfg := app.cfg
+	app.cfgMu.RUnlock()
+	// the scan must not trigger any jobs
+	cfg.Jenkins = Jenkins{}
+
+	scanner := &App{
+		cfg:           cfg,
+		githubPayload: app.githubPayload,
+		githubAPI:     app.githubAPI,
+		metrics:       NewMetrics(),
+	}
+	scanner.cache.init()
+	app.repositoriesMu.RLock()
+	for _, repo := range app.repositories {
+		scanner.setRepositories([]Repository{repo})
+	}
+	app.repositoriesMu.RUnlock()
+	return scanner
+}
+
+// apiHandlerPostRescan rebuilds the cache from GitHub. Only one rescan runs
+// at a time.
+func (app *App) apiHandlerPostRescan(w http.ResponseWriter, r *http.Request) {
+	if !app.checkAPIToken(w, r) {
+		return
+	}
+
+	if app.cfg.PullRequestDependsOn == nil {
+		app.writeFeatureDisabled(w, "PullRequestDependsOn is not configured")
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&app.rescanning, 0, 1) {
+		http.Error(w, "Rescan is already running", http.StatusConflict)
+		return
+	}
+	defer atomic.StoreInt32(&app.rescanning, 0)
+
+	logger.Info("Rescanning repositories")
+	result, err := app.rescan(r.Context())
+	if err != nil {
+		logger.Error("Error rescanning repositories", "error", err)
+		http.Error(w, "Error fetching repository list from GitHub", http.StatusBadGateway)
+		return
+	}
+	logger.Info("Rescanned repositories", "repos", result.Repositories, "prs", result.PullRequests)
+	app.writeJSON(w, r, result)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAPIHandlerPostRescan(t *testing.T) {
+	tests := []struct {
+		name         string
+		failing      bool
+		rescanning   bool
+		status       int
+		want         RescanResult
+		wantBranches map[string]map[int]string
+	}{
+		{"rebuilds cache", false, false, http.StatusOK, RescanResult{Repositories: 2, PullRequests: 2, Dependencies: 1}, map[string]map[int]string{"aaa": {1: "aaa"}, "bbb": {2: "bbb"}}},
+		{"github error", true, false, http.StatusBadGateway, RescanResult{}, map[string]map[int]string{"aaa": {1: "branch-1"}, "zzz": {9: "branch-9"}}},
+		{"already running", false, true, http.StatusConflict, RescanResult{}, map[string]map[int]string{"aaa": {1: "branch-1"}, "zzz": {9: "branch-9"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			responses := map[string]string{
+				"/orgs/o/repos":      `[{"name":"aaa"},{"name":"bbb"}]`,
+				"/repos/o/aaa/pulls": `[{"number":1,"head":{"ref":"aaa"},"body":""}]`,
+				"/repos/o/bbb/pulls": `[{"number":2,"head":{"ref":"bbb"},"body":"DependsOn:aaa#1"}]`,
+			}
+			if tt.failing {
+				delete(responses, "/orgs/o/repos")
+			}
+			newTestGitHub(t, responses)
+			app := newTestApp(t, `{"rate_limit_retries":1,"pull_request_depends_on":{"owner":"o","organization":true,"repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+			// the cache drifted, aaa#1 is on another branch and zzz#9 is closed
+			openTestPullRequest(app, "aaa", 1)
+			openTestPullRequest(app, "zzz", 9)
+			if tt.rescanning {
+				app.rescanning = 1
+			}
+
+			w := httptest.NewRecorder()
+			app.apiHandlerPostRescan(w, httptest.NewRequest("POST", "/rescan", nil))
+			if w.Code != tt.status {
+				t.Fatalf("got status %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusOK {
+				var got RescanResult
+				if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+					t.Fatal(err)
+				}
+				if got != tt.want {
+					t.Errorf("got %+v, want %+v", got, tt.want)
+				}
+			}
+			if got := app.cache.Snapshot().Branches; !reflect.DeepEqual(got, tt.wantBranches) {
+				t.Errorf("got branches %v, want %v", got, tt.wantBranches)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+)
+
+func TestWebhookSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	app := newTestApp(t, `{"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+	postTestWebhook(app, "pull_request", pullRequestPayload("opened", "a", 1, "feature", "Some change"))
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	tests := []struct {
+		name   string
+		parent string
+	}{
+		{"apiHandlerPost", ""},
+		{"processGitHubPayload", "apiHandlerPost"},
+		{"updateCache", "processGitHubPayload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			span, ok := spans[tt.name]
+			if !ok {
+				t.Fatalf("span was not produced")
+			}
+			if tt.parent == "" {
+				return
+			}
+			if span.Parent().SpanID() != spans[tt.parent].SpanContext().SpanID() {
+				t.Errorf("span is not a child of %s", tt.parent)
+			}
+		})
+	}
+}
+
+func TestGitHubAPISpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	newTestGitHub(t, map[string]string{
+		"/repos/o/bbb/pulls": `[{"number":2,"head":{"ref":"b2"},"body":""}]`,
+	})
+	app := newTestApp(t, `{"resync_on_installation_change":true,"pull_request_depends_on":{"owner":"o","repositories":[{"name":"*"}],"exclude_repositories":[]}}`)
+	postTestWebhook(app, "installation_repositories", `{"action":"added","repositories_added":[{"name":"bbb"}]}`)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	span, ok := spans["GitHubAPI.GetPullRequestList"]
+	if !ok {
+		t.Fatalf("span was not produced")
+	}
+	if span.Parent().SpanID() != spans["processGitHubPayload"].SpanContext().SpanID() {
+		t.Errorf("span is not a child of processGitHubPayload")
+	}
+}
@@ -1,3 +1,16 @@
 package main
 
 const VERSION = "0.3.0"
+
+// GitCommit and BuildDate are set at build time, eg.
+// go build -ldflags "-X main.GitCommit=$(git rev-parse --short HEAD) -X main.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	GitCommit = ""
+	BuildDate = ""
+)
+
+type VersionInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	gocli "github.com/gen64/go-cli"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const watchReconnectDelay = 5 * time.Second
+
+func (app *App) watchHandler(cli *gocli.CLI) int {
+	app.loadConfig(cli.Flag("config"))
+
+	url := app.getDaemonAdminURL(cli.Flag("address")) + "/events"
+	for {
+		err := app.watchEvents(url, os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s. Reconnecting in %s...\n", err.Error(), watchReconnectDelay)
+		}
+		time.Sleep(watchReconnectDelay)
+	}
+}
+
+// getDaemonURL returns base URL of the running daemon. When address is empty
+// then the daemon is expected to listen locally on port from config.
+func (app *App) getDaemonURL(address string) string {
+	if address != "" {
+		return strings.TrimRight(address, "/")
+	}
+	if app.cfg.IsTLSEnabled() {
+		return "https://127.0.0.1:" + app.cfg.Port
+	}
+	return "http://127.0.0.1:" + app.cfg.Port
+}
+
+// getDaemonAdminURL returns base URL of admin endpoints of the running daemon,
+// which are served on AdminPort when it is set.
+func (app *App) getDaemonAdminURL(address string) string {
+	if address != "" || app.cfg.AdminPort == "" {
+		return app.getDaemonURL(address)
+	}
+	if app.cfg.IsTLSEnabled() {
+		return "https://127.0.0.1:" + app.cfg.AdminPort
+	}
+	return "http://127.0.0.1:" + app.cfg.AdminPort
+}
+
+// getDaemonClient returns HTTP client for the running daemon. With TLS
+// enabled the configured certificate is trusted in addition to system ones so
+// that a self-signed certificate works too.
+func (app *App) getDaemonClient() *http.Client {
+	if !app.cfg.IsTLSEnabled() {
+		return &http.Client{}
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	pem, err := ioutil.ReadFile(app.cfg.TLSCertFile)
+	if err == nil {
+		pool.AppendCertsFromPEM(pem)
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}
+}
+
+// watchEvents reads the event stream until the connection is closed and
+// prints each cache change to w.
+func (app *App) watchEvents(url string, w io.Writer) error {
+	req, err := http.NewRequest("GET", url, strings.NewReader(""))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Accept", "text/event-stream")
+	if app.cfg.APITokenHeader != "" && app.cfg.APITokenValue != "" {
+		req.Header.Add(app.cfg.APITokenHeader, app.cfg.APITokenValue)
+	}
+
+	c := app.getDaemonClient()
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("Got HTTP status %d from %s", resp.StatusCode, url))
+	}
+	fmt.Fprintf(os.Stderr, "Connected to %s\n", url)
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		var event CacheEvent
+		err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &event)
+		if err != nil {
+			continue
+		}
+
+		deps := []string{}
+		for _, dep := range event.Dependencies {
+			deps = append(deps, fmt.Sprintf("%s#%d", dep.Repository, dep.Number))
+		}
+		fmt.Fprintf(w, "%s %-8s %s#%d %s depends on: [%s]\n", event.Time.Format(time.RFC3339), event.Action, event.Repository, event.Number, event.Branch, strings.Join(deps, ", "))
+	}
+	if scanner.Err() != nil {
+		return scanner.Err()
+	}
+	return errors.New("Connection to " + url + " closed")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWatchEvents(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		stream     string
+		wantOutput string
+		wantErr    string
+	}{
+		{
+			"events",
+			http.StatusOK,
+			": heartbeat\n\n" +
+				"event: cache\ndata: {\"action\":\"opened\",\"repository\":\"a\",\"number\":1,\"branch\":\"foo\",\"dependencies\":[{\"repository\":\"b\",\"number\":2}],\"time\":\"2021-01-02T03:04:05Z\"}\n\n" +
+				"event: cache\ndata: {\"action\":\"closed\",\"repository\":\"b\",\"number\":2,\"dependencies\":[],\"time\":\"2021-01-02T03:04:06Z\"}\n\n",
+			"2021-01-02T03:04:05Z opened   a#1 foo depends on: [b#2]\n" +
+				"2021-01-02T03:04:06Z closed   b#2  depends on: []\n",
+			"closed",
+		},
+		{
+			"malformed event",
+			http.StatusOK,
+			"event: cache\ndata: {invalid\n\n",
+			"",
+			"closed",
+		},
+		{
+			"unauthorized",
+			http.StatusUnauthorized,
+			"",
+			"",
+			"Got HTTP status 401",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var token string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				token = r.Header.Get("X-T")
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.stream)
+			}))
+			defer server.Close()
+
+			app := newTestApp(t, `{"incoming_api_token_header":"X-T","incoming_api_token_value":"one"}`)
+			var out bytes.Buffer
+			err := app.watchEvents(server.URL+"/events", &out)
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want error containing %q", err, tt.wantErr)
+			}
+			if out.String() != tt.wantOutput {
+				t.Errorf("got output %q, want %q", out.String(), tt.wantOutput)
+			}
+			if token != "one" {
+				t.Errorf("got API token %q", token)
+			}
+		})
+	}
+}
+
+func TestGetDaemonURL(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"", "http://127.0.0.1:32000"},
+		{"http://daemon:8080/", "http://daemon:8080"},
+	}
+	app := newTestApp(t, `{"port":"32000"}`)
+	for _, tt := range tests {
+		if got := app.getDaemonURL(tt.address); got != tt.want {
+			t.Errorf("got %s for %q, want %s", got, tt.address, tt.want)
+		}
+	}
+}
+
+func TestGetDaemonAdminURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     string
+		address string
+		want    string
+	}{
+		{"no admin port", `{"port":"32000"}`, "", "http://127.0.0.1:32000"},
+		{"admin port", `{"port":"32000","admin_port":"32001"}`, "", "http://127.0.0.1:32001"},
+		{"address given", `{"port":"32000","admin_port":"32001"}`, "http://daemon:9090/", "http://daemon:9090"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, tt.cfg)
+			if got := app.getDaemonAdminURL(tt.address); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}